@@ -1,41 +1,86 @@
 package main
 
 import (
-	"crypto/sha256"
 	"fmt"
-	"io"
-	"log"
-	"net/http"
+	"log/slog"
+	"net/url"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/Barrioslopezfd/httpfromtcp/cmd/server"
-	"github.com/Barrioslopezfd/httpfromtcp/internal/headers"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/accesslog"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/compress"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/etag"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/metrics"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/proxy"
 	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
 	"github.com/Barrioslopezfd/httpfromtcp/internal/response"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/sse"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/trace"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/websocket"
 )
 
 const port = 42069
 
+var httpbin = proxy.New(&url.URL{Scheme: "https", Host: "httpbin.org"}, proxy.Config{
+	StripPrefix: "/httpbin",
+	Timeout:     30 * time.Second,
+})
+
 func main() {
-	server, err := server.Serve(handler, port)
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	m := metrics.New(metrics.Config{})
+	// Spans go to a collector when one is configured the usual way;
+	// otherwise trace context is only passed on.
+	tracing := trace.Config{Logger: logger}
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); endpoint != "" {
+		tracing.Exporter = trace.NewHTTPExporter(endpoint)
+	}
+	tracer := trace.New(tracing)
+	defer tracer.Close()
+	logged, err := accesslog.New(m.Wrap(tracer.Wrap(compress.New(etag.New(handler, etag.Config{}), compress.Config{}))), accesslog.Config{})
+	if err != nil {
+		logger.Error("setting up the access log", "err", err)
+		os.Exit(1)
+	}
+	server, err := server.Serve(logged, port,
+		server.WithReadHeaderTimeout(10*time.Second),
+		server.WithReadBodyTimeout(30*time.Second),
+		server.WithWriteTimeout(30*time.Second),
+		server.WithIdleTimeout(60*time.Second),
+		server.WithHTTP2(),
+		server.WithRequestDecoding(0, 0),
+		server.WithLogger(logger),
+		server.WithRequestID(nil),
+		server.WithObserver(m),
+	)
 	if err != nil {
-		log.Fatalf("Error starting server: %v", err)
+		logger.Error("starting server", "err", err)
+		os.Exit(1)
 	}
 	defer server.Close()
-	log.Println("Server started on port", port)
+	logger.Info("server started", "port", port)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
-	log.Println("Server gracefully stopped")
+	logger.Info("server gracefully stopped")
 }
 
 func handler(w *response.Writer, r *request.Request) {
 	if strings.HasPrefix(r.RequestLine.RequestTarget, "/httpbin") {
-		handlerChunk(w, r)
+		httpbin(w, r)
+		return
+	}
+	if r.RequestLine.RequestTarget == "/ws" {
+		handlerWebSocket(w, r)
+		return
+	}
+	if r.RequestLine.RequestTarget == "/events" {
+		handlerEvents(w, r)
 		return
 	}
 	if r.RequestLine.RequestTarget == "/yourproblem" {
@@ -50,6 +95,42 @@ func handler(w *response.Writer, r *request.Request) {
 	handler200(w, r)
 }
 
+func handlerWebSocket(w *response.Writer, r *request.Request) {
+	conn, err := websocket.Upgrade(w, r, websocket.Config{})
+	if err != nil {
+		return
+	}
+	for {
+		t, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := conn.WriteMessage(t, msg); err != nil {
+			return
+		}
+	}
+}
+
+func handlerEvents(w *response.Writer, r *request.Request) {
+	sw, err := sse.NewWriter(w, r, sse.Config{})
+	if err != nil {
+		return
+	}
+	defer sw.Close()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := sw.Send(sse.Event{Event: "time", Data: now.Format(time.RFC3339)}); err != nil {
+				return
+			}
+		case <-sw.Done():
+			return
+		}
+	}
+}
+
 func handler200(w *response.Writer, r *request.Request) {
 	w.WriteStatusLine(response.OK)
 	body := toHtmlString(200, "Success!!", "Your request was an absolute banger.")
@@ -88,57 +169,3 @@ func toHtmlString(code int, errorMsg string, body string) string {
 	</body>
 	</html>`, code, errorMsg, errorMsg, body)
 }
-
-func handlerChunk(w *response.Writer, r *request.Request) {
-	path := strings.TrimPrefix(r.RequestLine.RequestTarget, "/httpbin/")
-	url := "https://httpbin.org/" + path
-	res, err := http.Get(url)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer res.Body.Close()
-	err = w.WriteStatusLine(response.OK)
-	if err != nil {
-		log.Fatal(err)
-	}
-	h := response.GetDefaultHeaders()
-	h.Remove("Content-Length")
-	h.Replace("Content-Type", "text/html")
-	h.Replace("Transfer-Encoding", "chunked")
-	h.Set("trailer", "x-content-sha256, x-content-length")
-	w.WriteHeaders(h)
-	buffer := make([]byte, 1024)
-	body := make([]byte, 0)
-	for {
-		n, err := res.Body.Read(buffer)
-		fmt.Println("Read", n, "bytes")
-		if n > 0 {
-			_, err := w.WriteChunkedBody(buffer[:n])
-			if err != nil {
-				fmt.Println("Error writing chunked body:", err.Error())
-				break
-			}
-			body = append(body, buffer[:n]...)
-		}
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			fmt.Println("Error reading response body:", err.Error())
-			break
-		}
-	}
-	_, err = w.WriteChunkedBodyDone()
-	if err != nil {
-		fmt.Println("Error writing chunked body done:", err.Error())
-	}
-
-	trailer := headers.NewHeaders()
-	sha := sha256.Sum256(body)
-	trailer.Set("X-Content-SHA256", fmt.Sprintf("%x", sha))
-	trailer.Set("X-Content-Length", fmt.Sprint(len(body)))
-	err = w.WriteTrailers(trailer)
-	if err != nil {
-		fmt.Println(err.Error())
-	}
-}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Barrioslopezfd/httpfromtcp/internal/response"
+)
+
+var aLongTimeAgo = time.Unix(1, 0)
+
+type ConnState int
+
+const (
+	// STATE_NEW is a connection that was just accepted.
+	STATE_NEW ConnState = iota
+	// STATE_ACTIVE is a connection whose request headers have been read and
+	// whose handler is running.
+	STATE_ACTIVE
+	// STATE_IDLE is a kept-alive connection waiting for its next request.
+	STATE_IDLE
+	// STATE_HIJACKED is a connection taken over by a handler. It is terminal,
+	// the server will not report STATE_CLOSED for it.
+	STATE_HIJACKED
+	// STATE_CLOSED is a connection the server has closed.
+	STATE_CLOSED
+)
+
+var connStateName = map[ConnState]string{
+	STATE_NEW:      "new",
+	STATE_ACTIVE:   "active",
+	STATE_IDLE:     "idle",
+	STATE_HIJACKED: "hijacked",
+	STATE_CLOSED:   "closed",
+}
+
+func (c ConnState) String() string {
+	return connStateName[c]
+}
+
+func (s *Server) setState(conn net.Conn, state ConnState) {
+	if s.connState != nil {
+		s.connState(conn, state)
+	}
+}
+
+// connReader sits between a connection and its bufio.Reader. While a handler
+// runs it keeps a one byte read outstanding so that a client hanging up
+// cancels the request context. A byte that arrives in the meantime belongs to
+// the next pipelined request and is handed out by the following Read.
+type connReader struct {
+	conn net.Conn
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	inRead  bool
+	aborted bool
+	hasByte bool
+	byteBuf [1]byte
+	cancel  context.CancelFunc
+}
+
+func newConnReader(conn net.Conn) *connReader {
+	cr := &connReader{conn: conn}
+	cr.cond = sync.NewCond(&cr.mu)
+	return cr
+}
+
+func (cr *connReader) Read(p []byte) (int, error) {
+	cr.mu.Lock()
+	if cr.inRead {
+		cr.mu.Unlock()
+		return 0, errors.New("concurrent read on connection")
+	}
+	if len(p) == 0 {
+		cr.mu.Unlock()
+		return 0, nil
+	}
+	if cr.hasByte {
+		p[0] = cr.byteBuf[0]
+		cr.hasByte = false
+		cr.mu.Unlock()
+		return 1, nil
+	}
+	cr.inRead = true
+	cr.mu.Unlock()
+
+	n, err := cr.conn.Read(p)
+
+	cr.mu.Lock()
+	cr.inRead = false
+	cr.mu.Unlock()
+	cr.cond.Broadcast()
+	return n, err
+}
+
+func (cr *connReader) startBackgroundRead(cancel context.CancelFunc) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.inRead || cr.hasByte {
+		return
+	}
+	cr.inRead = true
+	cr.cancel = cancel
+	cr.conn.SetReadDeadline(time.Time{})
+	go cr.backgroundRead()
+}
+
+func (cr *connReader) backgroundRead() {
+	n, err := cr.conn.Read(cr.byteBuf[:])
+	cr.mu.Lock()
+	if n == 1 {
+		cr.hasByte = true
+	}
+	if err != nil && !(cr.aborted && errors.Is(err, os.ErrDeadlineExceeded)) {
+		cr.cancel()
+	}
+	cr.aborted = false
+	cr.inRead = false
+	cr.mu.Unlock()
+	cr.cond.Broadcast()
+}
+
+// resumeBackgroundRead watches for a disconnect again after the handler read
+// from the connection itself.
+func (cr *connReader) resumeBackgroundRead() {
+	cr.mu.Lock()
+	cancel := cr.cancel
+	cr.mu.Unlock()
+	if cancel != nil {
+		cr.startBackgroundRead(cancel)
+	}
+}
+
+// abortPendingRead stops the background read and waits for it to return.
+func (cr *connReader) abortPendingRead() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if !cr.inRead {
+		return
+	}
+	cr.aborted = true
+	cr.conn.SetReadDeadline(aLongTimeAgo)
+	for cr.inRead {
+		cr.cond.Wait()
+	}
+	cr.conn.SetReadDeadline(time.Time{})
+}
+
+// bodyState follows a request body left on the wire for the handler. A
+// streamed body may be read on another goroutine, as the proxy's upstream
+// transport does, even after the handler has returned.
+type bodyState struct {
+	mu       sync.Mutex
+	started  bool
+	read     bool
+	err      error
+	returned bool
+}
+
+func (b *bodyState) start() {
+	b.mu.Lock()
+	b.started = true
+	b.mu.Unlock()
+}
+
+// end records how reading the body ended and reports whether the handler
+// is still running, so the connection should be watched again.
+func (b *bodyState) end(err error) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.read = err == nil
+	b.err = err
+	return !b.returned
+}
+
+func (b *bodyState) handlerReturned() {
+	b.mu.Lock()
+	b.returned = true
+	b.mu.Unlock()
+}
+
+func (b *bodyState) state() (started bool, read bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.started, b.read, b.err
+}
+
+// connWriter is the io.Writer HTTP/1.1 handlers write through. It also
+// implements response.Hijacker for handlers that take the connection over.
+type connWriter struct {
+	s        *Server
+	conn     net.Conn
+	cr       *connReader
+	reader   *bufio.Reader
+	hijacked bool
+}
+
+func (cw *connWriter) Write(p []byte) (int, error) {
+	if cw.hijacked {
+		return 0, response.ErrHijacked
+	}
+	return cw.conn.Write(p)
+}
+
+// Hijack hands over the connection along with whatever the client sent past
+// the current request. The server will not read, write or close the
+// connection afterwards.
+func (cw *connWriter) Hijack() (net.Conn, []byte, error) {
+	if cw.hijacked {
+		return nil, nil, response.ErrHijacked
+	}
+	cw.cr.abortPendingRead()
+	cw.conn.SetDeadline(time.Time{})
+	cw.hijacked = true
+
+	buffered, _ := cw.reader.Peek(cw.reader.Buffered())
+	rest := append([]byte(nil), buffered...)
+	cw.cr.mu.Lock()
+	if cw.cr.hasByte {
+		rest = append(rest, cw.cr.byteBuf[0])
+		cw.cr.hasByte = false
+	}
+	cw.cr.mu.Unlock()
+	cw.s.setState(cw.conn, STATE_HIJACKED)
+	return cw.conn, rest, nil
+}
+
+// SetWriteDeadline lets long-lived responses push the write timeout out
+// while they keep making progress.
+func (cw *connWriter) SetWriteDeadline(t time.Time) error {
+	return cw.conn.SetWriteDeadline(t)
+}
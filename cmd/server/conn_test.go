@@ -0,0 +1,394 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Barrioslopezfd/httpfromtcp/internal/headers"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/proxyproto"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/requestid"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHijack(t *testing.T) {
+	var mu sync.Mutex
+	var states []ConnState
+	handler := func(w *response.Writer, r *request.Request) {
+		conn, rest, err := w.Hijack()
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		_, _, err = w.Hijack()
+		assert.ErrorIs(t, err, response.ErrHijacked)
+
+		conn.Write([]byte("tunnel open\n"))
+		conn.Write(rest)
+		io.Copy(conn, conn)
+	}
+	srv, err := Serve(handler, 0, WithConnState(func(_ net.Conn, state ConnState) {
+		mu.Lock()
+		states = append(states, state)
+		mu.Unlock()
+	}))
+	require.NoError(t, err)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Test: Bytes sent right behind the request come back with the conn
+	_, err = conn.Write([]byte("GET /tunnel HTTP/1.1\r\nHost: localhost\r\n\r\nearly "))
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "tunnel open\n", line)
+	buf := make([]byte, len("early "))
+	_, err = io.ReadFull(reader, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "early ", string(buf))
+
+	// Test: The server no longer reads from the connection
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	buf = make([]byte, len("GET / HTTP/1.1\r\n\r\n"))
+	_, err = io.ReadFull(reader, buf)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(buf), "GET / HTTP/1.1"))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []ConnState{STATE_NEW, STATE_ACTIVE, STATE_HIJACKED}, states)
+}
+
+func TestExpectContinue(t *testing.T) {
+	handler := func(w *response.Writer, r *request.Request) {
+		switch r.RequestLine.RequestTarget {
+		case "/reject":
+			w.WriteStatusLine(response.BAD_REQUEST)
+			w.WriteHeaders(response.GetDefaultHeaders())
+		case "/hints":
+			hints := headers.NewHeaders()
+			hints.Replace("Link", "</style.css>; rel=preload; as=style")
+			w.WriteInformational(response.EARLY_HINTS, hints)
+			fallthrough
+		default:
+			body, err := r.ReadBody()
+			if err != nil {
+				return
+			}
+			w.WriteStatusLine(response.OK)
+			h := response.GetDefaultHeaders()
+			h.Replace("Connection", "keep-alive")
+			h.Replace("Content-Length", fmt.Sprint(len(body)))
+			w.WriteHeaders(h)
+			w.WriteBody(body)
+		}
+	}
+	srv, err := Serve(handler, 0)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	readHead := func(reader *bufio.Reader) string {
+		var head strings.Builder
+		for {
+			line, err := reader.ReadString('\n')
+			require.NoError(t, err)
+			head.WriteString(line)
+			if line == "\r\n" {
+				return head.String()
+			}
+		}
+	}
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	// Test: 100 Continue arrives before the body is sent
+	_, err = conn.Write([]byte("POST /echo HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n", readHead(reader))
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(readHead(reader), "HTTP/1.1 200 OK\r\n"))
+	body := make([]byte, 5)
+	_, err = io.ReadFull(reader, body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+
+	// Test: Early hints come first and the connection stays usable
+	_, err = conn.Write([]byte("POST /hints HTTP/1.1\r\nHost: localhost\r\nContent-Length: 2\r\n\r\nhi"))
+	require.NoError(t, err)
+	head := readHead(reader)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 103 Early Hints\r\n"))
+	assert.Contains(t, head, "link: </style.css>; rel=preload; as=style\r\n")
+	assert.True(t, strings.HasPrefix(readHead(reader), "HTTP/1.1 200 OK\r\n"))
+	body = make([]byte, 2)
+	_, err = io.ReadFull(reader, body)
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(body))
+
+	// Test: A rejection skips 100 Continue and closes the connection
+	_, err = conn.Write([]byte("POST /reject HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(readHead(reader), "HTTP/1.1 400 Bad Request\r\n"))
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestRequestDecoding(t *testing.T) {
+	handler := func(w *response.Writer, r *request.Request) {
+		body, err := r.ReadBody()
+		if err != nil {
+			return
+		}
+		w.WriteStatusLine(response.OK)
+		h := response.GetDefaultHeaders()
+		h.Replace("Content-Length", fmt.Sprint(len(body)))
+		w.WriteHeaders(h)
+		w.WriteBody(body)
+	}
+	srv, err := Serve(handler, 0, WithRequestDecoding(0, 0))
+	require.NoError(t, err)
+	defer srv.Close()
+	url := "http://" + srv.Addr().String() + "/upload"
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("hello, compressed world"))
+	zw.Close()
+
+	// Test: gzip bodies reach the handler decoded, with and without Expect
+	for _, expect := range []string{"", "100-continue"} {
+		req, err := http.NewRequest("POST", url, bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+		req.Header.Set("Content-Encoding", "gzip")
+		if expect != "" {
+			req.Header.Set("Expect", expect)
+		}
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, "hello, compressed world", string(body))
+	}
+
+	// Test: Unknown encodings get 415
+	req, err := http.NewRequest("POST", url, strings.NewReader("data"))
+	require.NoError(t, err)
+	req.Header.Set("Content-Encoding", "br")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 415, res.StatusCode)
+	assert.Equal(t, "gzip, deflate", res.Header.Get("Accept-Encoding"))
+}
+
+func TestProxyProtocol(t *testing.T) {
+	handler := func(w *response.Writer, r *request.Request) {
+		body := r.RemoteAddr.String()
+		if r.Proxy != nil {
+			body += fmt.Sprintf(" v%d", r.Proxy.Version)
+		}
+		h := response.GetDefaultHeaders()
+		h.Replace("Content-Length", fmt.Sprint(len(body)))
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	}
+	srv, err := Serve(handler, 0, WithProxyProtocol(proxyproto.Config{
+		Trusted:  []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+		Required: true,
+	}))
+	require.NoError(t, err)
+	defer srv.Close()
+	addr := net.JoinHostPort("127.0.0.1", fmt.Sprint(srv.Addr().(*net.TCPAddr).Port))
+
+	send := func(raw string) (*http.Response, string, error) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte(raw))
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return nil, "", err
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		return res, string(body), nil
+	}
+
+	// Test: Handlers see the client behind the balancer
+	res, body, err := send("PROXY TCP4 203.0.113.7 10.0.0.1 51234 80\r\nGET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "203.0.113.7:51234 v1", body)
+
+	// Test: A trusted peer without the header is refused
+	res, _, err = send("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if err == nil {
+		assert.Equal(t, 400, res.StatusCode)
+	}
+}
+
+// syncBuffer lets the test read what the server's goroutines log.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLogging(t *testing.T) {
+	handler := func(w *response.Writer, r *request.Request) {
+		if r.RequestLine.RequestTarget == "/panic" {
+			panic("boom")
+		}
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders())
+	}
+	var out syncBuffer
+	logger := slog.New(slog.NewJSONHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	srv, err := Serve(handler, 0, WithLogger(logger))
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: A panicking handler gets a 500, a closed connection and a log entry
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("GET /panic HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	var entry map[string]any
+	line, _, _ := strings.Cut(out.String(), "\n")
+	require.NoError(t, json.Unmarshal([]byte(line), &entry))
+	assert.Equal(t, "ERROR", entry["level"])
+	assert.Equal(t, "handler panic", entry["msg"])
+	assert.Equal(t, "boom", entry["panic"])
+	assert.Equal(t, "GET", entry["method"])
+	assert.Equal(t, "/panic", entry["target"])
+	assert.Equal(t, conn.LocalAddr().String(), entry["remote_addr"])
+	assert.Contains(t, entry["stack"], "TestLogging")
+
+	// Test: A malformed request is logged as a warning with its status
+	conn, err = net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("GET /\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	entry = nil
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &entry))
+	assert.Equal(t, "WARN", entry["level"])
+	assert.Equal(t, "bad request", entry["msg"])
+	assert.EqualValues(t, 400, entry["status"])
+}
+
+func TestRequestID(t *testing.T) {
+	handler := func(w *response.Writer, r *request.Request) {
+		if r.RequestLine.RequestTarget == "/panic" {
+			panic("boom")
+		}
+		id, _ := requestid.FromContext(r.Context())
+		header, _ := r.Headers.Get("x-request-id")
+		body := id + " " + header
+		h := response.GetDefaultHeaders()
+		h.Replace("content-length", fmt.Sprint(len(body)))
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	}
+	var out syncBuffer
+	logger := slog.New(slog.NewJSONHandler(&out, nil))
+	n := 0
+	srv, err := Serve(handler, 0, WithLogger(logger), WithRequestID(func() string {
+		n++
+		return fmt.Sprintf("gen-%d", n)
+	}))
+	require.NoError(t, err)
+	defer srv.Close()
+
+	get := func(raw string) (*http.Response, string) {
+		conn, err := net.Dial("tcp", srv.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Write([]byte(raw))
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	// Test: A request without an ID gets one on its context, headers and response
+	resp, body := get("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "gen-1 gen-1", body)
+	assert.Equal(t, "gen-1", resp.Header.Get("X-Request-ID"))
+
+	// Test: The client's ID is kept
+	resp, body = get("GET / HTTP/1.1\r\nHost: localhost\r\nX-Request-ID: client-7\r\n\r\n")
+	assert.Equal(t, "client-7 client-7", body)
+	assert.Equal(t, "client-7", resp.Header.Get("X-Request-ID"))
+
+	// Test: An unusable ID is replaced
+	resp, body = get("GET / HTTP/1.1\r\nHost: localhost\r\nX-Request-ID: " + strings.Repeat("x", 300) + "\r\n\r\n")
+	assert.Equal(t, "gen-2 gen-2", body)
+	assert.Equal(t, "gen-2", resp.Header.Get("X-Request-ID"))
+
+	// Test: Log lines about the request carry its ID, as does the 500
+	resp, _ = get("GET /panic HTTP/1.1\r\nHost: localhost\r\nX-Request-ID: client-8\r\n\r\n")
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Equal(t, "client-8", resp.Header.Get("X-Request-ID"))
+	var entry map[string]any
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimSpace(out.String())), &entry))
+	assert.Equal(t, "handler panic", entry["msg"])
+	assert.Equal(t, "client-8", entry["request_id"])
+}
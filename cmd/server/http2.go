@@ -0,0 +1,961 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Barrioslopezfd/httpfromtcp/internal/headers"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/http2"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/http2/hpack"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/proxyproto"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/requestid"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/response"
+)
+
+const (
+	h2MaxConcurrentStreams = 100
+	h2InitialWindow        = 1 << 20
+	h2MaxHeaderListSize    = 1 << 20
+	h2MaxBodySize          = 10 << 20
+)
+
+var (
+	errStreamClosed = errors.New("http2: stream closed")
+	errBodyTooLarge = errors.New("http2: request body too large")
+	errBodyLength   = errors.New("http2: body does not match content-length")
+)
+
+// connectionHeaders are HTTP/1.1 connection-specific fields that HTTP/2
+// forbids.
+var connectionHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+type h2Conn struct {
+	srv    *Server
+	conn   net.Conn
+	log    *slog.Logger
+	framer *http2.Framer
+	dec    *hpack.Decoder
+	enc    *hpack.Encoder
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu               sync.Mutex
+	cond             *sync.Cond
+	streams          map[uint32]*h2Stream
+	active           int
+	lastStreamID     uint32
+	sendWindow       int64
+	recvWindow       int64
+	peerInitWindow   int64
+	peerMaxFrameSize uint32
+	peerTableSize    *uint32
+	goingAway        bool
+	closed           bool
+
+	// Header block being reassembled from HEADERS and CONTINUATION frames.
+	// Only touched by the read loop.
+	contID        uint32
+	contBlock     []byte
+	contEndStream bool
+}
+
+type h2Stream struct {
+	c      *h2Conn
+	id     uint32
+	req    *request.Request
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Guarded by c.mu.
+	body       bytes.Buffer
+	bodyErr    error
+	sendWindow int64
+	recvWindow int64
+	// unacked is body taken out of the connection window that has not been
+	// given back, since the handler has not asked for it yet.
+	unacked    int64
+	reading    bool
+	remoteDone bool
+	running    bool
+	reset      bool
+	wroteHead  bool
+	ended      bool
+}
+
+// deadlineWriter applies the write timeout to every frame, since an HTTP/2
+// connection has no single response to time.
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (dw deadlineWriter) Write(p []byte) (int, error) {
+	if dw.timeout > 0 {
+		dw.conn.SetWriteDeadline(time.Now().Add(dw.timeout))
+	}
+	return dw.conn.Write(p)
+}
+
+func (s *Server) serveHTTP2(conn net.Conn, reader io.Reader, log *slog.Logger) {
+	c := &h2Conn{
+		srv:              s,
+		conn:             conn,
+		log:              log.With("proto", "h2"),
+		framer:           http2.NewFramer(deadlineWriter{conn, s.writeTimeout}, reader),
+		dec:              hpack.NewDecoder(http2.DefaultHeaderTableSize),
+		enc:              hpack.NewEncoder(),
+		streams:          map[uint32]*h2Stream{},
+		sendWindow:       http2.DefaultInitialWindow,
+		recvWindow:       h2InitialWindow,
+		peerInitWindow:   http2.DefaultInitialWindow,
+		peerMaxFrameSize: http2.DefaultMaxFrameSize,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	c.dec.MaxHeaderListSize = h2MaxHeaderListSize
+	c.ctx, c.cancel = context.WithCancel(s.ctx)
+	defer c.close()
+
+	setReadDeadline(conn, s.readHeaderTimeout)
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(reader, preface); err != nil || string(preface) != http2.ClientPreface {
+		c.log.Warn("bad client preface")
+		if c.srv.observer != nil {
+			c.srv.observer.ParseError("h2_preface")
+		}
+		return
+	}
+	err := c.framer.WriteSettings(
+		http2.Setting{ID: http2.SETTINGS_MAX_CONCURRENT_STREAMS, Val: h2MaxConcurrentStreams},
+		http2.Setting{ID: http2.SETTINGS_INITIAL_WINDOW_SIZE, Val: h2InitialWindow},
+		http2.Setting{ID: http2.SETTINGS_MAX_HEADER_LIST_SIZE, Val: h2MaxHeaderListSize},
+	)
+	if err == nil {
+		err = c.framer.WriteWindowUpdate(0, h2InitialWindow-http2.DefaultInitialWindow)
+	}
+	if err != nil {
+		return
+	}
+	go c.watchShutdown()
+
+	first := true
+	for {
+		c.setIdleDeadline()
+		f, err := c.framer.ReadFrame()
+		if err == nil && first {
+			first = false
+			if f.Type != http2.FRAME_SETTINGS || f.Has(http2.FLAG_ACK) {
+				err = http2.ConnectionError{Code: http2.PROTOCOL_ERROR, Reason: "first frame is not SETTINGS"}
+			}
+		}
+		if err == nil {
+			err = c.processFrame(f)
+		}
+		if err == nil {
+			continue
+		}
+
+		var se http2.StreamError
+		var ce http2.ConnectionError
+		switch {
+		case errors.As(err, &se):
+			c.resetStream(se.StreamID, se.Code)
+			continue
+		case errors.As(err, &ce):
+			c.log.Warn("connection error", "err", err)
+			c.goAway(ce.Code, ce.Reason)
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			c.goAway(http2.NO_ERROR, "idle timeout")
+		}
+		return
+	}
+}
+
+// setIdleDeadline arms the idle timeout while no stream is open.
+func (c *h2Conn) setIdleDeadline() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.active == 0 {
+		setReadDeadline(c.conn, c.srv.idleTimeout)
+	} else {
+		c.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+func (c *h2Conn) watchShutdown() {
+	select {
+	case <-c.srv.done:
+	case <-c.ctx.Done():
+		return
+	}
+	c.mu.Lock()
+	c.goingAway = true
+	idle := c.active == 0
+	c.mu.Unlock()
+	c.goAway(http2.NO_ERROR, "server shutting down")
+	if idle {
+		c.conn.Close()
+	}
+}
+
+func (c *h2Conn) goAway(code http2.ErrCode, reason string) {
+	c.mu.Lock()
+	last := c.lastStreamID
+	c.mu.Unlock()
+	c.framer.WriteGoAway(last, code, reason)
+}
+
+func (c *h2Conn) close() {
+	c.mu.Lock()
+	c.closed = true
+	for _, st := range c.streams {
+		st.cancel()
+	}
+	c.mu.Unlock()
+	c.cond.Broadcast()
+	c.cancel()
+}
+
+func (c *h2Conn) processFrame(f *http2.Frame) error {
+	if c.contID != 0 && f.Type != http2.FRAME_CONTINUATION {
+		return http2.ConnectionError{Code: http2.PROTOCOL_ERROR, Reason: fmt.Sprintf("%s in the middle of a header block", f.Type)}
+	}
+	switch f.Type {
+	case http2.FRAME_DATA:
+		return c.processData(f)
+	case http2.FRAME_HEADERS:
+		return c.processHeaders(f)
+	case http2.FRAME_CONTINUATION:
+		return c.processContinuation(f)
+	case http2.FRAME_PRIORITY:
+		if f.StreamID == 0 {
+			return http2.ConnectionError{Code: http2.PROTOCOL_ERROR, Reason: "PRIORITY on stream 0"}
+		}
+		if len(f.Payload) != 5 {
+			return http2.StreamError{StreamID: f.StreamID, Code: http2.FRAME_SIZE_ERROR, Reason: "PRIORITY not 5 bytes"}
+		}
+		return nil
+	case http2.FRAME_RST_STREAM:
+		return c.processRSTStream(f)
+	case http2.FRAME_SETTINGS:
+		return c.processSettings(f)
+	case http2.FRAME_PUSH_PROMISE:
+		return http2.ConnectionError{Code: http2.PROTOCOL_ERROR, Reason: "PUSH_PROMISE from client"}
+	case http2.FRAME_PING:
+		data, err := f.PingData()
+		if err != nil || f.Has(http2.FLAG_ACK) {
+			return err
+		}
+		return c.framer.WritePing(true, data)
+	case http2.FRAME_GOAWAY:
+		if _, _, err := f.GoAway(); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.goingAway = true
+		idle := c.active == 0
+		c.mu.Unlock()
+		if idle {
+			return io.EOF
+		}
+		return nil
+	case http2.FRAME_WINDOW_UPDATE:
+		return c.processWindowUpdate(f)
+	}
+	// Unknown frame types must be ignored.
+	return nil
+}
+
+func (c *h2Conn) processData(f *http2.Frame) error {
+	id := f.StreamID
+	if id == 0 {
+		return http2.ConnectionError{Code: http2.PROTOCOL_ERROR, Reason: "DATA on stream 0"}
+	}
+	data, err := f.Data()
+	if err != nil {
+		return err
+	}
+	// Padding counts against flow control too.
+	flowLen := int64(len(f.Payload))
+	endStream := f.Has(http2.FLAG_END_STREAM)
+
+	c.mu.Lock()
+	c.recvWindow -= flowLen
+	if c.recvWindow < 0 {
+		c.mu.Unlock()
+		return http2.ConnectionError{Code: http2.FLOW_CONTROL_ERROR, Reason: "connection window exceeded"}
+	}
+	st := c.streams[id]
+	idle := id > c.lastStreamID
+	if st == nil || st.remoteDone {
+		// Nobody is going to read it, so the connection gets it back.
+		c.recvWindow += flowLen
+		c.mu.Unlock()
+		if err := c.refill(0, flowLen); err != nil {
+			return err
+		}
+		if idle {
+			return http2.ConnectionError{Code: http2.PROTOCOL_ERROR, Reason: "DATA on idle stream"}
+		}
+		return http2.StreamError{StreamID: id, Code: http2.STREAM_CLOSED, Reason: "DATA after END_STREAM"}
+	}
+	st.recvWindow -= flowLen
+	if st.recvWindow < 0 {
+		c.recvWindow += flowLen
+		c.mu.Unlock()
+		if err := c.refill(0, flowLen); err != nil {
+			return err
+		}
+		return http2.StreamError{StreamID: id, Code: http2.FLOW_CONTROL_ERROR, Reason: "stream window exceeded"}
+	}
+
+	// The body is only acknowledged as the handler reads it, so one that
+	// never asks for it holds at most a window's worth. Past
+	// h2MaxBodySize the data is dropped and the stream window left shut.
+	var connCredit, streamCredit int64
+	switch {
+	case st.bodyErr != nil:
+		connCredit = flowLen
+	case st.body.Len()+len(data) > h2MaxBodySize:
+		st.bodyErr = errBodyTooLarge
+		st.body.Reset()
+		connCredit = flowLen
+	case st.reading:
+		st.body.Write(data)
+		connCredit, streamCredit = flowLen, flowLen
+	default:
+		st.body.Write(data)
+		st.unacked += flowLen
+	}
+	if endStream {
+		streamCredit = 0
+	}
+	c.recvWindow += connCredit
+	st.recvWindow += streamCredit
+	c.mu.Unlock()
+	c.cond.Broadcast()
+
+	if err := c.refill(0, connCredit); err != nil {
+		return err
+	}
+	if err := c.refill(id, streamCredit); err != nil {
+		return err
+	}
+	if endStream {
+		return c.endStream(st)
+	}
+	return nil
+}
+
+// refill returns n bytes of window to the client, on stream id or on the
+// connection when id is 0.
+func (c *h2Conn) refill(id uint32, n int64) error {
+	if n <= 0 {
+		return nil
+	}
+	return c.framer.WriteWindowUpdate(id, uint32(n))
+}
+
+func (c *h2Conn) processHeaders(f *http2.Frame) error {
+	id := f.StreamID
+	if id == 0 {
+		return http2.ConnectionError{Code: http2.PROTOCOL_ERROR, Reason: "HEADERS on stream 0"}
+	}
+	block, err := f.HeaderBlock()
+	if err != nil {
+		var se http2.StreamError
+		if errors.As(err, &se) {
+			// The block cannot be decoded into a stream, and skipping it
+			// would leave HPACK state out of step.
+			return http2.ConnectionError{Code: http2.PROTOCOL_ERROR, Reason: se.Reason}
+		}
+		return err
+	}
+
+	c.mu.Lock()
+	st := c.streams[id]
+	lastID := c.lastStreamID
+	c.mu.Unlock()
+	if st == nil && (id%2 == 0 || id <= lastID) {
+		return http2.ConnectionError{Code: http2.PROTOCOL_ERROR, Reason: fmt.Sprintf("HEADERS on stream %d after %d", id, lastID)}
+	}
+
+	c.contID = id
+	c.contBlock = append([]byte(nil), block...)
+	c.contEndStream = f.Has(http2.FLAG_END_STREAM)
+	if f.Has(http2.FLAG_END_HEADERS) {
+		return c.endHeaders()
+	}
+	return nil
+}
+
+func (c *h2Conn) processContinuation(f *http2.Frame) error {
+	if c.contID == 0 || f.StreamID != c.contID {
+		return http2.ConnectionError{Code: http2.PROTOCOL_ERROR, Reason: "unexpected CONTINUATION"}
+	}
+	c.contBlock = append(c.contBlock, f.Payload...)
+	if len(c.contBlock) > h2MaxHeaderListSize {
+		return http2.ConnectionError{Code: http2.ENHANCE_YOUR_CALM, Reason: "header block too large"}
+	}
+	if f.Has(http2.FLAG_END_HEADERS) {
+		return c.endHeaders()
+	}
+	return nil
+}
+
+func (c *h2Conn) endHeaders() error {
+	id, block, endStream := c.contID, c.contBlock, c.contEndStream
+	c.contID, c.contBlock = 0, nil
+
+	fields, err := c.dec.Decode(block)
+	tooLarge := errors.Is(err, hpack.ErrHeaderListTooLarge)
+	if err != nil && !tooLarge {
+		return http2.ConnectionError{Code: http2.COMPRESSION_ERROR, Reason: err.Error()}
+	}
+
+	c.mu.Lock()
+	st := c.streams[id]
+	if st != nil {
+		// Trailers. Only the fact that they end the stream matters here.
+		c.mu.Unlock()
+		if st.remoteDone {
+			return http2.StreamError{StreamID: id, Code: http2.STREAM_CLOSED, Reason: "HEADERS after END_STREAM"}
+		}
+		if !endStream {
+			return http2.StreamError{StreamID: id, Code: http2.PROTOCOL_ERROR, Reason: "trailers without END_STREAM"}
+		}
+		return c.endStream(st)
+	}
+	c.lastStreamID = id
+	if c.goingAway {
+		c.mu.Unlock()
+		return nil
+	}
+	if tooLarge || c.active >= h2MaxConcurrentStreams {
+		c.mu.Unlock()
+		return http2.StreamError{StreamID: id, Code: http2.REFUSED_STREAM, Reason: "stream refused"}
+	}
+	c.mu.Unlock()
+
+	req, err := newH2Request(fields)
+	if err != nil {
+		return http2.StreamError{StreamID: id, Code: http2.PROTOCOL_ERROR, Reason: err.Error()}
+	}
+	req.RemoteAddr = c.conn.RemoteAddr()
+	req.LocalAddr = c.conn.LocalAddr()
+	req.Proxy = proxyproto.HeaderOf(c.conn)
+	if tc, ok := c.conn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		req.TLS = &state
+	}
+	req.ResolveForwarded(c.srv.trustedProxies)
+
+	st = &h2Stream{
+		c:          c,
+		id:         id,
+		req:        req,
+		recvWindow: h2InitialWindow,
+	}
+	st.ctx, st.cancel = context.WithCancel(c.ctx)
+	c.mu.Lock()
+	st.sendWindow = c.peerInitWindow
+	c.streams[id] = st
+	c.active++
+	if c.active == 1 {
+		c.srv.setState(c.conn, STATE_ACTIVE)
+	}
+	c.mu.Unlock()
+
+	if endStream {
+		if err := c.endStream(st); err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	st.running = true
+	c.mu.Unlock()
+	go c.runHandler(st)
+	return nil
+}
+
+// newH2Request maps the pseudo-headers onto a request line so handlers see
+// the same Request for both protocols.
+func newH2Request(fields []hpack.HeaderField) (*request.Request, error) {
+	h := headers.NewHeaders()
+	pseudo := map[string]string{}
+	sawRegular := false
+	for _, f := range fields {
+		if strings.HasPrefix(f.Name, ":") {
+			if sawRegular {
+				return nil, fmt.Errorf("pseudo-header %s after regular headers", f.Name)
+			}
+			switch f.Name {
+			case ":method", ":scheme", ":authority", ":path":
+			default:
+				return nil, fmt.Errorf("unknown pseudo-header %s", f.Name)
+			}
+			if _, dup := pseudo[f.Name]; dup {
+				return nil, fmt.Errorf("duplicate pseudo-header %s", f.Name)
+			}
+			pseudo[f.Name] = f.Value
+			continue
+		}
+		sawRegular = true
+		if f.Name != strings.ToLower(f.Name) {
+			return nil, fmt.Errorf("uppercase header name %s", f.Name)
+		}
+		if connectionHeaders[f.Name] || (f.Name == "te" && f.Value != "trailers") {
+			return nil, fmt.Errorf("connection-specific header %s", f.Name)
+		}
+		if v, ok := h[f.Name]; ok {
+			sep := ", "
+			if f.Name == "cookie" {
+				sep = "; "
+			}
+			h[f.Name] = v + sep + f.Value
+			continue
+		}
+		h[f.Name] = f.Value
+	}
+
+	method, path := pseudo[":method"], pseudo[":path"]
+	if method == "" {
+		return nil, errors.New("missing :method")
+	}
+	if method == "CONNECT" {
+		if pseudo[":authority"] == "" || path != "" || pseudo[":scheme"] != "" {
+			return nil, errors.New("malformed CONNECT")
+		}
+		path = pseudo[":authority"]
+	} else if path == "" || pseudo[":scheme"] == "" {
+		return nil, errors.New("missing :path or :scheme")
+	}
+	if _, ok := h.Get("host"); !ok && pseudo[":authority"] != "" {
+		h.Replace("host", pseudo[":authority"])
+	}
+
+	return &request.Request{
+		RequestLine: request.RequestLine{
+			HttpVersion:   "2",
+			RequestTarget: path,
+			Method:        method,
+		},
+		ParserState: request.PARSING_BODY,
+		Headers:     h,
+	}, nil
+}
+
+// endStream marks the request body complete once the client has sent all
+// of it.
+func (c *h2Conn) endStream(st *h2Stream) error {
+	c.mu.Lock()
+	st.remoteDone = true
+	if v, ok := st.req.Headers.Get("content-length"); ok && st.bodyErr == nil {
+		if n, err := strconv.Atoi(v); err != nil || n != st.body.Len() {
+			st.bodyErr = errBodyLength
+		}
+	}
+	bodyErr := st.bodyErr
+	c.mu.Unlock()
+	c.cond.Broadcast()
+	if bodyErr == errBodyLength {
+		return http2.StreamError{StreamID: st.id, Code: http2.PROTOCOL_ERROR, Reason: "body does not match content-length"}
+	}
+	return nil
+}
+
+// readBody waits for the rest of st's body, handing back window for what
+// has come in so far and for everything that follows.
+func (c *h2Conn) readBody(ctx context.Context, st *h2Stream) ([]byte, error) {
+	c.mu.Lock()
+	st.reading = true
+	credit := st.unacked
+	st.unacked = 0
+	c.recvWindow += credit
+	streamOpen := !st.remoteDone && st.bodyErr == nil
+	if streamOpen {
+		st.recvWindow += credit
+	}
+	c.mu.Unlock()
+	if err := c.refill(0, credit); err != nil {
+		return nil, err
+	}
+	if streamOpen {
+		if err := c.refill(st.id, credit); err != nil {
+			return nil, err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for !st.remoteDone && st.bodyErr == nil && !st.reset && !c.closed && ctx.Err() == nil {
+		c.cond.Wait()
+	}
+	switch {
+	case st.bodyErr != nil:
+		return nil, st.bodyErr
+	case st.remoteDone:
+		return st.body.Bytes(), nil
+	case ctx.Err() != nil:
+		return nil, ctx.Err()
+	}
+	return nil, errStreamClosed
+}
+
+func (c *h2Conn) runHandler(st *h2Stream) {
+	ctx := st.ctx
+	if c.srv.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.srv.requestTimeout)
+		defer cancel()
+	}
+	stop := context.AfterFunc(ctx, c.cond.Broadcast)
+	defer stop()
+
+	log := c.log.With("stream", st.id, "method", st.req.RequestLine.Method, "target", st.req.RequestLine.RequestTarget)
+	w := &response.Writer{
+		Sink: st,
+	}
+	if id := c.srv.requestID(st.req, w); id != "" {
+		log = log.With("request_id", id)
+		ctx = requestid.NewContext(ctx, id)
+	}
+	// Handlers start with the headers; the body is let in as they read it.
+	st.req.DeferBody(request.BodyHooks{Start: func(r *request.Request) error {
+		if r.ExpectsContinue() && w.Status() == 0 {
+			if err := w.WriteInformational(response.CONTINUE, nil); err != nil {
+				return err
+			}
+		}
+		body, err := c.readBody(r.Context(), st)
+		if errors.Is(err, errBodyTooLarge) {
+			log.Warn("request body rejected", "err", err)
+			if w.Status() == 0 {
+				if werr := w.WriteStatusLine(response.CONTENT_TOO_LARGE); werr == nil {
+					w.WriteHeaders(response.GetDefaultHeaders())
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+		r.SetBody(body)
+		return c.srv.decodeBody(log, w, r)
+	}})
+	defer func() {
+		c.finishStream(log, st, recover())
+	}()
+	c.srv.handler(w, st.req.WithContext(ctx))
+}
+
+// finishStream ends the stream after its handler returns. A handler that
+// panicked or never wrote a response gets its stream reset.
+func (c *h2Conn) finishStream(log *slog.Logger, st *h2Stream, panicked any) {
+	if panicked != nil {
+		log.Error("handler panic", "panic", panicked, "stack", string(debug.Stack()))
+		if c.srv.observer != nil {
+			c.srv.observer.HandlerPanic()
+		}
+	}
+	c.mu.Lock()
+	reset, wroteHead, ended := st.reset, st.wroteHead, st.ended
+	c.mu.Unlock()
+	switch {
+	case reset:
+	case panicked != nil || !wroteHead:
+		c.resetStream(st.id, http2.INTERNAL_ERROR)
+	default:
+		if !ended {
+			c.mu.Lock()
+			st.ended = true
+			c.mu.Unlock()
+			c.framer.WriteData(st.id, true, nil)
+		}
+		// The response is complete, so whatever is left of the request is
+		// not wanted.
+		c.mu.Lock()
+		remoteDone := st.remoteDone
+		c.mu.Unlock()
+		if !remoteDone {
+			c.framer.WriteRSTStream(st.id, http2.NO_ERROR)
+		}
+	}
+	c.closeStream(st)
+}
+
+func (c *h2Conn) closeStream(st *h2Stream) {
+	c.mu.Lock()
+	if c.streams[st.id] != st {
+		c.mu.Unlock()
+		return
+	}
+	// The unread body no longer counts against the connection.
+	credit := st.unacked
+	st.unacked = 0
+	c.recvWindow += credit
+	defer c.refill(0, credit)
+	defer c.mu.Unlock()
+	delete(c.streams, st.id)
+	st.cancel()
+	c.active--
+	if c.active == 0 {
+		c.srv.setState(c.conn, STATE_IDLE)
+		if c.goingAway {
+			c.conn.Close()
+		} else {
+			setReadDeadline(c.conn, c.srv.idleTimeout)
+		}
+	}
+	c.cond.Broadcast()
+}
+
+func (c *h2Conn) resetStream(id uint32, code http2.ErrCode) {
+	c.framer.WriteRSTStream(id, code)
+	c.mu.Lock()
+	st := c.streams[id]
+	if st == nil {
+		c.mu.Unlock()
+		return
+	}
+	st.reset = true
+	st.cancel()
+	running := st.running
+	c.mu.Unlock()
+	c.cond.Broadcast()
+	if !running {
+		c.closeStream(st)
+	}
+}
+
+func (c *h2Conn) processRSTStream(f *http2.Frame) error {
+	if f.StreamID == 0 {
+		return http2.ConnectionError{Code: http2.PROTOCOL_ERROR, Reason: "RST_STREAM on stream 0"}
+	}
+	if _, err := f.RSTCode(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	if f.StreamID > c.lastStreamID {
+		c.mu.Unlock()
+		return http2.ConnectionError{Code: http2.PROTOCOL_ERROR, Reason: "RST_STREAM on idle stream"}
+	}
+	st := c.streams[f.StreamID]
+	if st == nil {
+		c.mu.Unlock()
+		return nil
+	}
+	st.reset = true
+	st.cancel()
+	running := st.running
+	c.mu.Unlock()
+	c.cond.Broadcast()
+	if !running {
+		c.closeStream(st)
+	}
+	return nil
+}
+
+func (c *h2Conn) processSettings(f *http2.Frame) error {
+	settings, err := f.Settings()
+	if err != nil || f.Has(http2.FLAG_ACK) {
+		return err
+	}
+	c.mu.Lock()
+	for _, s := range settings {
+		switch s.ID {
+		case http2.SETTINGS_HEADER_TABLE_SIZE:
+			size := s.Val
+			c.peerTableSize = &size
+		case http2.SETTINGS_ENABLE_PUSH:
+			if s.Val > 1 {
+				c.mu.Unlock()
+				return http2.ConnectionError{Code: http2.PROTOCOL_ERROR, Reason: "invalid SETTINGS_ENABLE_PUSH"}
+			}
+		case http2.SETTINGS_INITIAL_WINDOW_SIZE:
+			if s.Val > http2.MaxWindowSize {
+				c.mu.Unlock()
+				return http2.ConnectionError{Code: http2.FLOW_CONTROL_ERROR, Reason: "invalid SETTINGS_INITIAL_WINDOW_SIZE"}
+			}
+			delta := int64(s.Val) - c.peerInitWindow
+			for _, st := range c.streams {
+				st.sendWindow += delta
+			}
+			c.peerInitWindow = int64(s.Val)
+		case http2.SETTINGS_MAX_FRAME_SIZE:
+			if s.Val < http2.DefaultMaxFrameSize || s.Val > http2.MaxAllowedFrameSize {
+				c.mu.Unlock()
+				return http2.ConnectionError{Code: http2.PROTOCOL_ERROR, Reason: "invalid SETTINGS_MAX_FRAME_SIZE"}
+			}
+			c.peerMaxFrameSize = s.Val
+		}
+	}
+	c.mu.Unlock()
+	c.cond.Broadcast()
+	return c.framer.WriteSettingsAck()
+}
+
+func (c *h2Conn) processWindowUpdate(f *http2.Frame) error {
+	incr, err := f.WindowIncrement()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.cond.Broadcast()
+	defer c.mu.Unlock()
+	if f.StreamID == 0 {
+		if incr == 0 {
+			return http2.ConnectionError{Code: http2.PROTOCOL_ERROR, Reason: "zero WINDOW_UPDATE"}
+		}
+		c.sendWindow += int64(incr)
+		if c.sendWindow > http2.MaxWindowSize {
+			return http2.ConnectionError{Code: http2.FLOW_CONTROL_ERROR, Reason: "connection window overflow"}
+		}
+		return nil
+	}
+	if incr == 0 {
+		return http2.StreamError{StreamID: f.StreamID, Code: http2.PROTOCOL_ERROR, Reason: "zero WINDOW_UPDATE"}
+	}
+	st := c.streams[f.StreamID]
+	if st == nil {
+		return nil
+	}
+	st.sendWindow += int64(incr)
+	if st.sendWindow > http2.MaxWindowSize {
+		return http2.StreamError{StreamID: f.StreamID, Code: http2.FLOW_CONTROL_ERROR, Reason: "stream window overflow"}
+	}
+	return nil
+}
+
+// encodeHeaders runs under the framer's write lock, which is what keeps
+// encoder use in step with the order blocks go out.
+func (c *h2Conn) encodeHeaders(fields []hpack.HeaderField) []byte {
+	c.mu.Lock()
+	tableSize := c.peerTableSize
+	c.peerTableSize = nil
+	c.mu.Unlock()
+	if tableSize != nil {
+		c.enc.SetMaxTableSize(*tableSize)
+	}
+	return c.enc.Encode(nil, fields)
+}
+
+func (st *h2Stream) writable() (maxFrameSize uint32, err error) {
+	c := st.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if st.reset || st.ended || c.closed {
+		return 0, errStreamClosed
+	}
+	return c.peerMaxFrameSize, nil
+}
+
+func headerFields(h headers.Headers) []hpack.HeaderField {
+	fields := make([]hpack.HeaderField, 0, len(h))
+	for k, v := range h {
+		k = strings.ToLower(k)
+		if connectionHeaders[k] {
+			continue
+		}
+		fields = append(fields, hpack.HeaderField{
+			Name:      k,
+			Value:     v,
+			Sensitive: k == "set-cookie" || k == "authorization",
+		})
+	}
+	return fields
+}
+
+func (st *h2Stream) WriteInformational(code response.Code, h headers.Headers) error {
+	maxFrameSize, err := st.writable()
+	if err != nil {
+		return err
+	}
+	fields := append([]hpack.HeaderField{{Name: ":status", Value: strconv.Itoa(int(code))}}, headerFields(h)...)
+	return st.c.framer.WriteHeaders(st.id, false, maxFrameSize, func() []byte {
+		return st.c.encodeHeaders(fields)
+	})
+}
+
+func (st *h2Stream) WriteHead(code response.Code, h headers.Headers) error {
+	maxFrameSize, err := st.writable()
+	if err != nil {
+		return err
+	}
+	fields := append([]hpack.HeaderField{{Name: ":status", Value: strconv.Itoa(int(code))}}, headerFields(h)...)
+	err = st.c.framer.WriteHeaders(st.id, false, maxFrameSize, func() []byte {
+		return st.c.encodeHeaders(fields)
+	})
+	if err != nil {
+		return err
+	}
+	st.c.mu.Lock()
+	st.wroteHead = true
+	st.c.mu.Unlock()
+	return nil
+}
+
+// WriteData blocks until both the stream and connection windows have room.
+func (st *h2Stream) WriteData(p []byte) (int, error) {
+	c := st.c
+	total := 0
+	for len(p) > 0 {
+		c.mu.Lock()
+		for !st.reset && !c.closed && st.ctx.Err() == nil && (c.sendWindow <= 0 || st.sendWindow <= 0) {
+			c.cond.Wait()
+		}
+		if st.reset || st.ended || c.closed {
+			c.mu.Unlock()
+			return total, errStreamClosed
+		}
+		if err := st.ctx.Err(); err != nil {
+			c.mu.Unlock()
+			return total, err
+		}
+		n := min(int64(len(p)), int64(c.peerMaxFrameSize), c.sendWindow, st.sendWindow)
+		c.sendWindow -= n
+		st.sendWindow -= n
+		c.mu.Unlock()
+
+		if err := c.framer.WriteData(st.id, false, p[:n]); err != nil {
+			return total, err
+		}
+		total += int(n)
+		p = p[n:]
+	}
+	return total, nil
+}
+
+func (st *h2Stream) WriteTrailers(h headers.Headers) error {
+	maxFrameSize, err := st.writable()
+	if err != nil {
+		return err
+	}
+	st.c.mu.Lock()
+	st.ended = true
+	st.c.mu.Unlock()
+	fields := headerFields(h)
+	if len(fields) == 0 {
+		return st.c.framer.WriteData(st.id, true, nil)
+	}
+	return st.c.framer.WriteHeaders(st.id, true, maxFrameSize, func() []byte {
+		return st.c.encodeHeaders(fields)
+	})
+}
@@ -0,0 +1,310 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Barrioslopezfd/httpfromtcp/internal/headers"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/http2"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/http2/hpack"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func h2TestHandler(w *response.Writer, r *request.Request) {
+	switch r.RequestLine.RequestTarget {
+	case "/echo":
+		body, err := r.ReadBody()
+		if err != nil {
+			return
+		}
+		w.WriteStatusLine(response.OK)
+		h := response.GetDefaultHeaders()
+		h.Replace("Content-Length", fmt.Sprint(len(body)))
+		w.WriteHeaders(h)
+		w.WriteBody(body)
+	case "/trailers":
+		w.WriteStatusLine(response.OK)
+		h := response.GetDefaultHeaders()
+		h.Remove("Content-Length")
+		h.Replace("Transfer-Encoding", "chunked")
+		h.Replace("Trailer", "x-sum")
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("hello "))
+		w.WriteChunkedBody([]byte("world"))
+		w.WriteChunkedBodyDone()
+		trailers := headers.NewHeaders()
+		trailers.Replace("X-Sum", "42")
+		w.WriteTrailers(trailers)
+	case "/panic":
+		panic("boom")
+	default:
+		body := "version " + r.RequestLine.HttpVersion + " host " + r.Headers["host"]
+		w.WriteStatusLine(response.OK)
+		h := response.GetDefaultHeaders()
+		h.Replace("Content-Length", fmt.Sprint(len(body)))
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	}
+}
+
+func TestHTTP2OverTLS(t *testing.T) {
+	dir := t.TempDir()
+	certPEM, keyPEM, err := GenerateSelfSignedCert("localhost")
+	require.NoError(t, err)
+	cert := CertFile{CertFile: filepath.Join(dir, "c.crt"), KeyFile: filepath.Join(dir, "c.key")}
+	require.NoError(t, os.WriteFile(cert.CertFile, certPEM, 0o600))
+	require.NoError(t, os.WriteFile(cert.KeyFile, keyPEM, 0o600))
+
+	srv, err := Serve(h2TestHandler, 0, WithHTTP2(), WithTLS(TLSConfig{Certificates: []CertFile{cert}}))
+	require.NoError(t, err)
+	defer srv.Close()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		},
+		Timeout: 10 * time.Second,
+	}
+	base := fmt.Sprintf("https://localhost:%d", srv.Addr().(*net.TCPAddr).Port)
+
+	// Test: Plain GET is served over h2
+	res, err := client.Get(base + "/")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, 2, res.ProtoMajor)
+	assert.Equal(t, fmt.Sprintf("version 2 host localhost:%d", srv.Addr().(*net.TCPAddr).Port), string(body))
+
+	// Test: Bodies larger than every flow control window, in both directions
+	big := bytes.Repeat([]byte("0123456789abcdef"), 256*1024)
+	res, err = client.Post(base+"/echo", "application/octet-stream", bytes.NewReader(big))
+	require.NoError(t, err)
+	body, err = io.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, len(big), len(body))
+	assert.True(t, bytes.Equal(big, body))
+
+	// Test: Concurrent streams on one connection
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			payload := strings.Repeat(fmt.Sprint(i), 1000)
+			res, err := client.Post(base+"/echo", "text/plain", strings.NewReader(payload))
+			if !assert.NoError(t, err) {
+				return
+			}
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			assert.Equal(t, payload, string(body))
+		}(i)
+	}
+	wg.Wait()
+
+	// Test: Chunked handlers become DATA frames plus trailers
+	res, err = client.Get(base + "/trailers")
+	require.NoError(t, err)
+	body, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, "hello world", string(body))
+	assert.Equal(t, "42", res.Trailer.Get("X-Sum"))
+
+	// Test: Bodies over the cap get 413
+	res, err = client.Post(base+"/echo", "application/octet-stream", bytes.NewReader(make([]byte, h2MaxBodySize+1)))
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 413, res.StatusCode)
+
+	// Test: A panicking handler resets only its stream
+	_, err = client.Get(base + "/panic")
+	require.Error(t, err)
+	res, err = client.Get(base + "/")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+}
+
+func TestH2CPriorKnowledge(t *testing.T) {
+	srv, err := Serve(h2TestHandler, 0, WithHTTP2())
+	require.NoError(t, err)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = conn.Write([]byte(http2.ClientPreface))
+	require.NoError(t, err)
+	framer := http2.NewFramer(conn, conn)
+	require.NoError(t, framer.WriteSettings())
+	enc := hpack.NewEncoder()
+	err = framer.WriteHeaders(1, true, http2.DefaultMaxFrameSize, func() []byte {
+		return enc.Encode(nil, []hpack.HeaderField{
+			{Name: ":method", Value: "GET"},
+			{Name: ":scheme", Value: "http"},
+			{Name: ":path", Value: "/"},
+			{Name: ":authority", Value: "example.test"},
+		})
+	})
+	require.NoError(t, err)
+	require.NoError(t, framer.WritePing(false, [8]byte{1, 2, 3, 4, 5, 6, 7, 8}))
+
+	// Test: Server settings, settings ack, ping ack, response headers and body
+	dec := hpack.NewDecoder(http2.DefaultHeaderTableSize)
+	var status string
+	var body []byte
+	var sawSettings, sawPing bool
+	for {
+		f, err := framer.ReadFrame()
+		require.NoError(t, err)
+		switch f.Type {
+		case http2.FRAME_SETTINGS:
+			if !f.Has(http2.FLAG_ACK) {
+				sawSettings = true
+				require.NoError(t, framer.WriteSettingsAck())
+			}
+		case http2.FRAME_PING:
+			assert.True(t, f.Has(http2.FLAG_ACK))
+			assert.Equal(t, []byte{1, 2, 3, 4, 5, 6, 7, 8}, f.Payload)
+			sawPing = true
+		case http2.FRAME_HEADERS:
+			block, err := f.HeaderBlock()
+			require.NoError(t, err)
+			fields, err := dec.Decode(block)
+			require.NoError(t, err)
+			for _, hf := range fields {
+				if hf.Name == ":status" {
+					status = hf.Value
+				}
+				assert.NotEqual(t, "connection", hf.Name)
+			}
+		case http2.FRAME_DATA:
+			data, err := f.Data()
+			require.NoError(t, err)
+			body = append(body, data...)
+		}
+		if f.Type == http2.FRAME_DATA && f.Has(http2.FLAG_END_STREAM) {
+			break
+		}
+	}
+	assert.True(t, sawSettings)
+	assert.True(t, sawPing)
+	assert.Equal(t, "200", status)
+	assert.Equal(t, "version 2 host example.test", string(body))
+
+	// Test: Even stream ids are a connection error
+	err = framer.WriteHeaders(2, true, http2.DefaultMaxFrameSize, func() []byte {
+		return enc.Encode(nil, []hpack.HeaderField{{Name: ":method", Value: "GET"}})
+	})
+	require.NoError(t, err)
+	for {
+		f, err := framer.ReadFrame()
+		require.NoError(t, err)
+		if f.Type == http2.FRAME_GOAWAY {
+			_, code, err := f.GoAway()
+			require.NoError(t, err)
+			assert.Equal(t, http2.PROTOCOL_ERROR, code)
+			break
+		}
+	}
+}
+
+func TestH2CFlowControl(t *testing.T) {
+	release := make(chan struct{})
+	handler := func(w *response.Writer, r *request.Request) {
+		<-release
+		h2TestHandler(w, r)
+	}
+	srv, err := Serve(handler, 0, WithHTTP2())
+	require.NoError(t, err)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = conn.Write([]byte(http2.ClientPreface))
+	require.NoError(t, err)
+	framer := http2.NewFramer(conn, conn)
+	require.NoError(t, framer.WriteSettings())
+
+	credited := map[uint32]uint32{}
+	var body []byte
+	readUntil := func(done func(f *http2.Frame) bool) {
+		for {
+			f, err := framer.ReadFrame()
+			require.NoError(t, err)
+			switch f.Type {
+			case http2.FRAME_SETTINGS:
+				if !f.Has(http2.FLAG_ACK) {
+					require.NoError(t, framer.WriteSettingsAck())
+				}
+			case http2.FRAME_WINDOW_UPDATE:
+				n, err := f.WindowIncrement()
+				require.NoError(t, err)
+				credited[f.StreamID] += n
+			case http2.FRAME_DATA:
+				data, err := f.Data()
+				require.NoError(t, err)
+				body = append(body, data...)
+			}
+			if done(f) {
+				return
+			}
+		}
+	}
+	pingAck := func(f *http2.Frame) bool {
+		return f.Type == http2.FRAME_PING && f.Has(http2.FLAG_ACK)
+	}
+	require.NoError(t, framer.WritePing(false, [8]byte{}))
+	readUntil(pingAck)
+	clear(credited)
+
+	enc := hpack.NewEncoder()
+	err = framer.WriteHeaders(1, false, http2.DefaultMaxFrameSize, func() []byte {
+		return enc.Encode(nil, []hpack.HeaderField{
+			{Name: ":method", Value: "POST"},
+			{Name: ":scheme", Value: "http"},
+			{Name: ":path", Value: "/echo"},
+			{Name: ":authority", Value: "example.test"},
+		})
+	})
+	require.NoError(t, err)
+	require.NoError(t, framer.WriteData(1, false, bytes.Repeat([]byte("x"), 1000)))
+	require.NoError(t, framer.WritePing(false, [8]byte{}))
+
+	// Test: Nothing is handed back while the handler has not read the body
+	readUntil(pingAck)
+	assert.Empty(t, credited)
+
+	// Test: Reading the body hands back both windows
+	close(release)
+	readUntil(func(*http2.Frame) bool {
+		return credited[0] >= 1000 && credited[1] >= 1000
+	})
+	assert.Equal(t, map[uint32]uint32{0: 1000, 1: 1000}, credited)
+
+	require.NoError(t, framer.WriteData(1, true, []byte("y")))
+	readUntil(func(f *http2.Frame) bool {
+		return f.Type == http2.FRAME_DATA && f.Has(http2.FLAG_END_STREAM)
+	})
+	assert.Equal(t, strings.Repeat("x", 1000)+"y", string(body))
+}
@@ -1,12 +1,27 @@
 package server
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
+	"net/netip"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/Barrioslopezfd/httpfromtcp/internal/headers"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/proxyproto"
 	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/requestid"
 	"github.com/Barrioslopezfd/httpfromtcp/internal/response"
 )
 
@@ -21,9 +36,37 @@ type Server struct {
 	listening atomic.Bool
 	ln        net.Listener
 	handler   Handler
+	done      chan struct{}
+	closeOnce sync.Once
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	readHeaderTimeout time.Duration
+	readBodyTimeout   time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	requestTimeout    time.Duration
+
+	conns      chan struct{}
+	retryAfter time.Duration
+	rejects    chan struct{}
+
+	connState func(net.Conn, ConnState)
+	tls       *TLSConfig
+	http2     bool
+
+	maxDecodedSize int64
+	maxDecodeRatio int64
+
+	proxyProtocol  *proxyproto.Config
+	trustedProxies []netip.Prefix
+
+	logger       *slog.Logger
+	newRequestID func() string
+	observer     Observer
 }
 
-func Serve(h Handler, port int) (*Server, error) {
+func Serve(h Handler, port int, opts ...Option) (*Server, error) {
 	addr := fmt.Sprintf(":%d", port)
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -33,6 +76,29 @@ func Serve(h Handler, port int) (*Server, error) {
 	srv := &Server{
 		ln:      ln,
 		handler: h,
+		done:    make(chan struct{}),
+		logger:  slog.Default(),
+	}
+	srv.ctx, srv.cancel = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(srv)
+	}
+	if srv.observer != nil {
+		srv.ln = &observedListener{Listener: ln, o: srv.observer}
+		ln = srv.ln
+	}
+	// The PROXY header comes before anything else on the wire, TLS included.
+	if srv.proxyProtocol != nil {
+		srv.ln = proxyproto.NewListener(ln, *srv.proxyProtocol)
+		ln = srv.ln
+	}
+	if srv.tls != nil {
+		srv.ln, err = srv.listenTLS(ln)
+		if err != nil {
+			srv.Close()
+			ln.Close()
+			return nil, err
+		}
 	}
 
 	go srv.listen()
@@ -40,35 +106,424 @@ func Serve(h Handler, port int) (*Server, error) {
 	return srv, nil
 }
 
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+	// maxRejects bounds the connections being answered with 503 at once.
+	maxRejects = 64
+	// maxDiscardSize bounds the unread body read past to keep a
+	// connection alive.
+	maxDiscardSize = 256 << 10
+)
+
 func (s *Server) listen() {
+	var delay time.Duration
 	for {
+		if s.conns != nil && s.retryAfter == 0 {
+			// Hold off on Accept so excess clients queue in the kernel backlog.
+			select {
+			case s.conns <- struct{}{}:
+			case <-s.done:
+				return
+			}
+		}
 		conn, err := s.ln.Accept()
 		if err != nil {
+			if s.conns != nil && s.retryAfter == 0 {
+				<-s.conns
+			}
 			if s.listening.Load() {
 				return
 			}
-			fmt.Println("listen() error=", err)
+			if delay == 0 {
+				delay = minAcceptDelay
+			} else {
+				delay = min(delay*2, maxAcceptDelay)
+			}
+			s.logger.Error("accept failed", "err", err, "retry_in", delay)
+			select {
+			case <-time.After(delay):
+			case <-s.done:
+				return
+			}
 			continue
 		}
-		go s.handle(conn)
+		delay = 0
+
+		if s.conns != nil && s.retryAfter > 0 {
+			select {
+			case s.conns <- struct{}{}:
+			default:
+				// A flood of connections must not turn into a flood of
+				// goroutines; past a point they are just closed.
+				select {
+				case s.rejects <- struct{}{}:
+					go func() {
+						s.reject(conn)
+						<-s.rejects
+					}()
+				default:
+					conn.Close()
+				}
+				continue
+			}
+		}
+		go func() {
+			s.handle(conn)
+			if s.conns != nil {
+				<-s.conns
+			}
+		}()
 	}
 }
 
+// reject turns away a connection over the limit with a 503. The write side
+// is shut first and the request drained so the client sees the response
+// instead of a reset.
+func (s *Server) reject(conn net.Conn) {
+	s.setState(conn, STATE_NEW)
+	defer func() {
+		conn.Close()
+		s.setState(conn, STATE_CLOSED)
+	}()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	w := &response.Writer{
+		Writer: conn,
+	}
+	if err := w.WriteStatusLine(response.SERVICE_UNAVAILABLE); err != nil {
+		return
+	}
+	h := response.GetDefaultHeaders()
+	h.Replace("Retry-After", strconv.Itoa(int(s.retryAfter.Round(time.Second)/time.Second)))
+	if err := w.WriteHeaders(h); err != nil {
+		return
+	}
+	if tc, ok := conn.(interface{ CloseWrite() error }); ok {
+		tc.CloseWrite()
+	}
+	io.Copy(io.Discard, io.LimitReader(conn, 64<<10))
+}
+
 func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
-	req, err := request.RequestFromReader(conn)
-	if err != nil {
-		log.Fatal(err)
+	s.setState(conn, STATE_NEW)
+	cr := newConnReader(conn)
+	reader := bufio.NewReader(cr)
+	cw := &connWriter{
+		s:      s,
+		conn:   conn,
+		cr:     cr,
+		reader: reader,
+	}
+	defer func() {
+		if cw.hijacked {
+			return
+		}
+		conn.Close()
+		s.setState(conn, STATE_CLOSED)
+	}()
+
+	setReadDeadline(conn, s.readHeaderTimeout)
+	log := s.logger.With("remote_addr", conn.RemoteAddr().String())
+	if tc, ok := conn.(*tls.Conn); ok {
+		setWriteDeadline(conn, s.writeTimeout)
+		if err := tc.Handshake(); err != nil {
+			log.Debug("tls handshake failed", "err", err)
+			return
+		}
+		if tc.ConnectionState().NegotiatedProtocol == "h2" {
+			s.serveHTTP2(conn, reader, log)
+			return
+		}
+	} else if s.http2 {
+		// Only the HTTP/2 client preface starts with PRI, so three bytes are
+		// enough to tell prior-knowledge h2c from an HTTP/1.1 request.
+		if b, err := reader.Peek(3); err == nil && string(b) == "PRI" {
+			s.serveHTTP2(conn, reader, log)
+			return
+		}
 	}
+
+	for {
+		req, err := request.ReadRequest(reader)
+		if err != nil {
+			if err != io.EOF {
+				s.writeError(log, conn, err)
+			}
+			return
+		}
+		reqLog := log.With("method", req.RequestLine.Method, "target", req.RequestLine.RequestTarget)
+		s.setState(conn, STATE_ACTIVE)
+		req.RemoteAddr = conn.RemoteAddr()
+		req.LocalAddr = conn.LocalAddr()
+		req.Proxy = proxyproto.HeaderOf(conn)
+		if tc, ok := conn.(*tls.Conn); ok {
+			state := tc.ConnectionState()
+			req.TLS = &state
+		}
+		req.ResolveForwarded(s.trustedProxies)
+
+		w := &response.Writer{
+			Writer: cw,
+		}
+		id := s.requestID(req, w)
+		if id != "" {
+			reqLog = reqLog.With("request_id", id)
+		}
+		// The body stays on the wire until the handler reads it, whole or
+		// as a stream.
+		body := &bodyState{}
+		req.DeferBody(request.BodyHooks{
+			Start: func(r *request.Request) error {
+				body.start()
+				cr.abortPendingRead()
+				if r.ExpectsContinue() && w.Status() == 0 {
+					if err := w.WriteInformational(response.CONTINUE, nil); err != nil {
+						return err
+					}
+				}
+				setReadDeadline(conn, s.readBodyTimeout)
+				return nil
+			},
+			End: func(r *request.Request, err error) error {
+				conn.SetReadDeadline(time.Time{})
+				if body.end(err) {
+					cr.resumeBackgroundRead()
+				}
+				if err != nil || r.ParserState != request.DONE {
+					return err
+				}
+				return s.decodeBody(reqLog, w, r)
+			},
+		})
+
+		setWriteDeadline(conn, s.writeTimeout)
+		panicked := s.serveRequest(reqLog, cr, w, req, id)
+		// A streamed body may still be read after the handler returns, but
+		// the connection is not watched for a hang-up any more.
+		body.handlerReturned()
+		cr.abortPendingRead()
+		started, read, err := body.state()
+		if err != nil && w.Status() == 0 && !panicked && !cw.hijacked {
+			s.bodyError(reqLog, w, err)
+		}
+		// A handler that panicked partway through a response leaves nothing
+		// for the connection to carry on with.
+		if panicked || cw.hijacked || !keepAlive(req, w) {
+			return
+		}
+		// A small body the handler never asked for is read past. One that
+		// is larger, still being read, or never sent because the client is
+		// waiting for 100 Continue, stops the connection carrying another
+		// request.
+		if !started && !req.ExpectsContinue() {
+			discardBody(req)
+			_, read, _ = body.state()
+		}
+		if !read {
+			return
+		}
+		conn.SetWriteDeadline(time.Time{})
+		s.setState(conn, STATE_IDLE)
+
+		setReadDeadline(conn, s.idleTimeout)
+		if _, err := reader.Peek(1); err != nil {
+			return
+		}
+		setReadDeadline(conn, s.readHeaderTimeout)
+	}
+}
+
+// serveRequest runs the handler under a context that ends with the server,
+// the client connection or the per-request timeout, whichever comes first.
+// A panicking handler is logged and, if it had not started a response,
+// answered with 500.
+func (s *Server) serveRequest(log *slog.Logger, cr *connReader, w *response.Writer, req *request.Request, id string) (panicked bool) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	if s.requestTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, s.requestTimeout)
+		defer cancelTimeout()
+	}
+	if id != "" {
+		ctx = requestid.NewContext(ctx, id)
+	}
+
+	cr.startBackgroundRead(cancel)
+	defer cr.abortPendingRead()
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+		panicked = true
+		if s.observer != nil {
+			s.observer.HandlerPanic()
+		}
+		log.Error("handler panic", "panic", p, "stack", string(debug.Stack()))
+		if w.Status() == 0 {
+			if err := w.WriteStatusLine(response.INTERNAL_SERVER_ERROR); err == nil {
+				w.WriteHeaders(response.GetDefaultHeaders())
+			}
+		}
+	}()
+	s.handler(w, req.WithContext(ctx))
+	return false
+}
+
+// requestID settles req's ID when WithRequestID is on: the one the client
+// sent if it is usable, or else a new one, which replaces it in the request
+// headers. w sends it back with the response.
+func (s *Server) requestID(req *request.Request, w *response.Writer) string {
+	if s.newRequestID == nil {
+		return ""
+	}
+	key := strings.ToLower(requestid.Header)
+	id, ok := req.Headers.Get(key)
+	if !ok || !requestid.Valid(id) {
+		id = s.newRequestID()
+		req.Headers.Replace(key, id)
+	}
+	w.Extra = headers.Headers{key: id}
+	return id
+}
+
+// decodeBody applies WithRequestDecoding to a body that has been read. A
+// body it rejects is answered through w, so callers only have to stop.
+func (s *Server) decodeBody(log *slog.Logger, w *response.Writer, req *request.Request) error {
+	if s.maxDecodedSize == 0 {
+		return nil
+	}
+	err := req.DecodeBody(s.maxDecodedSize, s.maxDecodeRatio)
+	if err == nil {
+		return nil
+	}
+	log.Warn("request body rejected", "err", err)
+	s.parseError(err)
+	code := response.BAD_REQUEST
+	h := response.GetDefaultHeaders()
+	switch {
+	case errors.Is(err, request.ErrUnsupportedEncoding):
+		code = response.UNSUPPORTED_MEDIA_TYPE
+		h.Replace("Accept-Encoding", "gzip, deflate")
+	case errors.Is(err, request.ErrBodyTooLarge):
+		code = response.CONTENT_TOO_LARGE
+	}
+	if w.Status() == 0 {
+		if werr := w.WriteStatusLine(code); werr == nil {
+			w.WriteHeaders(h)
+		}
+	}
+	return err
+}
+
+// bodyError answers a request whose body could not be read when the
+// handler gave up on it without answering, with codes as in writeError.
+func (s *Server) bodyError(log *slog.Logger, w *response.Writer, err error) {
+	code := errorStatus(err)
+	if code == 0 {
+		log.Debug("client went away mid-request", "err", err)
+		return
+	}
+	log.Warn("bad request body", "err", err, "status", int(code))
+	s.parseError(err)
+	if werr := w.WriteStatusLine(code); werr == nil {
+		w.WriteHeaders(response.GetDefaultHeaders())
+	}
+}
+
+// discardBody reads past an unread body of up to maxDiscardSize bytes.
+func discardBody(req *request.Request) {
+	if rd, err := req.BodyReader(); err == nil {
+		io.CopyN(io.Discard, rd, maxDiscardSize+1)
+	}
+}
+
+// writeError answers a request that never reached the handler. Timeouts get
+// 408, anything else the parser rejected gets 400. A peer that hung up
+// mid-request gets nothing since there is nobody left to read it.
+func (s *Server) writeError(log *slog.Logger, conn net.Conn, err error) {
+	code := errorStatus(err)
+	if code == 0 {
+		log.Debug("client went away mid-request", "err", err)
+		return
+	}
+	log.Warn("bad request", "err", err, "status", int(code))
+	s.parseError(err)
+	setWriteDeadline(conn, s.writeTimeout)
 	w := &response.Writer{
 		Writer: conn,
 	}
+	if err := w.WriteStatusLine(code); err != nil {
+		return
+	}
+	w.WriteHeaders(response.GetDefaultHeaders())
+}
+
+func errorStatus(err error) response.Code {
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return response.REQUEST_TIMEOUT
+	case errors.Is(err, request.ErrUnsupportedTransferEncoding):
+		return response.NOT_IMPLEMENTED
+	case errors.Is(err, request.ErrContentTooLarge):
+		return response.CONTENT_TOO_LARGE
+	}
+	var netErr net.Error
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr) {
+		return 0
+	}
+	return response.BAD_REQUEST
+}
+
+// keepAlive only reuses connections whose response was framed by a
+// Content-Length that the handler actually filled. Chunked or unframed
+// responses end when the connection closes.
+func keepAlive(req *request.Request, w *response.Writer) bool {
+	if v, ok := req.Headers.Get("connection"); ok && strings.Contains(strings.ToLower(v), "close") {
+		return false
+	}
+	h := w.SentHeaders()
+	if h == nil {
+		return false
+	}
+	if v, ok := h.Get("connection"); ok && strings.Contains(strings.ToLower(v), "close") {
+		return false
+	}
+	v, ok := h.Get("content-length")
+	if !ok {
+		return false
+	}
+	length, err := strconv.Atoi(v)
+	return err == nil && length == w.BytesWritten()
+}
+
+func setReadDeadline(conn net.Conn, d time.Duration) {
+	if d > 0 {
+		conn.SetReadDeadline(time.Now().Add(d))
+	} else {
+		conn.SetReadDeadline(time.Time{})
+	}
+}
+
+func setWriteDeadline(conn net.Conn, d time.Duration) {
+	if d > 0 {
+		conn.SetWriteDeadline(time.Now().Add(d))
+	} else {
+		conn.SetWriteDeadline(time.Time{})
+	}
+}
 
-	s.handler(w, req)
+func (s *Server) Addr() net.Addr {
+	return s.ln.Addr()
 }
 
 func (s *Server) Close() error {
 	s.listening.Store(true)
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.cancel()
+	})
 	if s.ln != nil {
 		return s.ln.Close()
 	}
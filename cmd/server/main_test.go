@@ -0,0 +1,383 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func dial(t *testing.T, srv *Server) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.ln.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func ok(w *response.Writer, r *request.Request) {
+	h := response.GetDefaultHeaders()
+	h.Replace("Connection", "keep-alive")
+	w.WriteStatusLine(response.OK)
+	w.WriteHeaders(h)
+}
+
+func TestRejectLimit(t *testing.T) {
+	release := make(chan struct{})
+	handler := func(w *response.Writer, r *request.Request) {
+		<-release
+		ok(w, r)
+	}
+	srv, err := Serve(handler, 0, WithMaxConns(1), WithRejectOverload(time.Second))
+	require.NoError(t, err)
+	defer srv.Close()
+	defer close(release)
+
+	busy := dial(t, srv)
+	_, err = busy.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	// Test: Only so many connections are answered with 503 at once, the rest
+	// are closed straight away
+	conns := make([]net.Conn, maxRejects+16)
+	for i := range conns {
+		conns[i] = dial(t, srv)
+	}
+	rejected, closed := 0, 0
+	for _, conn := range conns {
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			closed++
+			continue
+		}
+		assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+		rejected++
+	}
+	assert.LessOrEqual(t, rejected, maxRejects)
+	assert.Positive(t, closed)
+}
+
+func TestTimeouts(t *testing.T) {
+	handler := func(w *response.Writer, r *request.Request) {
+		if _, err := r.ReadBody(); err != nil {
+			return
+		}
+		ok(w, r)
+	}
+	srv, err := Serve(handler, 0,
+		WithReadHeaderTimeout(100*time.Millisecond),
+		WithReadBodyTimeout(100*time.Millisecond),
+		WithIdleTimeout(100*time.Millisecond),
+	)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: A header block that never finishes gets 408
+	conn := dial(t, srv)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: loc"))
+	require.NoError(t, err)
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusRequestTimeout, res.StatusCode)
+
+	// Test: So does a body that stops short
+	conn = dial(t, srv)
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\nabc"))
+	require.NoError(t, err)
+	res, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusRequestTimeout, res.StatusCode)
+
+	// Test: A kept-alive connection is closed once idle too long
+	conn = dial(t, srv)
+	reader := bufio.NewReader(conn)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	res, err = http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	start := time.Now()
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.GreaterOrEqual(t, time.Since(start), 80*time.Millisecond)
+}
+
+func TestChunkedRequest(t *testing.T) {
+	echo := func(w *response.Writer, r *request.Request) {
+		body, err := r.ReadBody()
+		if err != nil {
+			return
+		}
+		h := response.GetDefaultHeaders()
+		h.Replace("Content-Length", strconv.Itoa(len(body)))
+		h.Replace("Connection", "keep-alive")
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(h)
+		w.WriteBody(body)
+	}
+	srv, err := Serve(echo, 0, WithReadBodyTimeout(100*time.Millisecond))
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: A chunked POST is read whole and the GET behind it is its own request
+	conn := dial(t, srv)
+	reader := bufio.NewReader(conn)
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5\r\nhello\r\n0\r\n\r\n" +
+		"GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	for _, want := range []string{"hello", ""} {
+		res, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		body, _ := io.ReadAll(res.Body)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, want, string(body))
+	}
+
+	// Test: A chunked body that stalls gets 408
+	conn = dial(t, srv)
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhel"))
+	require.NoError(t, err)
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusRequestTimeout, res.StatusCode)
+
+	// Test: Other transfer codings get 501 and both framings at once get
+	// 400, each closing the connection
+	for raw, code := range map[string]int{
+		"Transfer-Encoding: gzip\r\n":                         http.StatusNotImplemented,
+		"Transfer-Encoding: chunked\r\nContent-Length: 5\r\n": http.StatusBadRequest,
+	} {
+		conn = dial(t, srv)
+		reader = bufio.NewReader(conn)
+		_, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\n" + raw + "\r\n0\r\n\r\nGET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		require.NoError(t, err)
+		res, err = http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		assert.Equal(t, code, res.StatusCode)
+		io.ReadAll(res.Body)
+		_, err = http.ReadResponse(reader, nil)
+		assert.Error(t, err)
+	}
+}
+
+func TestUnreadBody(t *testing.T) {
+	srv, err := Serve(ok, 0)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: A small body the handler ignores is read past for the next request
+	conn := dial(t, srv)
+	reader := bufio.NewReader(conn)
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello" +
+		"GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		res, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		io.ReadAll(res.Body)
+	}
+
+	// Test: A large one closes the connection instead
+	conn = dial(t, srv)
+	reader = bufio.NewReader(conn)
+	size := maxDiscardSize + 1
+	go conn.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: " + strconv.Itoa(size) + "\r\n\r\n" + strings.Repeat("a", size)))
+	res, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	io.ReadAll(res.Body)
+	_, err = http.ReadResponse(reader, nil)
+	assert.Error(t, err)
+}
+
+func TestMaxConns(t *testing.T) {
+	release := make(chan struct{})
+	handler := func(w *response.Writer, r *request.Request) {
+		<-release
+		ok(w, r)
+	}
+
+	// Test: Over the cap, a connection waits in the backlog until one frees up
+	srv, err := Serve(handler, 0, WithMaxConns(1))
+	require.NoError(t, err)
+	defer srv.Close()
+	first, second := dial(t, srv), dial(t, srv)
+	_, err = first.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	_, err = second.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	second.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = second.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	close(release)
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	res, err := http.ReadResponse(bufio.NewReader(second), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	// Test: With rejection on, it gets 503 and Retry-After at once
+	hold := make(chan struct{})
+	defer close(hold)
+	srv, err = Serve(func(w *response.Writer, r *request.Request) { <-hold }, 0, WithMaxConns(1), WithRejectOverload(3*time.Second))
+	require.NoError(t, err)
+	defer srv.Close()
+	busy := dial(t, srv)
+	_, err = busy.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	res, err = http.ReadResponse(bufio.NewReader(dial(t, srv)), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Equal(t, "3", res.Header.Get("Retry-After"))
+}
+
+// failingListener fails every Accept, noting when it was called.
+type failingListener struct {
+	net.Listener
+	mu    sync.Mutex
+	calls []time.Time
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	l.calls = append(l.calls, time.Now())
+	l.mu.Unlock()
+	return nil, errors.New("too many open files")
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	fl := &failingListener{Listener: ln}
+	s := &Server{ln: fl, done: make(chan struct{}), logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	go s.listen()
+	time.Sleep(200 * time.Millisecond)
+	s.Close()
+
+	// Test: Accept errors are retried with growing delays, not in a tight loop
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	require.GreaterOrEqual(t, len(fl.calls), 4)
+	assert.Less(t, len(fl.calls), 10)
+	for i := 2; i < len(fl.calls); i++ {
+		assert.Greater(t, fl.calls[i].Sub(fl.calls[i-1]), fl.calls[i-1].Sub(fl.calls[i-2]))
+	}
+}
+
+func TestRequestContext(t *testing.T) {
+	errs := make(chan error, 1)
+	handler := func(w *response.Writer, r *request.Request) {
+		select {
+		case <-r.Context().Done():
+			errs <- r.Context().Err()
+		case <-time.After(5 * time.Second):
+			errs <- nil
+		}
+	}
+	wait := func() error {
+		t.Helper()
+		select {
+		case err := <-errs:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("handler never returned")
+			return nil
+		}
+	}
+
+	srv, err := Serve(handler, 0)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: The client hanging up cancels the context
+	conn := dial(t, srv)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+	assert.ErrorIs(t, wait(), context.Canceled)
+
+	// Test: So does the server shutting down
+	conn = dial(t, srv)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	srv.Close()
+	assert.ErrorIs(t, wait(), context.Canceled)
+
+	// Test: The per-request timeout ends it with a deadline error
+	srv, err = Serve(handler, 0, WithRequestTimeout(50*time.Millisecond))
+	require.NoError(t, err)
+	defer srv.Close()
+	conn = dial(t, srv)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	assert.ErrorIs(t, wait(), context.DeadlineExceeded)
+}
+
+func TestConnState(t *testing.T) {
+	var mu sync.Mutex
+	var states []ConnState
+	var remote, local net.Addr
+	handler := func(w *response.Writer, r *request.Request) {
+		mu.Lock()
+		remote, local = r.RemoteAddr, r.LocalAddr
+		assert.Nil(t, r.TLS)
+		mu.Unlock()
+		ok(w, r)
+	}
+	closed := make(chan struct{})
+	srv, err := Serve(handler, 0, WithConnState(func(_ net.Conn, state ConnState) {
+		mu.Lock()
+		states = append(states, state)
+		mu.Unlock()
+		if state == STATE_CLOSED {
+			close(closed)
+		}
+	}))
+	require.NoError(t, err)
+	defer srv.Close()
+
+	conn := dial(t, srv)
+	reader := bufio.NewReader(conn)
+	for range 2 {
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		require.NoError(t, err)
+		_, err = http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+	}
+	conn.Close()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection never reported closed")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// Test: States follow the connection through two requests and the hang-up
+	assert.Equal(t, []ConnState{STATE_NEW, STATE_ACTIVE, STATE_IDLE, STATE_ACTIVE, STATE_IDLE, STATE_CLOSED}, states)
+
+	// Test: The handler sees both ends of the connection
+	assert.Equal(t, conn.LocalAddr().String(), remote.String())
+	assert.Equal(t, conn.RemoteAddr().String(), local.String())
+}
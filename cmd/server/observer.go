@@ -0,0 +1,96 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+)
+
+// Observer is told about what only the server sees: connections, bytes on
+// the wire, requests it could not parse and handlers that panicked. Its
+// methods are called from many goroutines at once and should not block.
+type Observer interface {
+	ConnOpened()
+	ConnClosed()
+	BytesRead(n int)
+	BytesWritten(n int)
+	// ParseError is called with a short reason, such as "malformed" or
+	// "timeout", for each request rejected before reaching the handler.
+	ParseError(reason string)
+	HandlerPanic()
+}
+
+// observedListener counts traffic on the raw connections, below TLS and
+// the PROXY protocol, so what is reported is what crossed the network.
+type observedListener struct {
+	net.Listener
+	o Observer
+}
+
+func (l *observedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.o.ConnOpened()
+	return &observedConn{Conn: conn, o: l.o}, nil
+}
+
+type observedConn struct {
+	net.Conn
+	o    Observer
+	once sync.Once
+}
+
+func (c *observedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.o.BytesRead(n)
+	}
+	return n, err
+}
+
+func (c *observedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.o.BytesWritten(n)
+	}
+	return n, err
+}
+
+// Close reports the connection closed once, whether the server or a
+// handler that hijacked it closes it.
+func (c *observedConn) Close() error {
+	c.once.Do(c.o.ConnClosed)
+	return c.Conn.Close()
+}
+
+func (c *observedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+func (s *Server) parseError(err error) {
+	if s.observer != nil {
+		s.observer.ParseError(parseErrorReason(err))
+	}
+}
+
+func parseErrorReason(err error) string {
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, request.ErrLineTooLong):
+		return "too_long"
+	case errors.Is(err, request.ErrUnsupportedEncoding), errors.Is(err, request.ErrUnsupportedTransferEncoding):
+		return "unsupported_encoding"
+	case errors.Is(err, request.ErrBodyTooLarge), errors.Is(err, request.ErrContentTooLarge):
+		return "body_too_large"
+	}
+	return "malformed"
+}
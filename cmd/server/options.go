@@ -0,0 +1,169 @@
+package server
+
+import (
+	"log/slog"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/Barrioslopezfd/httpfromtcp/internal/proxyproto"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/requestid"
+)
+
+const (
+	defaultMaxDecodedSize = 10 << 20
+	defaultMaxDecodeRatio = 100
+)
+
+type Option func(*Server)
+
+// WithReadHeaderTimeout bounds the time from the first byte of a request (or
+// the accept, for the first one) until its header block has been read.
+func WithReadHeaderTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.readHeaderTimeout = d
+	}
+}
+
+// WithReadBodyTimeout bounds the time spent reading the request body once the
+// headers are in.
+func WithReadBodyTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.readBodyTimeout = d
+	}
+}
+
+// WithWriteTimeout bounds the time the handler has to write its response.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.writeTimeout = d
+	}
+}
+
+// WithIdleTimeout bounds how long a kept-alive connection may sit between
+// requests before it is closed.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.idleTimeout = d
+	}
+}
+
+// WithMaxConns caps the number of connections served at once. By default
+// connections over the cap wait in the kernel accept backlog; see
+// WithRejectOverload for turning them away instead.
+func WithMaxConns(n int) Option {
+	return func(s *Server) {
+		if n > 0 {
+			s.conns = make(chan struct{}, n)
+		}
+	}
+}
+
+// WithRejectOverload makes connections over the WithMaxConns cap get an
+// immediate 503 carrying retryAfter in the Retry-After header. Beyond a
+// fixed number being turned away at once, further ones are simply closed.
+func WithRejectOverload(retryAfter time.Duration) Option {
+	return func(s *Server) {
+		s.retryAfter = max(retryAfter, time.Second)
+		s.rejects = make(chan struct{}, maxRejects)
+	}
+}
+
+// WithRequestTimeout sets a deadline on each request's context, measured from
+// when the handler is called.
+func WithRequestTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.requestTimeout = d
+	}
+}
+
+// WithConnState registers a hook called on every connection state change.
+// It runs on the connection's goroutine and should return quickly.
+func WithConnState(hook func(net.Conn, ConnState)) Option {
+	return func(s *Server) {
+		s.connState = hook
+	}
+}
+
+// WithTLS serves TLS instead of plain TCP.
+func WithTLS(cfg TLSConfig) Option {
+	return func(s *Server) {
+		s.tls = &cfg
+	}
+}
+
+// WithHTTP2 accepts HTTP/2 alongside HTTP/1.1: through ALPN on TLS listeners
+// and through prior knowledge (h2c) on plain ones.
+func WithHTTP2() Option {
+	return func(s *Server) {
+		s.http2 = true
+	}
+}
+
+// WithRequestDecoding decompresses gzip and deflate request bodies before
+// handlers see them. A decoded body over maxSize bytes, or over maxRatio
+// times its compressed size, gets 413; other encodings get 415. Zero
+// arguments mean 10MB and a ratio of 100. Bodies taken through BodyReader
+// are passed on as they were sent.
+func WithRequestDecoding(maxSize int64, maxRatio int64) Option {
+	return func(s *Server) {
+		if maxSize <= 0 {
+			maxSize = defaultMaxDecodedSize
+		}
+		if maxRatio <= 0 {
+			maxRatio = defaultMaxDecodeRatio
+		}
+		s.maxDecodedSize = maxSize
+		s.maxDecodeRatio = maxRatio
+	}
+}
+
+// WithProxyProtocol reads a PROXY protocol header, v1 or v2, off connections
+// from cfg.Trusted peers before anything else, so requests carry the
+// original client address in RemoteAddr and the header in Proxy.
+func WithProxyProtocol(cfg proxyproto.Config) Option {
+	return func(s *Server) {
+		s.proxyProtocol = &cfg
+	}
+}
+
+// WithTrustedProxies names the peers whose Forwarded and X-Forwarded-*
+// headers are believed when setting each request's ClientIP, Scheme and
+// Host. Without it those headers are ignored.
+func WithTrustedProxies(prefixes ...netip.Prefix) Option {
+	return func(s *Server) {
+		s.trustedProxies = prefixes
+	}
+}
+
+// WithLogger sets where connection and request errors, handler panics and
+// certificate reload failures are logged. Without it slog.Default is used.
+func WithLogger(l *slog.Logger) Option {
+	return func(s *Server) {
+		if l != nil {
+			s.logger = l
+		}
+	}
+}
+
+// WithRequestID gives every request an ID: the client's X-Request-ID if it
+// sent a usable one, otherwise one from generate, or a random UUID when
+// generate is nil. The ID replaces the request header, is sent back with
+// the response, is on the request context for requestid.FromContext and is
+// in every log line about the request.
+func WithRequestID(generate func() string) Option {
+	return func(s *Server) {
+		if generate == nil {
+			generate = requestid.New
+		}
+		s.newRequestID = generate
+	}
+}
+
+// WithObserver reports connections, traffic, parse errors and handler
+// panics to o, as the metrics package does.
+func WithObserver(o Observer) Option {
+	return func(s *Server) {
+		s.observer = o
+	}
+}
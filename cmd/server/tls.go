@@ -0,0 +1,219 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultReloadInterval = time.Minute
+
+type TLSConfig struct {
+	// Certificates are matched against the client's SNI name in order. The
+	// first one is served when nothing matches or no name was sent.
+	Certificates []CertFile
+	// MinVersion defaults to TLS 1.2.
+	MinVersion uint16
+	// CipherSuites only applies to TLS 1.2 and below; nil keeps Go's defaults.
+	CipherSuites []uint16
+	// ReloadInterval is how often the files are checked for changes. Zero
+	// means one minute, a negative value turns reloading off.
+	ReloadInterval time.Duration
+}
+
+type CertFile struct {
+	CertFile string
+	KeyFile  string
+}
+
+// certStore holds the loaded key pairs and swaps them out when the files
+// on disk change.
+type certStore struct {
+	files []CertFile
+
+	mu      sync.RWMutex
+	certs   []*tls.Certificate
+	modTime []time.Time
+}
+
+func newCertStore(files []CertFile) (*certStore, error) {
+	if len(files) == 0 {
+		return nil, errors.New("tls: at least one certificate is required")
+	}
+	cs := &certStore{
+		files:   files,
+		certs:   make([]*tls.Certificate, len(files)),
+		modTime: make([]time.Time, len(files)),
+	}
+	for i := range files {
+		if _, err := cs.load(i); err != nil {
+			return nil, err
+		}
+	}
+	return cs, nil
+}
+
+// load reads files[i] again if either file changed since the last load and
+// reports whether it did.
+func (cs *certStore) load(i int) (bool, error) {
+	f := cs.files[i]
+	modTime, err := latestModTime(f.CertFile, f.KeyFile)
+	if err != nil {
+		return false, err
+	}
+	cs.mu.RLock()
+	unchanged := cs.certs[i] != nil && modTime.Equal(cs.modTime[i])
+	cs.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+	if err != nil {
+		return false, fmt.Errorf("tls: loading %s, err=%w", f.CertFile, err)
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return false, fmt.Errorf("tls: parsing %s, err=%w", f.CertFile, err)
+		}
+	}
+	cs.mu.Lock()
+	cs.certs[i] = &cert
+	cs.modTime[i] = modTime
+	cs.mu.Unlock()
+	return true, nil
+}
+
+// reload keeps serving the previous certificate when a rotated one fails to
+// load, which usually means the cert and key were caught mid-write.
+func (cs *certStore) reload(log *slog.Logger) {
+	for i := range cs.files {
+		if _, err := cs.load(i); err != nil {
+			log.Error("certificate reload failed", "cert", cs.files[i].CertFile, "err", err)
+		}
+	}
+}
+
+func (cs *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	if hello.ServerName != "" {
+		for _, cert := range cs.certs {
+			if hello.SupportsCertificate(cert) == nil {
+				return cert, nil
+			}
+		}
+	}
+	return cs.certs[0], nil
+}
+
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (s *Server) listenTLS(ln net.Listener) (net.Listener, error) {
+	cs, err := newCertStore(s.tls.Certificates)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		GetCertificate: cs.getCertificate,
+		MinVersion:     s.tls.MinVersion,
+		CipherSuites:   s.tls.CipherSuites,
+	}
+	if conf.MinVersion == 0 {
+		conf.MinVersion = tls.VersionTLS12
+	}
+	if s.http2 {
+		conf.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	interval := s.tls.ReloadInterval
+	if interval == 0 {
+		interval = defaultReloadInterval
+	}
+	if interval > 0 {
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					cs.reload(s.logger)
+				case <-s.done:
+					return
+				}
+			}
+		}()
+	}
+	return tls.NewListener(ln, conf), nil
+}
+
+// GenerateSelfSignedCert returns a PEM encoded certificate and ECDSA key valid
+// for a year for the given DNS names and IP addresses.
+func GenerateSelfSignedCert(hosts ...string) (certPEM []byte, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"httpfromtcp"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	if len(hosts) > 0 {
+		template.Subject.CommonName = hosts[0]
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeCert(t *testing.T, dir string, name string, modTime time.Time) CertFile {
+	certPEM, keyPEM, err := GenerateSelfSignedCert(name)
+	require.NoError(t, err)
+	f := CertFile{
+		CertFile: filepath.Join(dir, name+".crt"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+	}
+	require.NoError(t, os.WriteFile(f.CertFile, certPEM, 0o600))
+	require.NoError(t, os.WriteFile(f.KeyFile, keyPEM, 0o600))
+	require.NoError(t, os.Chtimes(f.CertFile, modTime, modTime))
+	require.NoError(t, os.Chtimes(f.KeyFile, modTime, modTime))
+	return f
+}
+
+func dialTLS(t *testing.T, srv *Server, serverName string) *x509.Certificate {
+	conn, err := tls.Dial("tcp", srv.Addr().String(), &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	})
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: " + serverName + "\r\n\r\n"))
+	require.NoError(t, err)
+	body, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "HTTP/1.1 200 OK")
+	return conn.ConnectionState().PeerCertificates[0]
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	past := time.Now().Add(-time.Hour)
+	a := writeCert(t, dir, "a.test", past)
+	b := writeCert(t, dir, "b.test", past)
+
+	var sawTLS atomic.Bool
+	handler := func(w *response.Writer, r *request.Request) {
+		sawTLS.Store(r.TLS != nil && r.TLS.ServerName != "")
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders())
+	}
+	srv, err := Serve(handler, 0, WithTLS(TLSConfig{
+		Certificates:   []CertFile{a, b},
+		ReloadInterval: 20 * time.Millisecond,
+	}))
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: SNI picks the matching certificate
+	assert.Equal(t, []string{"a.test"}, dialTLS(t, srv, "a.test").DNSNames)
+	assert.True(t, sawTLS.Load())
+	assert.Equal(t, []string{"b.test"}, dialTLS(t, srv, "b.test").DNSNames)
+
+	// Test: Unknown names get the first certificate
+	assert.Equal(t, []string{"a.test"}, dialTLS(t, srv, "c.test").DNSNames)
+
+	// Test: A rotated certificate is picked up without a restart
+	before := dialTLS(t, srv, "b.test").SerialNumber
+	writeCert(t, dir, "b.test", time.Now())
+	require.Eventually(t, func() bool {
+		return dialTLS(t, srv, "b.test").SerialNumber.Cmp(before) != 0
+	}, 2*time.Second, 20*time.Millisecond)
+
+	// Test: Missing files fail at startup
+	_, err = Serve(handler, 0, WithTLS(TLSConfig{
+		Certificates: []CertFile{{CertFile: filepath.Join(dir, "nope.crt"), KeyFile: filepath.Join(dir, "nope.key")}},
+	}))
+	require.Error(t, err)
+}
@@ -0,0 +1,188 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	server "github.com/Barrioslopezfd/httpfromtcp/cmd/server"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/response"
+)
+
+// Formats for Config.Format. Common and Combined are Apache's, written as
+// templates over Entry; JSON writes one object per line.
+const (
+	Common   = `{{.ClientIP}} - {{esc .User}} [{{.Time.Format "02/Jan/2006:15:04:05 -0700"}}] "{{.Method}} {{esc .URI}} {{.Proto}}" {{.Status}} {{if .Bytes}}{{.Bytes}}{{else}}-{{end}}`
+	Combined = Common + ` "{{esc .Referer}}" "{{esc .UserAgent}}"`
+	JSON     = "json"
+)
+
+type Config struct {
+	// Format is Common, Combined, JSON or any text/template over Entry,
+	// which may use esc to quote a string the way Apache does. Empty means
+	// Combined.
+	Format string
+	// Output receives one line per request. Nil means os.Stdout; see
+	// NewRotatingFile for a file.
+	Output io.Writer
+}
+
+// Entry is what is known about a request once it has been answered.
+type Entry struct {
+	Time      time.Time     `json:"time"`
+	ClientIP  string        `json:"client_ip"`
+	User      string        `json:"user,omitempty"`
+	Method    string        `json:"method"`
+	URI       string        `json:"uri"`
+	Proto     string        `json:"proto"`
+	Host      string        `json:"host,omitempty"`
+	Status    int           `json:"status"`
+	Bytes     int           `json:"bytes"`
+	Duration  time.Duration `json:"-"`
+	Referer   string        `json:"referer,omitempty"`
+	UserAgent string        `json:"user_agent,omitempty"`
+	RequestID string        `json:"request_id,omitempty"`
+}
+
+type logger struct {
+	mu   sync.Mutex
+	out  io.Writer
+	tmpl *template.Template
+	json bool
+}
+
+// New wraps next so every request it serves is logged after the response
+// is written. It should be the outermost middleware, so the status and
+// byte count are those that went to the client. A handler that panics
+// before responding is logged with the 500 the server answers it with.
+func New(next server.Handler, cfg Config) (server.Handler, error) {
+	if cfg.Format == "" {
+		cfg.Format = Combined
+	}
+	if cfg.Output == nil {
+		cfg.Output = os.Stdout
+	}
+	l := &logger{out: cfg.Output}
+	if cfg.Format == JSON {
+		l.json = true
+	} else {
+		tmpl, err := template.New("accesslog").Funcs(template.FuncMap{"esc": escape}).Parse(cfg.Format)
+		if err != nil {
+			return nil, fmt.Errorf("accesslog: %w", err)
+		}
+		l.tmpl = tmpl
+	}
+	return func(w *response.Writer, r *request.Request) {
+		start := time.Now()
+		defer func() {
+			if p := recover(); p != nil {
+				e := newEntry(w, r, start)
+				if e.Status == 0 {
+					e.Status = int(response.INTERNAL_SERVER_ERROR)
+				}
+				l.log(e)
+				panic(p)
+			}
+		}()
+		next(w, r)
+		l.log(newEntry(w, r, start))
+	}, nil
+}
+
+func newEntry(w *response.Writer, r *request.Request, start time.Time) *Entry {
+	e := &Entry{
+		Time:     start,
+		Method:   r.RequestLine.Method,
+		URI:      r.RequestLine.RequestTarget,
+		Proto:    "HTTP/" + r.RequestLine.HttpVersion,
+		Host:     r.Host,
+		Status:   int(w.Status()),
+		Bytes:    w.BytesWritten(),
+		Duration: time.Since(start),
+		User:     basicUser(r),
+	}
+	if r.ClientIP.IsValid() {
+		e.ClientIP = r.ClientIP.String()
+	} else if r.RemoteAddr != nil {
+		e.ClientIP = r.RemoteAddr.String()
+	}
+	if e.Host == "" {
+		e.Host, _ = r.Headers.Get("host")
+	}
+	e.Referer, _ = r.Headers.Get("referer")
+	e.UserAgent, _ = r.Headers.Get("user-agent")
+	// The ID a handler or middleware settled on is the one sent back.
+	if h := w.SentHeaders(); h != nil {
+		e.RequestID, _ = h.Get("x-request-id")
+	}
+	if e.RequestID == "" {
+		e.RequestID, _ = r.Headers.Get("x-request-id")
+	}
+	return e
+}
+
+func (l *logger) log(e *Entry) {
+	var buf bytes.Buffer
+	if l.json {
+		type jsonEntry struct {
+			*Entry
+			DurationMS float64 `json:"duration_ms"`
+		}
+		json.NewEncoder(&buf).Encode(jsonEntry{e, float64(e.Duration) / float64(time.Millisecond)})
+	} else {
+		if err := l.tmpl.Execute(&buf, e); err != nil {
+			return
+		}
+		buf.WriteByte('\n')
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(buf.Bytes())
+}
+
+func basicUser(r *request.Request) string {
+	v, ok := r.Headers.Get("authorization")
+	if !ok {
+		return ""
+	}
+	scheme, credentials, _ := strings.Cut(v, " ")
+	if !strings.EqualFold(scheme, "basic") {
+		return ""
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return ""
+	}
+	user, _, _ := strings.Cut(string(decoded), ":")
+	return user
+}
+
+// escape writes "-" for an empty string, and otherwise escapes quotes,
+// backslashes and control bytes so a client cannot forge log lines.
+func escape(s string) string {
+	if s == "" {
+		return "-"
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,137 @@
+package accesslog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	server "github.com/Barrioslopezfd/httpfromtcp/cmd/server"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lines collects log lines; entries are written after the response, so
+// tests wait for them.
+type lines struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (l *lines) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *lines) next(t *testing.T) string {
+	t.Helper()
+	var line string
+	require.Eventually(t, func() bool {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		s := l.buf.String()
+		i := strings.IndexByte(s, '\n')
+		if i < 0 {
+			return false
+		}
+		line = s[:i]
+		l.buf.Reset()
+		l.buf.WriteString(s[i+1:])
+		return true
+	}, 2*time.Second, 5*time.Millisecond)
+	return line
+}
+
+func serve(t *testing.T, cfg Config) string {
+	t.Helper()
+	handler := func(w *response.Writer, r *request.Request) {
+		body := "hello world"
+		h := response.GetDefaultHeaders()
+		h.Replace("Content-Length", fmt.Sprint(len(body)))
+		h.Replace("X-Request-ID", "req-42")
+		if r.RequestLine.RequestTarget == "/panic" {
+			panic("handler failed")
+		}
+		if r.RequestLine.RequestTarget == "/missing" {
+			w.WriteStatusLine(response.NOT_FOUND)
+			w.WriteHeaders(response.GetDefaultHeaders())
+			return
+		}
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	}
+	logged, err := New(handler, cfg)
+	require.NoError(t, err)
+	srv, err := server.Serve(logged, 0)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	return srv.Addr().String()
+}
+
+func send(t *testing.T, addr string, raw string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte(raw))
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+}
+
+func TestFormats(t *testing.T) {
+	out := &lines{}
+	addr := serve(t, Config{Format: Common, Output: out})
+
+	// Test: Common
+	send(t, addr, "GET /a?b=c HTTP/1.1\r\nHost: localhost\r\nAuthorization: Basic YWxpY2U6c2VjcmV0\r\n\r\n")
+	assert.Regexp(t, regexp.MustCompile(`^\S+ - alice \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /a\?b=c HTTP/1\.1" 200 11$`), out.next(t))
+	send(t, addr, "GET /missing HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Regexp(t, `"GET /missing HTTP/1\.1" 404 -$`, out.next(t))
+
+	// Test: A handler that panics is logged with its 500
+	send(t, addr, "GET /panic HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Regexp(t, `"GET /panic HTTP/1\.1" 500 -$`, out.next(t))
+
+	// Test: Combined, with quotes in the user agent escaped
+	out = &lines{}
+	addr = serve(t, Config{Output: out})
+	send(t, addr, "GET / HTTP/1.1\r\nHost: localhost\r\nReferer: http://ref.example/\r\nUser-Agent: evil\" \"agent\r\n\r\n")
+	assert.Regexp(t, `" 200 11 "http://ref\.example/" "evil\\" \\"agent"$`, out.next(t))
+
+	// Test: JSON
+	out = &lines{}
+	addr = serve(t, Config{Format: JSON, Output: out})
+	send(t, addr, "GET /j HTTP/1.1\r\nHost: localhost\r\nUser-Agent: test\r\n\r\n")
+	var entry map[string]any
+	require.NoError(t, json.Unmarshal([]byte(out.next(t)), &entry))
+	assert.Equal(t, "GET", entry["method"])
+	assert.Equal(t, "/j", entry["uri"])
+	assert.Equal(t, float64(200), entry["status"])
+	assert.Equal(t, float64(11), entry["bytes"])
+	assert.Equal(t, "test", entry["user_agent"])
+	assert.Equal(t, "req-42", entry["request_id"])
+	assert.Contains(t, entry, "duration_ms")
+
+	// Test: Custom template
+	out = &lines{}
+	addr = serve(t, Config{Format: `{{.Status}} {{.Method}} {{.RequestID}} {{esc .Referer}}`, Output: out})
+	send(t, addr, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "200 GET req-42 -", out.next(t))
+
+	_, err := New(nil, Config{Format: "{{.Nope"})
+	assert.Error(t, err)
+}
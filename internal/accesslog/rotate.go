@@ -0,0 +1,122 @@
+package accesslog
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultMaxSize = 100 << 20
+
+// rotateRetryInterval is how long writing carries on in an oversized file
+// after moving it aside failed, before trying again.
+const rotateRetryInterval = time.Minute
+
+// RotatingFile is a log file that is moved aside once it reaches MaxSize.
+// The current file is path, older ones path.1, path.2 and so on up to
+// MaxBackups, the highest number being the oldest.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu      sync.Mutex
+	f       *os.File
+	size    int64
+	closed  bool
+	retryAt time.Time
+}
+
+// NewRotatingFile opens path for appending. A maxSize of zero means 100MB.
+// maxBackups old files are kept; zero keeps none.
+func NewRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	if maxSize <= 0 {
+		maxSize = defaultMaxSize
+	}
+	rf := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, info.Size()
+	return nil
+}
+
+// Write appends p, rotating first if p would take the file past MaxSize.
+// A single write is never split across files.
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.closed {
+		return 0, os.ErrClosed
+	}
+	if rf.f == nil {
+		// Reopening after a rotation failed; try again.
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize && !time.Now().Before(rf.retryAt) {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside and starts a new one. If moving
+// fails, writing carries on in the old file rather than losing lines, and
+// rotating is not tried again for a while. Only failing to reopen the file
+// is an error.
+func (rf *RotatingFile) rotate() error {
+	rf.f.Close()
+	rf.f = nil
+	if err := rf.shift(); err != nil {
+		rf.retryAt = time.Now().Add(rotateRetryInterval)
+	}
+	return rf.open()
+}
+
+func (rf *RotatingFile) shift() error {
+	if rf.maxBackups <= 0 {
+		return os.Remove(rf.path)
+	}
+	os.Remove(backupName(rf.path, rf.maxBackups))
+	for i := rf.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(backupName(rf.path, i), backupName(rf.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(rf.path, backupName(rf.path, 1))
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.closed = true
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
+
+func backupName(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
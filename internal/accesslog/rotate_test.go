@@ -0,0 +1,70 @@
+package accesslog
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	rf, err := NewRotatingFile(path, 10, 2)
+	require.NoError(t, err)
+	defer rf.Close()
+
+	// Test: Files are moved aside when full, and the oldest dropped
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := rf.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	read := func(name string) string {
+		b, _ := os.ReadFile(name)
+		return string(b)
+	}
+	assert.Equal(t, "fourth\n", read(path))
+	assert.Equal(t, "third\n", read(path+".1"))
+	assert.Equal(t, "second\n", read(path+".2"))
+	assert.NoFileExists(t, path+".3")
+
+	// Test: Reopening appends to what is there
+	require.NoError(t, rf.Close())
+	rf, err = NewRotatingFile(path, 100, 0)
+	require.NoError(t, err)
+	rf.Write([]byte("fifth\n"))
+	assert.Equal(t, "fourth\nfifth\n", read(path))
+}
+
+func TestRotatingFileShiftFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	// A directory with something in it where the backup goes can be neither
+	// removed nor replaced.
+	require.NoError(t, os.MkdirAll(filepath.Join(path+".1", "taken"), 0o755))
+	rf, err := NewRotatingFile(path, 10, 1)
+	require.NoError(t, err)
+	defer rf.Close()
+
+	// Test: Lines keep going to the current file when it cannot be moved aside
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		n, err := rf.Write([]byte(line))
+		require.NoError(t, err)
+		assert.Equal(t, len(line), n)
+	}
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "first\nsecond\nthird\n", string(b))
+	assert.False(t, rf.retryAt.IsZero())
+
+	// Test: Rotation is tried again once the retry time has passed
+	require.NoError(t, os.RemoveAll(path+".1"))
+	rf.retryAt = time.Time{}
+	_, err = rf.Write([]byte("fourth\n"))
+	require.NoError(t, err)
+	b, _ = os.ReadFile(path)
+	assert.Equal(t, "fourth\n", string(b))
+	b, _ = os.ReadFile(path + ".1")
+	assert.Equal(t, "first\nsecond\nthird\n", string(b))
+}
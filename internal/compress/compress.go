@@ -0,0 +1,371 @@
+package compress
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"maps"
+	"strconv"
+	"strings"
+	"time"
+
+	server "github.com/Barrioslopezfd/httpfromtcp/cmd/server"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/headers"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/response"
+)
+
+const defaultMinSize = 1024
+
+// DefaultExcludedTypes are content types that are already compressed or are
+// streamed and must not sit in a compressor's buffer.
+var DefaultExcludedTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zstd",
+	"application/octet-stream",
+	"text/event-stream",
+}
+
+type Config struct {
+	// Level is passed to gzip and zlib. Zero or anything outside
+	// gzip.HuffmanOnly..gzip.BestCompression means gzip.DefaultCompression.
+	Level int
+	// MinSize is the smallest body worth compressing. Zero means 1KB.
+	MinSize int
+	// ExcludedTypes are content type prefixes that are never compressed.
+	// Nil means DefaultExcludedTypes.
+	ExcludedTypes []string
+}
+
+// New wraps next so its responses are compressed with the best encoding the
+// client accepts.
+func New(next server.Handler, cfg Config) server.Handler {
+	if cfg.Level == 0 || cfg.Level < gzip.HuffmanOnly || cfg.Level > gzip.BestCompression {
+		cfg.Level = gzip.DefaultCompression
+	}
+	if cfg.MinSize <= 0 {
+		cfg.MinSize = defaultMinSize
+	}
+	if cfg.ExcludedTypes == nil {
+		cfg.ExcludedTypes = DefaultExcludedTypes
+	}
+	return func(w *response.Writer, r *request.Request) {
+		// Upgrades and tunnels take the raw connection, which a Sink cannot
+		// hand out.
+		if _, ok := r.Headers.Get("upgrade"); ok || r.RequestLine.Method == "CONNECT" {
+			next(w, r)
+			return
+		}
+		accept, _ := r.Headers.Get("accept-encoding")
+		cw := &compressWriter{
+			out:      w,
+			cfg:      &cfg,
+			encoding: Negotiate(accept),
+			headOnly: r.RequestLine.Method == "HEAD",
+		}
+		cw.ifNoneMatch, _ = r.Headers.Get("if-none-match")
+		next(&response.Writer{Sink: cw}, r)
+		cw.finish(nil)
+	}
+}
+
+// Negotiate picks gzip or deflate from an Accept-Encoding value by q-value,
+// preferring gzip on a tie. It returns "" when neither is acceptable.
+func Negotiate(acceptEncoding string) string {
+	q, wildcard := parseAcceptEncoding(acceptEncoding)
+	best, bestQ := "", 0.0
+	for _, enc := range []string{"gzip", "deflate"} {
+		if weight := weightOf(q, wildcard, enc); weight > bestQ {
+			best, bestQ = enc, weight
+		}
+	}
+	return best
+}
+
+// Accepts reports whether an Accept-Encoding value allows encoding at all.
+func Accepts(acceptEncoding string, encoding string) bool {
+	q, wildcard := parseAcceptEncoding(acceptEncoding)
+	return weightOf(q, wildcard, strings.ToLower(encoding)) > 0
+}
+
+func parseAcceptEncoding(acceptEncoding string) (q map[string]float64, wildcard float64) {
+	q = map[string]float64{}
+	wildcard = -1.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		weight := 1.0
+		for _, param := range strings.Split(params, ";") {
+			k, v, ok := strings.Cut(param, "=")
+			if !ok || strings.ToLower(strings.TrimSpace(k)) != "q" {
+				continue
+			}
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil && f >= 0 && f <= 1 {
+				weight = f
+			} else {
+				weight = 0
+			}
+		}
+		if name == "*" {
+			wildcard = weight
+			continue
+		}
+		q[name] = weight
+	}
+	return q, wildcard
+}
+
+func weightOf(q map[string]float64, wildcard float64, enc string) float64 {
+	weight, ok := q[enc]
+	if !ok && enc == "gzip" {
+		weight, ok = q["x-gzip"]
+	}
+	if !ok {
+		weight = wildcard
+	}
+	return weight
+}
+
+type writerState int
+
+const (
+	statePending writerState = iota
+	statePassthrough
+	stateBuffering
+	stateCompressing
+	stateDone
+)
+
+// compressWriter is the Sink handlers write through. Eligible bodies are
+// held back until MinSize bytes arrive, so small responses go out as they
+// were written and larger ones are compressed into chunks. Chunked
+// responses are streams and are compressed from the start, each write
+// flushed through as its own chunk.
+type compressWriter struct {
+	out      *response.Writer
+	cfg      *Config
+	encoding string
+	headOnly bool
+	// ifNoneMatch tells a 304 for the compressed representation from one
+	// for the plain one, since neither has a body to go by.
+	ifNoneMatch string
+
+	state   writerState
+	code    response.Code
+	h       headers.Headers
+	chunked bool
+	buf     []byte
+	zw      flushWriteCloser
+}
+
+// flushWriteCloser is what gzip.Writer and zlib.Writer have in common.
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func (cw *compressWriter) WriteInformational(code response.Code, h headers.Headers) error {
+	return cw.out.WriteInformational(code, h)
+}
+
+func (cw *compressWriter) SetWriteDeadline(t time.Time) error {
+	return cw.out.SetWriteDeadline(t)
+}
+
+func (cw *compressWriter) WriteHead(code response.Code, h headers.Headers) error {
+	h = maps.Clone(h)
+	cw.code = code
+	cw.h = h
+	te, _ := h.Get("transfer-encoding")
+	cw.chunked = strings.EqualFold(te, "chunked")
+
+	if code == response.NOT_MODIFIED && cw.encoding != "" {
+		if etag, ok := h.Get("etag"); ok {
+			if coded := response.CodingETag(etag, cw.encoding); strings.Contains(cw.ifNoneMatch, coded) {
+				h.Replace("ETag", coded)
+			}
+		}
+	}
+	if !cw.compressible() {
+		return cw.writeHead(statePassthrough)
+	}
+	addVary(h, "Accept-Encoding")
+	if cw.encoding == "" || cw.headOnly {
+		return cw.writeHead(statePassthrough)
+	}
+	if v, ok := h.Get("content-length"); ok {
+		if n, err := strconv.Atoi(v); err == nil && n < cw.cfg.MinSize {
+			return cw.writeHead(statePassthrough)
+		}
+		return cw.startCompression()
+	}
+	if cw.chunked {
+		return cw.startCompression()
+	}
+	cw.state = stateBuffering
+	return nil
+}
+
+func (cw *compressWriter) compressible() bool {
+	switch {
+	case cw.code < 200, cw.code == 204, cw.code == 206, cw.code == 304:
+		return false
+	}
+	if _, ok := cw.h.Get("content-encoding"); ok {
+		return false
+	}
+	ct, _ := cw.h.Get("content-type")
+	ct = strings.ToLower(strings.TrimSpace(ct))
+	for _, excluded := range cw.cfg.ExcludedTypes {
+		if strings.HasPrefix(ct, strings.ToLower(excluded)) {
+			return false
+		}
+	}
+	return true
+}
+
+func addVary(h headers.Headers, field string) {
+	v, ok := h.Get("vary")
+	if !ok || strings.TrimSpace(v) == "" {
+		h.Replace("Vary", field)
+		return
+	}
+	for _, f := range strings.Split(v, ",") {
+		f = strings.TrimSpace(f)
+		if f == "*" || strings.EqualFold(f, field) {
+			return
+		}
+	}
+	h.Replace("Vary", v+", "+field)
+}
+
+func (cw *compressWriter) writeHead(next writerState) error {
+	cw.state = next
+	if err := cw.out.WriteStatusLine(cw.code); err != nil {
+		return err
+	}
+	return cw.out.WriteHeaders(cw.h)
+}
+
+func (cw *compressWriter) startCompression() error {
+	cw.h.Remove("Content-Length")
+	cw.h.Replace("Content-Encoding", cw.encoding)
+	if etag, ok := cw.h.Get("etag"); ok {
+		cw.h.Replace("ETag", response.CodingETag(etag, cw.encoding))
+	}
+	cw.h.Replace("Transfer-Encoding", "chunked")
+	if err := cw.writeHead(stateCompressing); err != nil {
+		return err
+	}
+	dst := chunkWriter{cw.out}
+	if cw.encoding == "gzip" {
+		cw.zw, _ = gzip.NewWriterLevel(dst, cw.cfg.Level)
+	} else {
+		cw.zw, _ = zlib.NewWriterLevel(dst, cw.cfg.Level)
+	}
+	buf := cw.buf
+	cw.buf = nil
+	_, err := cw.zw.Write(buf)
+	return err
+}
+
+func (cw *compressWriter) WriteData(p []byte) (int, error) {
+	switch cw.state {
+	case statePassthrough:
+		return cw.writePlain(p)
+	case stateBuffering:
+		cw.buf = append(cw.buf, p...)
+		if len(cw.buf) >= cw.cfg.MinSize {
+			if err := cw.startCompression(); err != nil {
+				return 0, err
+			}
+		}
+		return len(p), nil
+	case stateCompressing:
+		n, err := cw.zw.Write(p)
+		if err == nil && cw.chunked {
+			err = cw.zw.Flush()
+		}
+		return n, err
+	}
+	return 0, io.ErrClosedPipe
+}
+
+func (cw *compressWriter) writePlain(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if cw.chunked {
+		if _, err := cw.out.WriteChunkedBody(p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	return cw.out.WriteBody(p)
+}
+
+func (cw *compressWriter) WriteTrailers(h headers.Headers) error {
+	return cw.finish(h)
+}
+
+// finish ends the response once the handler is done, flushing whatever is
+// still buffered. It runs from WriteTrailers for chunked handlers and after
+// the handler returns for everything else, whichever comes first.
+func (cw *compressWriter) finish(trailers headers.Headers) error {
+	switch cw.state {
+	case stateBuffering:
+		// Never reached MinSize, so the body goes out as written.
+		if err := cw.writeHead(statePassthrough); err != nil {
+			return err
+		}
+		if _, err := cw.writePlain(cw.buf); err != nil {
+			return err
+		}
+		cw.buf = nil
+	case stateCompressing:
+		if err := cw.zw.Close(); err != nil {
+			return err
+		}
+		cw.chunked = true
+	case statePassthrough:
+	default:
+		return nil
+	}
+	cw.state = stateDone
+
+	if !cw.chunked {
+		return nil
+	}
+	if _, err := cw.out.WriteChunkedBodyDone(); err != nil {
+		return err
+	}
+	if trailers == nil {
+		trailers = headers.NewHeaders()
+	}
+	return cw.out.WriteTrailers(trailers)
+}
+
+// chunkWriter sends each compressor flush as one chunk.
+type chunkWriter struct {
+	w *response.Writer
+}
+
+func (c chunkWriter) Write(p []byte) (int, error) {
+	// An empty chunk would end the body.
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if _, err := c.w.WriteChunkedBody(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
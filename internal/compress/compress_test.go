@@ -0,0 +1,219 @@
+package compress
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	server "github.com/Barrioslopezfd/httpfromtcp/cmd/server"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/etag"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var page = strings.Repeat("<p>hello compression</p>\n", 200)
+
+func testHandler(w *response.Writer, r *request.Request) {
+	body := page
+	contentType := "text/html"
+	switch r.RequestLine.RequestTarget {
+	case "/tiny":
+		body = "hi"
+	case "/image":
+		contentType = "image/png"
+	case "/chunked":
+		w.WriteStatusLine(response.OK)
+		h := response.GetDefaultHeaders()
+		h.Remove("Content-Length")
+		h.Replace("Transfer-Encoding", "chunked")
+		h.Replace("Content-Type", contentType)
+		w.WriteHeaders(h)
+		for i := 0; i < 10; i++ {
+			w.WriteChunkedBody([]byte(page[:len(page)/10]))
+		}
+		w.WriteChunkedBodyDone()
+		w.WriteTrailers(response.GetDefaultHeaders())
+		return
+	}
+	w.WriteStatusLine(response.OK)
+	h := response.GetDefaultHeaders()
+	h.Replace("Content-Length", fmt.Sprint(len(body)))
+	h.Replace("Content-Type", contentType)
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(body))
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := map[string]string{
+		"":                           "",
+		"gzip":                       "gzip",
+		"deflate, gzip":              "gzip",
+		"gzip;q=0.5, deflate":        "deflate",
+		"gzip;q=0":                   "",
+		"*":                          "gzip",
+		"*;q=0.3, gzip;q=0":          "deflate",
+		"br, identity":               "",
+		"GZIP;Q=0.8, deflate;q=0.81": "deflate",
+		"x-gzip":                     "gzip",
+	}
+	for header, want := range tests {
+		assert.Equal(t, want, Negotiate(header), header)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	srv, err := server.Serve(New(testHandler, Config{Level: gzip.BestSpeed}), 0)
+	require.NoError(t, err)
+	defer srv.Close()
+	base := "http://" + srv.Addr().String()
+	client := &http.Client{
+		Transport: &http.Transport{DisableCompression: true},
+		Timeout:   5 * time.Second,
+	}
+	get := func(path, acceptEncoding string) (*http.Response, string) {
+		req, err := http.NewRequest("GET", base+path, nil)
+		require.NoError(t, err)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		var body io.Reader = res.Body
+		switch res.Header.Get("Content-Encoding") {
+		case "gzip":
+			body, err = gzip.NewReader(res.Body)
+			require.NoError(t, err)
+		case "deflate":
+			body, err = zlib.NewReader(res.Body)
+			require.NoError(t, err)
+		}
+		b, err := io.ReadAll(body)
+		require.NoError(t, err)
+		return res, string(b)
+	}
+
+	// Test: gzip for a large HTML body
+	res, body := get("/", "gzip, deflate")
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"))
+	assert.Equal(t, int64(-1), res.ContentLength)
+	assert.Equal(t, page, body)
+
+	// Test: q-values pick deflate
+	res, body = get("/", "gzip;q=0.2, deflate")
+	assert.Equal(t, "deflate", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, page, body)
+
+	// Test: Chunked handlers are compressed too
+	res, body = get("/chunked", "gzip")
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, page, body)
+
+	// Test: No Accept-Encoding means identity, still with Vary
+	res, body = get("/", "")
+	assert.Empty(t, res.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"))
+	assert.Equal(t, int64(len(page)), res.ContentLength)
+	assert.Equal(t, page, body)
+
+	// Test: Tiny bodies are left alone
+	res, body = get("/tiny", "gzip")
+	assert.Empty(t, res.Header.Get("Content-Encoding"))
+	assert.Equal(t, "hi", body)
+
+	// Test: Excluded content types are left alone
+	res, body = get("/image", "gzip")
+	assert.Empty(t, res.Header.Get("Content-Encoding"))
+	assert.Empty(t, res.Header.Get("Vary"))
+	assert.Equal(t, page, body)
+}
+
+func TestCompressStream(t *testing.T) {
+	next := make(chan struct{})
+	handler := func(w *response.Writer, r *request.Request) {
+		h := response.GetDefaultHeaders()
+		h.Remove("Content-Length")
+		h.Replace("Transfer-Encoding", "chunked")
+		h.Replace("Content-Type", "text/plain")
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("first\n"))
+		<-next
+		w.WriteChunkedBody([]byte("second\n"))
+		w.WriteChunkedBodyDone()
+		w.WriteTrailers(response.GetDefaultHeaders())
+	}
+	srv, err := server.Serve(New(handler, Config{}), 0)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", "http://"+srv.Addr().String()+"/", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "gzip")
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}, Timeout: 5 * time.Second}
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+
+	// Test: Each write of a stream arrives while the handler is still going
+	zr, err := gzip.NewReader(res.Body)
+	require.NoError(t, err)
+	first := make([]byte, len("first\n"))
+	_, err = io.ReadFull(zr, first)
+	require.NoError(t, err)
+	assert.Equal(t, "first\n", string(first))
+
+	close(next)
+	rest, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, "second\n", string(rest))
+}
+
+func TestCompressETag(t *testing.T) {
+	srv, err := server.Serve(New(etag.New(testHandler, etag.Config{}), Config{}), 0)
+	require.NoError(t, err)
+	defer srv.Close()
+	client := &http.Client{
+		Transport: &http.Transport{DisableCompression: true},
+		Timeout:   5 * time.Second,
+	}
+	get := func(acceptEncoding, ifNoneMatch string) *http.Response {
+		req, err := http.NewRequest("GET", "http://"+srv.Addr().String()+"/", nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		return res
+	}
+
+	// Test: Each coding gets its own strong ETag
+	plain := get("identity", "").Header.Get("ETag")
+	gzipped := get("gzip", "").Header.Get("ETag")
+	require.NotEmpty(t, plain)
+	assert.Equal(t, strings.TrimSuffix(plain, `"`)+`-gzip"`, gzipped)
+	assert.Equal(t, strings.TrimSuffix(plain, `"`)+`-deflate"`, get("deflate", "").Header.Get("ETag"))
+
+	// Test: The coded tag revalidates and the 304 repeats it
+	res := get("gzip", gzipped)
+	assert.Equal(t, http.StatusNotModified, res.StatusCode)
+	assert.Equal(t, gzipped, res.Header.Get("ETag"))
+
+	// Test: The plain tag revalidates too, and keeps its own ETag
+	res = get("gzip", plain)
+	assert.Equal(t, http.StatusNotModified, res.StatusCode)
+	assert.Equal(t, plain, res.Header.Get("ETag"))
+}
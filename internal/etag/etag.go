@@ -0,0 +1,229 @@
+package etag
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	server "github.com/Barrioslopezfd/httpfromtcp/cmd/server"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/headers"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/response"
+)
+
+const defaultMaxSize = 1 << 20
+
+type Config struct {
+	// Weak marks generated tags W/, for responses that are equivalent but
+	// not byte for byte identical across requests.
+	Weak bool
+	// MaxSize is the largest body that is buffered to be hashed. Bigger
+	// responses stream through without an ETag. Zero means 1MB.
+	MaxSize int
+}
+
+// New wraps next so successful GET and HEAD responses carry an ETag computed
+// from their body, and conditional requests are answered with 304 or 412.
+// Only responses without chunked framing are buffered and tagged.
+// A HEAD reaches next as a HEAD. Whatever body it writes anyway is tagged
+// like the GET's and then dropped; without one the head goes out as written.
+// Responses that set their own ETag keep it.
+func New(next server.Handler, cfg Config) server.Handler {
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = defaultMaxSize
+	}
+	return func(w *response.Writer, r *request.Request) {
+		method := r.RequestLine.Method
+		if _, upgrade := r.Headers.Get("upgrade"); upgrade || (method != "GET" && method != "HEAD") {
+			next(w, r)
+			return
+		}
+		bw := &bufferWriter{
+			out:      w,
+			r:        r,
+			cfg:      &cfg,
+			headOnly: method == "HEAD",
+		}
+		next(&response.Writer{Sink: bw}, r)
+		bw.finish()
+	}
+}
+
+// Generate returns the tag for a body.
+func Generate(body []byte, weak bool) string {
+	sum := sha256.Sum256(body)
+	tag := fmt.Sprintf(`"%x-%s"`, len(body), hex.EncodeToString(sum[:12]))
+	if weak {
+		return "W/" + tag
+	}
+	return tag
+}
+
+// bufferWriter is the Sink handlers write through. It holds the response
+// until the handler is done unless it is chunked or the body outgrows
+// MaxSize, in which case everything streams through untouched.
+type bufferWriter struct {
+	out      *response.Writer
+	r        *request.Request
+	cfg      *Config
+	headOnly bool
+
+	code      response.Code
+	h         headers.Headers
+	chunked   bool
+	wroteHead bool
+	streaming bool
+	done      bool
+	ended     bool
+	buf       []byte
+	trailers  headers.Headers
+}
+
+func (bw *bufferWriter) WriteInformational(code response.Code, h headers.Headers) error {
+	return bw.out.WriteInformational(code, h)
+}
+
+func (bw *bufferWriter) SetWriteDeadline(t time.Time) error {
+	return bw.out.SetWriteDeadline(t)
+}
+
+func (bw *bufferWriter) WriteHead(code response.Code, h headers.Headers) error {
+	bw.code = code
+	bw.h = maps.Clone(h)
+	bw.wroteHead = true
+	te, _ := h.Get("transfer-encoding")
+	bw.chunked = strings.EqualFold(te, "chunked")
+	// Chunked responses are streams, such as server-sent events, that must
+	// not wait in a buffer.
+	if bw.chunked {
+		return bw.stream()
+	}
+	return nil
+}
+
+func (bw *bufferWriter) WriteData(p []byte) (int, error) {
+	if bw.streaming {
+		return bw.writeBody(p)
+	}
+	bw.buf = append(bw.buf, p...)
+	if len(bw.buf) > bw.cfg.MaxSize {
+		if err := bw.stream(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (bw *bufferWriter) WriteTrailers(h headers.Headers) error {
+	if bw.streaming {
+		return bw.endChunked(h)
+	}
+	bw.trailers = h
+	return nil
+}
+
+// stream gives up on buffering and sends what is held so far.
+func (bw *bufferWriter) stream() error {
+	bw.streaming = true
+	if err := bw.writeHead(bw.code, bw.h); err != nil {
+		return err
+	}
+	buf := bw.buf
+	bw.buf = nil
+	_, err := bw.writeBody(buf)
+	return err
+}
+
+func (bw *bufferWriter) writeHead(code response.Code, h headers.Headers) error {
+	if err := bw.out.WriteStatusLine(code); err != nil {
+		return err
+	}
+	return bw.out.WriteHeaders(h)
+}
+
+func (bw *bufferWriter) writeBody(p []byte) (int, error) {
+	if bw.headOnly || len(p) == 0 {
+		return len(p), nil
+	}
+	if bw.chunked {
+		if _, err := bw.out.WriteChunkedBody(p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	return bw.out.WriteBody(p)
+}
+
+func (bw *bufferWriter) endChunked(trailers headers.Headers) error {
+	if !bw.chunked || bw.headOnly || bw.ended {
+		return nil
+	}
+	bw.ended = true
+	if _, err := bw.out.WriteChunkedBodyDone(); err != nil {
+		return err
+	}
+	if trailers == nil {
+		trailers = headers.NewHeaders()
+	}
+	return bw.out.WriteTrailers(trailers)
+}
+
+// finish tags the buffered response, settles the preconditions and sends
+// whichever response they call for.
+func (bw *bufferWriter) finish() error {
+	if !bw.wroteHead || bw.done {
+		return nil
+	}
+	bw.done = true
+	if bw.streaming {
+		return bw.endChunked(nil)
+	}
+
+	h := bw.h
+	if bw.code >= 200 && bw.code < 300 {
+		etag, ok := h.Get("etag")
+		if !ok && bw.code == response.OK && bw.hasBody() {
+			etag = Generate(bw.buf, bw.cfg.Weak)
+			h.Replace("ETag", etag)
+		}
+		var modTime time.Time
+		if v, ok := h.Get("last-modified"); ok {
+			modTime, _ = http.ParseTime(v)
+		}
+		switch response.CheckPreconditions(bw.r, etag, modTime) {
+		case response.NOT_MODIFIED:
+			return response.WriteNotModified(bw.out, h)
+		case response.PRECONDITION_FAILED:
+			return response.WritePreconditionFailed(bw.out)
+		}
+	}
+
+	if !bw.chunked && bw.code != 204 && bw.code != response.NOT_MODIFIED && bw.hasBody() {
+		h.Replace("Content-Length", strconv.Itoa(len(bw.buf)))
+	}
+	if err := bw.writeHead(bw.code, h); err != nil {
+		return err
+	}
+	if _, err := bw.writeBody(bw.buf); err != nil {
+		return err
+	}
+	return bw.endChunked(bw.trailers)
+}
+
+// hasBody reports whether the buffer holds the whole body. A HEAD handler
+// usually leaves it out, and then there is nothing to tag or measure.
+func (bw *bufferWriter) hasBody() bool {
+	if !bw.headOnly {
+		return true
+	}
+	if v, ok := bw.h.Get("content-length"); ok {
+		n, err := strconv.Atoi(v)
+		return err == nil && n == len(bw.buf)
+	}
+	return len(bw.buf) > 0
+}
@@ -0,0 +1,108 @@
+package etag
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	server "github.com/Barrioslopezfd/httpfromtcp/cmd/server"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const page = "<p>the same page every time</p>"
+
+func testHandler(w *response.Writer, r *request.Request) {
+	body := page
+	if r.RequestLine.RequestTarget == "/big" {
+		body = strings.Repeat("x", 100)
+	}
+	w.WriteStatusLine(response.OK)
+	h := response.GetDefaultHeaders()
+	h.Replace("Content-Length", fmt.Sprint(len(body)))
+	h.Replace("Last-Modified", "Mon, 06 May 2024 07:08:09 GMT")
+	w.WriteHeaders(h)
+	if r.RequestLine.Method != "HEAD" || r.RequestLine.RequestTarget == "/always" {
+		w.WriteBody([]byte(body))
+	}
+}
+
+func do(t *testing.T, addr string, method string, target string, extra string) (*http.Response, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte(method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n" + extra + "\r\n"))
+	require.NoError(t, err)
+	res, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: method})
+	require.NoError(t, err)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	return res, string(body)
+}
+
+func TestETag(t *testing.T) {
+	srv, err := server.Serve(New(testHandler, Config{MaxSize: 64}), 0)
+	require.NoError(t, err)
+	defer srv.Close()
+	addr := srv.Addr().String()
+
+	// Test: Strong tag from the body
+	res, body := do(t, addr, "GET", "/", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, page, body)
+	tag := res.Header.Get("ETag")
+	assert.Equal(t, Generate([]byte(page), false), tag)
+
+	// Test: HEAD stays HEAD, and its handler's head goes out as written
+	res, body = do(t, addr, "HEAD", "/", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Empty(t, res.Header.Get("ETag"))
+	assert.Equal(t, int64(len(page)), res.ContentLength)
+	assert.Empty(t, body)
+
+	// Test: A body written for HEAD anyway is tagged like the GET's and dropped
+	res, body = do(t, addr, "HEAD", "/always", "")
+	assert.Equal(t, tag, res.Header.Get("ETag"))
+	assert.Equal(t, int64(len(page)), res.ContentLength)
+	assert.Empty(t, body)
+
+	// Test: If-None-Match revalidates to 304
+	res, body = do(t, addr, "GET", "/", "If-None-Match: "+tag+"\r\n")
+	assert.Equal(t, 304, res.StatusCode)
+	assert.Equal(t, tag, res.Header.Get("ETag"))
+	assert.Equal(t, "Mon, 06 May 2024 07:08:09 GMT", res.Header.Get("Last-Modified"))
+	assert.Empty(t, body)
+
+	// Test: If-Match: * passes for a HEAD response that has no tag
+	res, _ = do(t, addr, "HEAD", "/", "If-Match: *\r\n")
+	assert.Equal(t, 200, res.StatusCode)
+
+	// Test: If-Match with a stale tag fails
+	res, _ = do(t, addr, "GET", "/", "If-Match: \"stale\"\r\n")
+	assert.Equal(t, 412, res.StatusCode)
+
+	// Test: If-Modified-Since still works without a tag in hand
+	res, _ = do(t, addr, "GET", "/", "If-Modified-Since: Mon, 06 May 2024 07:08:09 GMT\r\n")
+	assert.Equal(t, 304, res.StatusCode)
+
+	// Test: Bodies over MaxSize stream through untagged
+	res, body = do(t, addr, "GET", "/big", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Empty(t, res.Header.Get("ETag"))
+	assert.Equal(t, strings.Repeat("x", 100), body)
+}
+
+func TestWeak(t *testing.T) {
+	tag := Generate([]byte("abc"), true)
+	assert.True(t, strings.HasPrefix(tag, `W/"`))
+	assert.Equal(t, "W/"+Generate([]byte("abc"), false), tag)
+}
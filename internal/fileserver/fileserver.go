@@ -0,0 +1,317 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	server "github.com/Barrioslopezfd/httpfromtcp/cmd/server"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/compress"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/headers"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/response"
+)
+
+const sniffLen = 512
+
+type Config struct {
+	// IndexFiles are served for a directory in order of preference. Nil
+	// means index.html.
+	IndexFiles []string
+	// Listings renders an HTML index of directories without an index file.
+	// Without it those directories get 403.
+	Listings bool
+}
+
+type fileServer struct {
+	prefix string
+	root   fs.FS
+	cfg    Config
+}
+
+// New serves the files in root under the URL prefix, which is stripped
+// before the lookup.
+func New(prefix string, root fs.FS, cfg Config) server.Handler {
+	if cfg.IndexFiles == nil {
+		cfg.IndexFiles = []string{"index.html"}
+	}
+	fsrv := &fileServer{
+		prefix: "/" + strings.Trim(prefix, "/"),
+		root:   root,
+		cfg:    cfg,
+	}
+	return fsrv.serve
+}
+
+// NewDir is New over a directory on disk. Symlinks are followed only while
+// they resolve to somewhere inside dir.
+func NewDir(prefix string, dir string, cfg Config) (server.Handler, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("fileserver: %s is not a directory", dir)
+	}
+	return New(prefix, rootDir(resolved), cfg), nil
+}
+
+// rootDir is an fs.FS over a directory that refuses to open anything whose
+// real path, after resolving symlinks, lies outside it.
+type rootDir string
+
+func (d rootDir) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) || strings.ContainsAny(name, "\\\x00") {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	full := filepath.Join(string(d), filepath.FromSlash(name))
+	resolved, err := filepath.EvalSymlinks(full)
+	if err != nil {
+		return nil, err
+	}
+	if resolved != string(d) && !strings.HasPrefix(resolved, string(d)+string(filepath.Separator)) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return os.Open(resolved)
+}
+
+func (fsrv *fileServer) serve(w *response.Writer, r *request.Request) {
+	method := r.RequestLine.Method
+	if method != "GET" && method != "HEAD" {
+		h := response.GetDefaultHeaders()
+		h.Replace("Allow", "GET, HEAD")
+		writeStatus(w, response.METHOD_NOT_ALLOWED, h)
+		return
+	}
+	u, err := url.ParseRequestURI(r.RequestLine.RequestTarget)
+	if err != nil {
+		writeStatus(w, response.BAD_REQUEST, response.GetDefaultHeaders())
+		return
+	}
+	urlPath := u.Path
+	if urlPath != fsrv.prefix && !strings.HasPrefix(urlPath, strings.TrimSuffix(fsrv.prefix, "/")+"/") {
+		writeStatus(w, response.NOT_FOUND, response.GetDefaultHeaders())
+		return
+	}
+	// Cleaning a rooted path can never climb above the root, so dot-dot
+	// segments are resolved before the file system sees the name.
+	name := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(urlPath, fsrv.prefix)), "/")
+	if name == "" {
+		name = "."
+	}
+
+	f, info, err := fsrv.open(name)
+	if err != nil {
+		writeStatus(w, errorCode(err), response.GetDefaultHeaders())
+		return
+	}
+	defer f.Close()
+
+	if info.IsDir() {
+		if !strings.HasSuffix(urlPath, "/") {
+			fsrv.redirect(w, u)
+			return
+		}
+		for _, index := range fsrv.cfg.IndexFiles {
+			indexName := path.Join(name, index)
+			ff, finfo, err := fsrv.open(indexName)
+			if err != nil {
+				continue
+			}
+			defer ff.Close()
+			if finfo.IsDir() {
+				continue
+			}
+			fsrv.serveFile(w, r, indexName, ff, finfo)
+			return
+		}
+		if !fsrv.cfg.Listings {
+			writeStatus(w, response.FORBIDDEN, response.GetDefaultHeaders())
+			return
+		}
+		fsrv.serveListing(w, r, f, info)
+		return
+	}
+	fsrv.serveFile(w, r, name, f, info)
+}
+
+func (fsrv *fileServer) open(name string) (fs.File, fs.FileInfo, error) {
+	f, err := fsrv.root.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+func errorCode(err error) response.Code {
+	switch {
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, fs.ErrInvalid):
+		return response.NOT_FOUND
+	case errors.Is(err, fs.ErrPermission):
+		return response.FORBIDDEN
+	}
+	return response.INTERNAL_SERVER_ERROR
+}
+
+func (fsrv *fileServer) redirect(w *response.Writer, u *url.URL) {
+	target := u.EscapedPath() + "/"
+	if u.RawQuery != "" {
+		target += "?" + u.RawQuery
+	}
+	h := response.GetDefaultHeaders()
+	h.Replace("Location", target)
+	writeStatus(w, response.MOVED_PERMANENTLY, h)
+}
+
+// serveFile writes a regular file, swapping in name.gz when the client
+// takes gzip and such a sidecar exists. Files that can seek get range
+// support through response.ServeContent.
+func (fsrv *fileServer) serveFile(w *response.Writer, r *request.Request, name string, f fs.File, info fs.FileInfo) {
+	h := headers.NewHeaders()
+	var body io.Reader = f
+	size := info.Size()
+
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		// Sniff from the original even when a sidecar is served, since the
+		// sidecar's bytes are compressed.
+		buf := make([]byte, sniffLen)
+		n, _ := io.ReadFull(f, buf)
+		contentType = http.DetectContentType(buf[:n])
+		if rs, ok := f.(io.Seeker); ok {
+			rs.Seek(0, io.SeekStart)
+		} else {
+			body = io.MultiReader(strings.NewReader(string(buf[:n])), f)
+		}
+	}
+	h.Replace("Content-Type", contentType)
+
+	if gz, gzInfo, err := fsrv.open(name + ".gz"); err == nil {
+		defer gz.Close()
+		h.Replace("Vary", "Accept-Encoding")
+		accept, _ := r.Headers.Get("accept-encoding")
+		if !gzInfo.IsDir() && compress.Accepts(accept, "gzip") {
+			h.Replace("Content-Encoding", "gzip")
+			body, size = gz, gzInfo.Size()
+			info = gzInfo
+		}
+	}
+
+	modTime := info.ModTime()
+	if modTime.Unix() <= 0 {
+		modTime = time.Time{}
+	}
+	if rs, ok := body.(io.ReadSeeker); ok {
+		response.ServeContent(w, r, h, modTime, rs)
+		return
+	}
+	if !modTime.IsZero() {
+		h.Replace("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	switch response.CheckPreconditions(r, "", modTime) {
+	case response.NOT_MODIFIED:
+		response.WriteNotModified(w, h)
+		return
+	case response.PRECONDITION_FAILED:
+		response.WritePreconditionFailed(w)
+		return
+	}
+	h.Replace("Content-Length", fmt.Sprint(size))
+	if err := w.WriteStatusLine(response.OK); err != nil {
+		return
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return
+	}
+	if r.RequestLine.Method == "HEAD" {
+		return
+	}
+	io.Copy(bodyWriter{w}, io.LimitReader(body, size))
+}
+
+func (fsrv *fileServer) serveListing(w *response.Writer, r *request.Request, f fs.File, info fs.FileInfo) {
+	dir, ok := f.(fs.ReadDirFile)
+	if !ok {
+		writeStatus(w, response.FORBIDDEN, response.GetDefaultHeaders())
+		return
+	}
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		writeStatus(w, response.INTERNAL_SERVER_ERROR, response.GetDefaultHeaders())
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	var b strings.Builder
+	b.WriteString("<!doctype html>\n<meta charset=\"utf-8\">\n<pre>\n")
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() {
+			name += "/"
+		}
+		href := (&url.URL{Path: name}).EscapedPath()
+		// A name with a colon would otherwise read as a URL scheme.
+		if strings.Contains(name, ":") {
+			href = "./" + href
+		}
+		fmt.Fprintf(&b, "<a href=\"%s\">%s</a>\n", html.EscapeString(href), html.EscapeString(name))
+	}
+	b.WriteString("</pre>\n")
+
+	h := headers.NewHeaders()
+	h.Replace("Content-Type", "text/html; charset=utf-8")
+	h.Replace("Content-Length", fmt.Sprint(b.Len()))
+	if modTime := info.ModTime(); !modTime.IsZero() && modTime.Unix() > 0 {
+		h.Replace("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	if err := w.WriteStatusLine(response.OK); err != nil {
+		return
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return
+	}
+	if r.RequestLine.Method != "HEAD" {
+		w.WriteBody([]byte(b.String()))
+	}
+}
+
+func writeStatus(w *response.Writer, code response.Code, h headers.Headers) {
+	if err := w.WriteStatusLine(code); err != nil {
+		return
+	}
+	w.WriteHeaders(h)
+}
+
+type bodyWriter struct {
+	w *response.Writer
+}
+
+func (bw bodyWriter) Write(p []byte) (int, error) {
+	return bw.w.WriteBody(p)
+}
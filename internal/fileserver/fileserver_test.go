@@ -0,0 +1,149 @@
+package fileserver
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	server "github.com/Barrioslopezfd/httpfromtcp/cmd/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rawGet sends the target as is, since net/http would clean dot segments
+// before they reach the server.
+func rawGet(t *testing.T, addr string, target string, extra string) (*http.Response, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("GET " + target + " HTTP/1.1\r\nHost: localhost\r\n" + extra + "\r\n"))
+	require.NoError(t, err)
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	return res, string(body)
+}
+
+func TestDir(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "public")
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "docs"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "empty"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(base, "secret.txt"), []byte("top secret"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "index.html"), []byte("<h1>home</h1>"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "app.js"), []byte("console.log(1)"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "README"), []byte("<!DOCTYPE html><p>readme"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "docs", "Guide One.txt"), []byte("guide"), 0o644))
+	require.NoError(t, os.Symlink(filepath.Join(base, "secret.txt"), filepath.Join(root, "escape.txt")))
+	require.NoError(t, os.Symlink(filepath.Join(root, "app.js"), filepath.Join(root, "alias.js")))
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("console.log(1)"))
+	zw.Close()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "app.js.gz"), gz.Bytes(), 0o644))
+
+	handler, err := NewDir("/static", root, Config{Listings: true})
+	require.NoError(t, err)
+	srv, err := server.Serve(handler, 0)
+	require.NoError(t, err)
+	defer srv.Close()
+	addr := srv.Addr().String()
+
+	// Test: Index file, type by extension and Last-Modified
+	res, body := rawGet(t, addr, "/static/", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "<h1>home</h1>", body)
+	assert.Equal(t, "text/html; charset=utf-8", res.Header.Get("Content-Type"))
+	lastModified := res.Header.Get("Last-Modified")
+	assert.NotEmpty(t, lastModified)
+
+	// Test: Revalidation with If-Modified-Since
+	res, _ = rawGet(t, addr, "/static/index.html", "If-Modified-Since: "+lastModified+"\r\n")
+	assert.Equal(t, 304, res.StatusCode)
+
+	// Test: Directory without slash redirects
+	res, _ = rawGet(t, addr, "/static/docs", "")
+	assert.Equal(t, 301, res.StatusCode)
+	assert.Equal(t, "/static/docs/", res.Header.Get("Location"))
+
+	// Test: Listing with escaped names
+	res, body = rawGet(t, addr, "/static/docs/", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Contains(t, body, `<a href="Guide%20One.txt">Guide One.txt</a>`)
+
+	// Test: Escaped names are decoded before the lookup
+	res, body = rawGet(t, addr, "/static/docs/Guide%20One.txt", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "guide", body)
+
+	// Test: Sniffed content type
+	res, _ = rawGet(t, addr, "/static/README", "")
+	assert.Equal(t, "text/html; charset=utf-8", res.Header.Get("Content-Type"))
+
+	// Test: gzip sidecar
+	res, body = rawGet(t, addr, "/static/app.js", "Accept-Encoding: gzip\r\n")
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"))
+	assert.Equal(t, gz.String(), body)
+	res, body = rawGet(t, addr, "/static/app.js", "")
+	assert.Empty(t, res.Header.Get("Content-Encoding"))
+	assert.Equal(t, "console.log(1)", body)
+
+	// Test: Byte ranges
+	res, body = rawGet(t, addr, "/static/app.js", "Range: bytes=0-6\r\n")
+	assert.Equal(t, 206, res.StatusCode)
+	assert.Equal(t, "console", body)
+
+	// Test: Traversal stays inside the root
+	for _, target := range []string{"/static/../secret.txt", "/static/%2e%2e/secret.txt", "/static/docs/../../secret.txt"} {
+		res, body = rawGet(t, addr, target, "")
+		assert.Equal(t, 404, res.StatusCode, target)
+		assert.NotContains(t, body, "top secret", target)
+	}
+
+	// Test: Symlinks out of the root are refused, inside ones are fine
+	res, body = rawGet(t, addr, "/static/escape.txt", "")
+	assert.Equal(t, 403, res.StatusCode)
+	assert.NotContains(t, body, "top secret")
+	res, body = rawGet(t, addr, "/static/alias.js", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "console.log(1)", body)
+
+	// Test: Outside the prefix
+	res, _ = rawGet(t, addr, "/staticfoo/app.js", "")
+	assert.Equal(t, 404, res.StatusCode)
+}
+
+func TestFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a/b.css": {Data: []byte("body{}"), ModTime: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+		"a/c.txt": {Data: []byte("hidden")},
+	}
+	srv, err := server.Serve(New("/", fsys, Config{}), 0)
+	require.NoError(t, err)
+	defer srv.Close()
+	addr := srv.Addr().String()
+
+	// Test: File from an fs.FS
+	res, body := rawGet(t, addr, "/a/b.css", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "body{}", body)
+	assert.Equal(t, "text/css; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Equal(t, "Tue, 02 Jan 2024 03:04:05 GMT", res.Header.Get("Last-Modified"))
+
+	// Test: No listings unless enabled
+	res, _ = rawGet(t, addr, "/a/", "")
+	assert.Equal(t, 403, res.StatusCode)
+}
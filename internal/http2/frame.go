@@ -0,0 +1,381 @@
+package http2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+	frameHeaderLen         = 9
+	DefaultMaxFrameSize    = 16384
+	MaxAllowedFrameSize    = 1<<24 - 1
+	DefaultInitialWindow   = 65535
+	MaxWindowSize          = 1<<31 - 1
+	DefaultHeaderTableSize = 4096
+)
+
+type FrameType uint8
+
+const (
+	FRAME_DATA          FrameType = 0x0
+	FRAME_HEADERS       FrameType = 0x1
+	FRAME_PRIORITY      FrameType = 0x2
+	FRAME_RST_STREAM    FrameType = 0x3
+	FRAME_SETTINGS      FrameType = 0x4
+	FRAME_PUSH_PROMISE  FrameType = 0x5
+	FRAME_PING          FrameType = 0x6
+	FRAME_GOAWAY        FrameType = 0x7
+	FRAME_WINDOW_UPDATE FrameType = 0x8
+	FRAME_CONTINUATION  FrameType = 0x9
+)
+
+var frameName = map[FrameType]string{
+	FRAME_DATA:          "DATA",
+	FRAME_HEADERS:       "HEADERS",
+	FRAME_PRIORITY:      "PRIORITY",
+	FRAME_RST_STREAM:    "RST_STREAM",
+	FRAME_SETTINGS:      "SETTINGS",
+	FRAME_PUSH_PROMISE:  "PUSH_PROMISE",
+	FRAME_PING:          "PING",
+	FRAME_GOAWAY:        "GOAWAY",
+	FRAME_WINDOW_UPDATE: "WINDOW_UPDATE",
+	FRAME_CONTINUATION:  "CONTINUATION",
+}
+
+func (t FrameType) String() string {
+	if name, ok := frameName[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_%d", uint8(t))
+}
+
+const (
+	FLAG_END_STREAM  uint8 = 0x1
+	FLAG_ACK         uint8 = 0x1
+	FLAG_END_HEADERS uint8 = 0x4
+	FLAG_PADDED      uint8 = 0x8
+	FLAG_PRIORITY    uint8 = 0x20
+)
+
+type ErrCode uint32
+
+const (
+	NO_ERROR            ErrCode = 0x0
+	PROTOCOL_ERROR      ErrCode = 0x1
+	INTERNAL_ERROR      ErrCode = 0x2
+	FLOW_CONTROL_ERROR  ErrCode = 0x3
+	SETTINGS_TIMEOUT    ErrCode = 0x4
+	STREAM_CLOSED       ErrCode = 0x5
+	FRAME_SIZE_ERROR    ErrCode = 0x6
+	REFUSED_STREAM      ErrCode = 0x7
+	CANCEL              ErrCode = 0x8
+	COMPRESSION_ERROR   ErrCode = 0x9
+	CONNECT_ERROR       ErrCode = 0xa
+	ENHANCE_YOUR_CALM   ErrCode = 0xb
+	INADEQUATE_SECURITY ErrCode = 0xc
+	HTTP_1_1_REQUIRED   ErrCode = 0xd
+)
+
+// ConnectionError ends the whole connection with a GOAWAY.
+type ConnectionError struct {
+	Code   ErrCode
+	Reason string
+}
+
+func (e ConnectionError) Error() string {
+	return fmt.Sprintf("http2: connection error %d: %s", e.Code, e.Reason)
+}
+
+// StreamError ends a single stream with a RST_STREAM.
+type StreamError struct {
+	StreamID uint32
+	Code     ErrCode
+	Reason   string
+}
+
+func (e StreamError) Error() string {
+	return fmt.Sprintf("http2: stream %d error %d: %s", e.StreamID, e.Code, e.Reason)
+}
+
+type SettingID uint16
+
+const (
+	SETTINGS_HEADER_TABLE_SIZE      SettingID = 0x1
+	SETTINGS_ENABLE_PUSH            SettingID = 0x2
+	SETTINGS_MAX_CONCURRENT_STREAMS SettingID = 0x3
+	SETTINGS_INITIAL_WINDOW_SIZE    SettingID = 0x4
+	SETTINGS_MAX_FRAME_SIZE         SettingID = 0x5
+	SETTINGS_MAX_HEADER_LIST_SIZE   SettingID = 0x6
+)
+
+type Setting struct {
+	ID  SettingID
+	Val uint32
+}
+
+type FrameHeader struct {
+	Length   uint32
+	Type     FrameType
+	Flags    uint8
+	StreamID uint32
+}
+
+func (h FrameHeader) Has(flag uint8) bool {
+	return h.Flags&flag != 0
+}
+
+type Frame struct {
+	FrameHeader
+	Payload []byte
+}
+
+// Framer reads and writes frames on one connection. Writes are serialized so
+// handlers on different streams can share it.
+type Framer struct {
+	r           io.Reader
+	maxReadSize uint32
+	header      [frameHeaderLen]byte
+
+	wmu sync.Mutex
+	w   io.Writer
+}
+
+func NewFramer(w io.Writer, r io.Reader) *Framer {
+	return &Framer{
+		r:           r,
+		w:           w,
+		maxReadSize: DefaultMaxFrameSize,
+	}
+}
+
+// SetMaxReadFrameSize should follow the SETTINGS_MAX_FRAME_SIZE we advertise.
+func (f *Framer) SetMaxReadFrameSize(n uint32) {
+	f.maxReadSize = n
+}
+
+func (f *Framer) ReadFrame() (*Frame, error) {
+	if _, err := io.ReadFull(f.r, f.header[:]); err != nil {
+		return nil, err
+	}
+	fh := FrameHeader{
+		Length:   uint32(f.header[0])<<16 | uint32(f.header[1])<<8 | uint32(f.header[2]),
+		Type:     FrameType(f.header[3]),
+		Flags:    f.header[4],
+		StreamID: binary.BigEndian.Uint32(f.header[5:]) & (1<<31 - 1),
+	}
+	if fh.Length > f.maxReadSize {
+		return nil, ConnectionError{FRAME_SIZE_ERROR, fmt.Sprintf("%s frame of %d bytes", fh.Type, fh.Length)}
+	}
+	payload := make([]byte, fh.Length)
+	if _, err := io.ReadFull(f.r, payload); err != nil {
+		return nil, err
+	}
+	return &Frame{FrameHeader: fh, Payload: payload}, nil
+}
+
+func (f *Framer) WriteFrame(t FrameType, flags uint8, streamID uint32, payload []byte) error {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+	return f.writeFrame(t, flags, streamID, payload)
+}
+
+func (f *Framer) writeFrame(t FrameType, flags uint8, streamID uint32, payload []byte) error {
+	if len(payload) > MaxAllowedFrameSize {
+		return errors.New("http2: frame payload too large")
+	}
+	buf := make([]byte, frameHeaderLen, frameHeaderLen+len(payload))
+	buf[0] = byte(len(payload) >> 16)
+	buf[1] = byte(len(payload) >> 8)
+	buf[2] = byte(len(payload))
+	buf[3] = byte(t)
+	buf[4] = flags
+	binary.BigEndian.PutUint32(buf[5:], streamID&(1<<31-1))
+	buf = append(buf, payload...)
+	_, err := f.w.Write(buf)
+	return err
+}
+
+func (f *Framer) WriteSettings(settings ...Setting) error {
+	payload := make([]byte, 0, 6*len(settings))
+	for _, s := range settings {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(s.ID))
+		payload = binary.BigEndian.AppendUint32(payload, s.Val)
+	}
+	return f.WriteFrame(FRAME_SETTINGS, 0, 0, payload)
+}
+
+func (f *Framer) WriteSettingsAck() error {
+	return f.WriteFrame(FRAME_SETTINGS, FLAG_ACK, 0, nil)
+}
+
+func (f *Framer) WritePing(ack bool, data [8]byte) error {
+	var flags uint8
+	if ack {
+		flags = FLAG_ACK
+	}
+	return f.WriteFrame(FRAME_PING, flags, 0, data[:])
+}
+
+func (f *Framer) WriteGoAway(lastStreamID uint32, code ErrCode, debug string) error {
+	payload := binary.BigEndian.AppendUint32(nil, lastStreamID&(1<<31-1))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	payload = append(payload, debug...)
+	return f.WriteFrame(FRAME_GOAWAY, 0, 0, payload)
+}
+
+func (f *Framer) WriteRSTStream(streamID uint32, code ErrCode) error {
+	return f.WriteFrame(FRAME_RST_STREAM, 0, streamID, binary.BigEndian.AppendUint32(nil, uint32(code)))
+}
+
+func (f *Framer) WriteWindowUpdate(streamID uint32, increment uint32) error {
+	return f.WriteFrame(FRAME_WINDOW_UPDATE, 0, streamID, binary.BigEndian.AppendUint32(nil, increment))
+}
+
+func (f *Framer) WriteData(streamID uint32, endStream bool, data []byte) error {
+	var flags uint8
+	if endStream {
+		flags = FLAG_END_STREAM
+	}
+	return f.WriteFrame(FRAME_DATA, flags, streamID, data)
+}
+
+// WriteHeaders sends block as one HEADERS frame followed by as many
+// CONTINUATION frames as maxFrameSize requires. encode runs under the write
+// lock so header blocks reach the peer in the order their HPACK state was
+// updated.
+func (f *Framer) WriteHeaders(streamID uint32, endStream bool, maxFrameSize uint32, encode func() []byte) error {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+	block := encode()
+	var flags uint8
+	if endStream {
+		flags = FLAG_END_STREAM
+	}
+	t := FRAME_HEADERS
+	for {
+		chunk := block
+		if uint32(len(chunk)) > maxFrameSize {
+			chunk = chunk[:maxFrameSize]
+		}
+		block = block[len(chunk):]
+		if len(block) == 0 {
+			flags |= FLAG_END_HEADERS
+		}
+		if err := f.writeFrame(t, flags, streamID, chunk); err != nil {
+			return err
+		}
+		if len(block) == 0 {
+			return nil
+		}
+		t = FRAME_CONTINUATION
+		flags = 0
+	}
+}
+
+// Settings parses a SETTINGS payload.
+func (fr *Frame) Settings() ([]Setting, error) {
+	if fr.StreamID != 0 {
+		return nil, ConnectionError{PROTOCOL_ERROR, "SETTINGS on a stream"}
+	}
+	if fr.Has(FLAG_ACK) {
+		if len(fr.Payload) != 0 {
+			return nil, ConnectionError{FRAME_SIZE_ERROR, "SETTINGS ack with payload"}
+		}
+		return nil, nil
+	}
+	if len(fr.Payload)%6 != 0 {
+		return nil, ConnectionError{FRAME_SIZE_ERROR, "SETTINGS length not a multiple of 6"}
+	}
+	var settings []Setting
+	for p := fr.Payload; len(p) > 0; p = p[6:] {
+		settings = append(settings, Setting{
+			ID:  SettingID(binary.BigEndian.Uint16(p)),
+			Val: binary.BigEndian.Uint32(p[2:]),
+		})
+	}
+	return settings, nil
+}
+
+// Data returns a DATA payload without its padding.
+func (fr *Frame) Data() ([]byte, error) {
+	return fr.unpad()
+}
+
+// HeaderBlock returns the header block fragment of a HEADERS frame, without
+// padding or priority fields.
+func (fr *Frame) HeaderBlock() ([]byte, error) {
+	p, err := fr.unpad()
+	if err != nil {
+		return nil, err
+	}
+	if fr.Has(FLAG_PRIORITY) {
+		if len(p) < 5 {
+			return nil, ConnectionError{FRAME_SIZE_ERROR, "HEADERS too short for priority"}
+		}
+		if binary.BigEndian.Uint32(p)&(1<<31-1) == fr.StreamID {
+			return nil, StreamError{fr.StreamID, PROTOCOL_ERROR, "stream depends on itself"}
+		}
+		p = p[5:]
+	}
+	return p, nil
+}
+
+func (fr *Frame) unpad() ([]byte, error) {
+	p := fr.Payload
+	if !fr.Has(FLAG_PADDED) {
+		return p, nil
+	}
+	if len(p) < 1 {
+		return nil, ConnectionError{FRAME_SIZE_ERROR, fmt.Sprintf("padded %s without pad length", fr.Type)}
+	}
+	pad := int(p[0])
+	p = p[1:]
+	if pad > len(p) {
+		return nil, ConnectionError{PROTOCOL_ERROR, fmt.Sprintf("%s padding longer than payload", fr.Type)}
+	}
+	return p[:len(p)-pad], nil
+}
+
+func (fr *Frame) uint32Payload() (uint32, error) {
+	if len(fr.Payload) != 4 {
+		return 0, ConnectionError{FRAME_SIZE_ERROR, fmt.Sprintf("%s of %d bytes", fr.Type, len(fr.Payload))}
+	}
+	return binary.BigEndian.Uint32(fr.Payload), nil
+}
+
+func (fr *Frame) WindowIncrement() (uint32, error) {
+	v, err := fr.uint32Payload()
+	return v & (1<<31 - 1), err
+}
+
+func (fr *Frame) RSTCode() (ErrCode, error) {
+	v, err := fr.uint32Payload()
+	return ErrCode(v), err
+}
+
+func (fr *Frame) PingData() ([8]byte, error) {
+	var data [8]byte
+	if fr.StreamID != 0 {
+		return data, ConnectionError{PROTOCOL_ERROR, "PING on a stream"}
+	}
+	if len(fr.Payload) != 8 {
+		return data, ConnectionError{FRAME_SIZE_ERROR, "PING not 8 bytes"}
+	}
+	copy(data[:], fr.Payload)
+	return data, nil
+}
+
+func (fr *Frame) GoAway() (lastStreamID uint32, code ErrCode, err error) {
+	if fr.StreamID != 0 {
+		return 0, 0, ConnectionError{PROTOCOL_ERROR, "GOAWAY on a stream"}
+	}
+	if len(fr.Payload) < 8 {
+		return 0, 0, ConnectionError{FRAME_SIZE_ERROR, "GOAWAY too short"}
+	}
+	return binary.BigEndian.Uint32(fr.Payload) & (1<<31 - 1), ErrCode(binary.BigEndian.Uint32(fr.Payload[4:])), nil
+}
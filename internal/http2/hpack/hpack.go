@@ -0,0 +1,343 @@
+package hpack
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// DefaultTableSize is SETTINGS_HEADER_TABLE_SIZE until a peer says
+	// otherwise.
+	DefaultTableSize = 4096
+	entryOverhead    = 32
+)
+
+var (
+	ErrIntegerOverflow     = errors.New("hpack: integer overflow")
+	ErrTruncated           = errors.New("hpack: truncated header block")
+	ErrHeaderListTooLarge  = errors.New("hpack: header list too large")
+	ErrMisplacedSizeUpdate = errors.New("hpack: dynamic table size update after first field")
+)
+
+type HeaderField struct {
+	Name  string
+	Value string
+	// Sensitive fields are sent as never-indexed literals so that
+	// intermediaries do not put them in a compression context either.
+	Sensitive bool
+}
+
+func (f HeaderField) size() uint32 {
+	return uint32(len(f.Name) + len(f.Value) + entryOverhead)
+}
+
+// dynamicTable keeps the newest entry last. On the wire the newest entry is
+// index len(staticTable)+1.
+type dynamicTable struct {
+	entries []HeaderField
+	size    uint32
+	maxSize uint32
+}
+
+func (t *dynamicTable) add(f HeaderField) {
+	t.entries = append(t.entries, f)
+	t.size += f.size()
+	t.evict()
+}
+
+func (t *dynamicTable) setMaxSize(n uint32) {
+	t.maxSize = n
+	t.evict()
+}
+
+func (t *dynamicTable) evict() {
+	drop := 0
+	for t.size > t.maxSize && drop < len(t.entries) {
+		t.size -= t.entries[drop].size()
+		drop++
+	}
+	if drop > 0 {
+		t.entries = append(t.entries[:0], t.entries[drop:]...)
+	}
+}
+
+func (t *dynamicTable) at(index uint64) (HeaderField, bool) {
+	if index == 0 {
+		return HeaderField{}, false
+	}
+	if index <= uint64(len(staticTable)) {
+		return staticTable[index-1], true
+	}
+	i := index - uint64(len(staticTable))
+	if i > uint64(len(t.entries)) {
+		return HeaderField{}, false
+	}
+	return t.entries[uint64(len(t.entries))-i], true
+}
+
+// search returns the index of an exact match if there is one, otherwise of
+// an entry with the same name, otherwise 0.
+func (t *dynamicTable) search(f HeaderField) (index uint64, exact bool) {
+	for i, e := range staticTable {
+		if e.Name != f.Name {
+			continue
+		}
+		if e.Value == f.Value {
+			return uint64(i + 1), true
+		}
+		if index == 0 {
+			index = uint64(i + 1)
+		}
+	}
+	for i := len(t.entries) - 1; i >= 0; i-- {
+		e := t.entries[i]
+		if e.Name != f.Name {
+			continue
+		}
+		idx := uint64(len(staticTable) + len(t.entries) - i)
+		if e.Value == f.Value {
+			return idx, true
+		}
+		if index == 0 {
+			index = idx
+		}
+	}
+	return index, false
+}
+
+func appendInt(dst []byte, prefixBits uint8, first byte, v uint64) []byte {
+	max := uint64(1)<<prefixBits - 1
+	if v < max {
+		return append(dst, first|byte(v))
+	}
+	dst = append(dst, first|byte(max))
+	v -= max
+	for v >= 128 {
+		dst = append(dst, byte(v%128)|0x80)
+		v /= 128
+	}
+	return append(dst, byte(v))
+}
+
+func readInt(p []byte, prefixBits uint8) (uint64, []byte, error) {
+	if len(p) == 0 {
+		return 0, nil, ErrTruncated
+	}
+	max := uint64(1)<<prefixBits - 1
+	v := uint64(p[0]) & max
+	p = p[1:]
+	if v < max {
+		return v, p, nil
+	}
+	var shift uint
+	for len(p) > 0 {
+		b := p[0]
+		p = p[1:]
+		v += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return v, p, nil
+		}
+		shift += 7
+		if shift >= 63 {
+			return 0, nil, ErrIntegerOverflow
+		}
+	}
+	return 0, nil, ErrTruncated
+}
+
+func appendString(dst []byte, s string) []byte {
+	if n := huffmanEncodedLen(s); n < len(s) {
+		dst = appendInt(dst, 7, 0x80, uint64(n))
+		return huffmanEncode(dst, s)
+	}
+	dst = appendInt(dst, 7, 0, uint64(len(s)))
+	return append(dst, s...)
+}
+
+func readString(p []byte) (string, []byte, error) {
+	if len(p) == 0 {
+		return "", nil, ErrTruncated
+	}
+	huffman := p[0]&0x80 != 0
+	n, p, err := readInt(p, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint64(len(p)) < n {
+		return "", nil, ErrTruncated
+	}
+	raw := p[:n]
+	p = p[n:]
+	if !huffman {
+		return string(raw), p, nil
+	}
+	s, err := huffmanDecode(make([]byte, 0, len(raw)*8/5), raw)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(s), p, nil
+}
+
+type Decoder struct {
+	table dynamicTable
+	// allowedMaxSize is the SETTINGS_HEADER_TABLE_SIZE we advertised, the
+	// ceiling for size updates sent by the peer.
+	allowedMaxSize uint32
+	// MaxHeaderListSize caps the decoded size of one header block, counted
+	// like SETTINGS_MAX_HEADER_LIST_SIZE. Zero means no limit.
+	MaxHeaderListSize uint32
+}
+
+func NewDecoder(maxTableSize uint32) *Decoder {
+	return &Decoder{
+		table:          dynamicTable{maxSize: maxTableSize},
+		allowedMaxSize: maxTableSize,
+	}
+}
+
+// Decode decodes one complete header block. The dynamic table is updated
+// even when an error is returned for an oversized list, so a caller that
+// refuses the stream can keep using the connection.
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+	var listSize uint32
+	tooLarge := false
+	p := block
+	for len(p) > 0 {
+		b := p[0]
+		var f HeaderField
+		var err error
+		switch {
+		case b&0x80 != 0:
+			var idx uint64
+			idx, p, err = readInt(p, 7)
+			if err != nil {
+				return nil, err
+			}
+			var ok bool
+			if f, ok = d.table.at(idx); !ok {
+				return nil, fmt.Errorf("hpack: invalid index %d", idx)
+			}
+		case b&0xc0 == 0x40:
+			f, p, err = d.readLiteral(p, 6)
+			if err != nil {
+				return nil, err
+			}
+			d.table.add(HeaderField{Name: f.Name, Value: f.Value})
+		case b&0xe0 == 0x20:
+			if len(fields) > 0 {
+				return nil, ErrMisplacedSizeUpdate
+			}
+			var size uint64
+			size, p, err = readInt(p, 5)
+			if err != nil {
+				return nil, err
+			}
+			if size > uint64(d.allowedMaxSize) {
+				return nil, fmt.Errorf("hpack: table size update %d over limit %d", size, d.allowedMaxSize)
+			}
+			d.table.setMaxSize(uint32(size))
+			continue
+		default:
+			f, p, err = d.readLiteral(p, 4)
+			if err != nil {
+				return nil, err
+			}
+			f.Sensitive = b&0xf0 == 0x10
+		}
+
+		listSize += f.size()
+		if d.MaxHeaderListSize > 0 && listSize > d.MaxHeaderListSize {
+			tooLarge = true
+			fields = nil
+		}
+		if !tooLarge {
+			fields = append(fields, f)
+		}
+	}
+	if tooLarge {
+		return nil, ErrHeaderListTooLarge
+	}
+	return fields, nil
+}
+
+func (d *Decoder) readLiteral(p []byte, prefixBits uint8) (HeaderField, []byte, error) {
+	var f HeaderField
+	idx, p, err := readInt(p, prefixBits)
+	if err != nil {
+		return f, nil, err
+	}
+	if idx > 0 {
+		named, ok := d.table.at(idx)
+		if !ok {
+			return f, nil, fmt.Errorf("hpack: invalid index %d", idx)
+		}
+		f.Name = named.Name
+	} else {
+		f.Name, p, err = readString(p)
+		if err != nil {
+			return f, nil, err
+		}
+	}
+	f.Value, p, err = readString(p)
+	if err != nil {
+		return f, nil, err
+	}
+	return f, p, nil
+}
+
+type Encoder struct {
+	table dynamicTable
+	// minSize tracks the smallest limit set since the last block, since the
+	// peer has to see every shrink before the final size.
+	minSize       uint32
+	pendingUpdate bool
+}
+
+func NewEncoder() *Encoder {
+	return &Encoder{
+		table: dynamicTable{maxSize: DefaultTableSize},
+	}
+}
+
+// SetMaxTableSize applies the peer's SETTINGS_HEADER_TABLE_SIZE. Encoders
+// may use less, so this never grows the table past DefaultTableSize.
+func (e *Encoder) SetMaxTableSize(n uint32) {
+	n = min(n, DefaultTableSize)
+	if !e.pendingUpdate || n < e.minSize {
+		e.minSize = n
+	}
+	e.pendingUpdate = true
+	e.table.setMaxSize(n)
+}
+
+// Encode appends the header block for fields to dst.
+func (e *Encoder) Encode(dst []byte, fields []HeaderField) []byte {
+	if e.pendingUpdate {
+		if e.minSize < e.table.maxSize {
+			dst = appendInt(dst, 5, 0x20, uint64(e.minSize))
+		}
+		dst = appendInt(dst, 5, 0x20, uint64(e.table.maxSize))
+		e.pendingUpdate = false
+	}
+	for _, f := range fields {
+		idx, exact := e.table.search(f)
+		switch {
+		case exact && !f.Sensitive:
+			dst = appendInt(dst, 7, 0x80, idx)
+			continue
+		case f.Sensitive:
+			dst = appendInt(dst, 4, 0x10, idx)
+		case f.size() <= e.table.maxSize:
+			dst = appendInt(dst, 6, 0x40, idx)
+			e.table.add(HeaderField{Name: f.Name, Value: f.Value})
+		default:
+			dst = appendInt(dst, 4, 0, idx)
+		}
+		if idx == 0 {
+			dst = appendString(dst, f.Name)
+		}
+		dst = appendString(dst, f.Value)
+	}
+	return dst
+}
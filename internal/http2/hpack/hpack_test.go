@@ -0,0 +1,138 @@
+package hpack
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return b
+}
+
+func fields(pairs ...string) []HeaderField {
+	var out []HeaderField
+	for i := 0; i < len(pairs); i += 2 {
+		out = append(out, HeaderField{Name: pairs[i], Value: pairs[i+1]})
+	}
+	return out
+}
+
+func TestDecoder(t *testing.T) {
+	// Test: RFC 7541 C.3, requests without Huffman coding
+	d := NewDecoder(DefaultTableSize)
+	got, err := d.Decode(unhex(t, "8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d"))
+	require.NoError(t, err)
+	assert.Equal(t, fields(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "www.example.com"), got)
+	got, err = d.Decode(unhex(t, "8286 84be 5808 6e6f 2d63 6163 6865"))
+	require.NoError(t, err)
+	assert.Equal(t, fields(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "www.example.com", "cache-control", "no-cache"), got)
+	got, err = d.Decode(unhex(t, "8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65"))
+	require.NoError(t, err)
+	assert.Equal(t, fields(":method", "GET", ":scheme", "https", ":path", "/index.html", ":authority", "www.example.com", "custom-key", "custom-value"), got)
+	assert.Equal(t, uint32(164), d.table.size)
+
+	// Test: RFC 7541 C.4, requests with Huffman coding
+	d = NewDecoder(DefaultTableSize)
+	got, err = d.Decode(unhex(t, "8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff"))
+	require.NoError(t, err)
+	assert.Equal(t, fields(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "www.example.com"), got)
+	got, err = d.Decode(unhex(t, "8286 84be 5886 a8eb 1064 9cbf"))
+	require.NoError(t, err)
+	assert.Equal(t, "no-cache", got[4].Value)
+	got, err = d.Decode(unhex(t, "8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf"))
+	require.NoError(t, err)
+	assert.Equal(t, HeaderField{Name: "custom-key", Value: "custom-value"}, got[4])
+
+	// Test: RFC 7541 C.6, responses with Huffman coding and evictions
+	d = NewDecoder(256)
+	_, err = d.Decode(unhex(t, "4882 6402 5885 aec3 771a 4b61 96d0 7abe 9410 54d4 44a8 2005 9504 0b81 66e0 82a6 2d1b ff6e 919d 29ad 1718 63c7 8f0b 97c8 e9ae 82ae 43d3"))
+	require.NoError(t, err)
+	_, err = d.Decode(unhex(t, "4883 640e ffc1 c0bf"))
+	require.NoError(t, err)
+	got, err = d.Decode(unhex(t, "88c1 6196 d07a be94 1054 d444 a820 0595 040b 8166 e084 a62d 1bff c05a 839b d9ab 77ad 94e7 821d d7f2 e6c7 b335 dfdf cd5b 3960 d5af 2708 7f36 72c1 ab27 0fb5 291f 9587 3160 65c0 03ed 4ee5 b106 3d50 07"))
+	require.NoError(t, err)
+	assert.Equal(t, fields(
+		":status", "200",
+		"cache-control", "private",
+		"date", "Mon, 21 Oct 2013 20:13:22 GMT",
+		"location", "https://www.example.com",
+		"content-encoding", "gzip",
+		"set-cookie", "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1",
+	), got)
+	assert.Equal(t, uint32(215), d.table.size)
+
+	// Test: Index zero and out of range indexes are errors
+	_, err = NewDecoder(DefaultTableSize).Decode([]byte{0x80})
+	require.Error(t, err)
+	_, err = NewDecoder(DefaultTableSize).Decode([]byte{0xbf})
+	require.Error(t, err)
+
+	// Test: Size update above the advertised limit
+	_, err = NewDecoder(256).Decode(unhex(t, "3fe1 1f"))
+	require.Error(t, err)
+
+	// Test: Header list limit
+	d = NewDecoder(DefaultTableSize)
+	d.MaxHeaderListSize = 64
+	_, err = d.Decode(unhex(t, "8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d"))
+	require.ErrorIs(t, err, ErrHeaderListTooLarge)
+	assert.Equal(t, 1, len(d.table.entries))
+}
+
+func TestHuffman(t *testing.T) {
+	// Test: RFC 7541 C.4.1 string
+	assert.Equal(t, unhex(t, "f1e3 c2e5 f23a 6ba0 ab90 f4ff"), huffmanEncode(nil, "www.example.com"))
+	s, err := huffmanDecode(nil, unhex(t, "f1e3 c2e5 f23a 6ba0 ab90 f4ff"))
+	require.NoError(t, err)
+	assert.Equal(t, "www.example.com", string(s))
+
+	// Test: Every byte value round trips
+	var all []byte
+	for i := 0; i < 256; i++ {
+		all = append(all, byte(i))
+	}
+	s, err = huffmanDecode(nil, huffmanEncode(nil, string(all)))
+	require.NoError(t, err)
+	assert.Equal(t, all, s)
+
+	// Test: Padding longer than 7 bits or not all ones
+	_, err = huffmanDecode(nil, []byte{0xff, 0xff})
+	require.Error(t, err)
+	_, err = huffmanDecode(nil, []byte{0x1e})
+	require.Error(t, err)
+}
+
+func TestEncoder(t *testing.T) {
+	// Test: Round trip keeps both dynamic tables in step
+	e := NewEncoder()
+	d := NewDecoder(DefaultTableSize)
+	blocks := [][]HeaderField{
+		fields(":status", "200", "content-type", "text/html", "x-custom", "one"),
+		fields(":status", "404", "content-type", "text/html", "x-custom", "one"),
+		{{Name: "set-cookie", Value: "secret", Sensitive: true}},
+	}
+	var sizes []int
+	for _, block := range blocks {
+		wire := e.Encode(nil, block)
+		sizes = append(sizes, len(wire))
+		got, err := d.Decode(wire)
+		require.NoError(t, err)
+		assert.Equal(t, block, got)
+	}
+	assert.Less(t, sizes[1], sizes[0])
+
+	// Test: A smaller peer table size is announced before the next block
+	e.SetMaxTableSize(0)
+	wire := e.Encode(nil, fields("x-custom", "one"))
+	assert.Equal(t, byte(0x20), wire[0])
+	got, err := d.Decode(wire)
+	require.NoError(t, err)
+	assert.Equal(t, fields("x-custom", "one"), got)
+	assert.Equal(t, 0, len(d.table.entries))
+}
@@ -0,0 +1,96 @@
+package hpack
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrInvalidHuffman = errors.New("hpack: invalid huffman-encoded data")
+
+type huffmanNode struct {
+	children [2]*huffmanNode
+	sym      byte
+	leaf     bool
+}
+
+var (
+	huffmanRootOnce sync.Once
+	huffmanRoot     *huffmanNode
+)
+
+// buildHuffmanTree turns the code table into a binary tree. EOS is left out
+// on purpose: it must never appear inside a string, so reaching it is an
+// error like any other missing branch.
+func buildHuffmanTree() {
+	huffmanRoot = &huffmanNode{}
+	for sym, code := range huffmanCodes {
+		n := huffmanRoot
+		for i := int(huffmanCodeLen[sym]) - 1; i >= 0; i-- {
+			bit := (code >> uint(i)) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = &huffmanNode{}
+			}
+			n = n.children[bit]
+		}
+		n.sym = byte(sym)
+		n.leaf = true
+	}
+}
+
+func huffmanDecode(dst []byte, src []byte) ([]byte, error) {
+	huffmanRootOnce.Do(buildHuffmanTree)
+	n := huffmanRoot
+	// pending counts the bits read since the last symbol and allOnes whether
+	// they could still be padding, which is at most 7 bits of EOS prefix.
+	pending := 0
+	allOnes := true
+	for _, b := range src {
+		for i := 7; i >= 0; i-- {
+			bit := (b >> uint(i)) & 1
+			n = n.children[bit]
+			if n == nil {
+				return nil, ErrInvalidHuffman
+			}
+			pending++
+			allOnes = allOnes && bit == 1
+			if n.leaf {
+				dst = append(dst, n.sym)
+				n = huffmanRoot
+				pending = 0
+				allOnes = true
+			}
+		}
+	}
+	if pending > 7 || !allOnes {
+		return nil, ErrInvalidHuffman
+	}
+	return dst, nil
+}
+
+func huffmanEncodedLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanCodeLen[s[i]])
+	}
+	return (bits + 7) / 8
+}
+
+func huffmanEncode(dst []byte, s string) []byte {
+	var acc uint64
+	var n uint
+	for i := 0; i < len(s); i++ {
+		l := uint(huffmanCodeLen[s[i]])
+		acc = acc<<l | uint64(huffmanCodes[s[i]])
+		n += l
+		for n >= 8 {
+			n -= 8
+			dst = append(dst, byte(acc>>n))
+		}
+	}
+	if n > 0 {
+		// Pad the last byte with the most significant bits of EOS (all ones).
+		acc = acc<<(8-n) | (1<<(8-n) - 1)
+		dst = append(dst, byte(acc))
+	}
+	return dst
+}
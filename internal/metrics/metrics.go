@@ -0,0 +1,177 @@
+package metrics
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+
+	server "github.com/Barrioslopezfd/httpfromtcp/cmd/server"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/response"
+)
+
+// ContentType is that of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	// DefaultLatencyBuckets are in seconds, from 5ms to 10s.
+	DefaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	// DefaultSizeBuckets are in bytes, from 100B to 100MB.
+	DefaultSizeBuckets = []float64{100, 1000, 10000, 100000, 1e6, 1e7, 1e8}
+)
+
+type Config struct {
+	// Path is where the metrics are served. Empty means /metrics.
+	Path string
+	// Route names the route a request went to, for the route label. Nil
+	// puts every request under "*", since labelling by raw path would let
+	// clients create series at will.
+	Route func(r *request.Request) string
+	// LatencyBuckets and SizeBuckets are the histogram upper bounds, in
+	// ascending order. Nil means DefaultLatencyBuckets and
+	// DefaultSizeBuckets.
+	LatencyBuckets []float64
+	SizeBuckets    []float64
+}
+
+// Metrics collects request metrics through Wrap and connection, traffic,
+// parse error and panic metrics as the server's Observer:
+//
+//	m := metrics.New(metrics.Config{})
+//	srv, err := server.Serve(m.Wrap(handler), port, server.WithObserver(m))
+type Metrics struct {
+	cfg  Config
+	vecs []*vec
+
+	requests     *vec
+	latency      *vec
+	size         *vec
+	connsActive  *vec
+	connsTotal   *vec
+	bytesRead    *vec
+	bytesWritten *vec
+	parseErrors  *vec
+	panics       *vec
+}
+
+func New(cfg Config) *Metrics {
+	if cfg.Path == "" {
+		cfg.Path = "/metrics"
+	}
+	if cfg.Route == nil {
+		cfg.Route = func(*request.Request) string { return "*" }
+	}
+	if cfg.LatencyBuckets == nil {
+		cfg.LatencyBuckets = DefaultLatencyBuckets
+	}
+	if cfg.SizeBuckets == nil {
+		cfg.SizeBuckets = DefaultSizeBuckets
+	}
+	m := &Metrics{cfg: cfg}
+	m.requests = m.register(newVec("http_requests_total", "Requests served, by status class.", kindCounter, nil, "method", "route", "code"))
+	m.latency = m.register(newVec("http_request_duration_seconds", "Time from the request's headers being read to the handler returning.", kindHistogram, cfg.LatencyBuckets, "method", "route"))
+	m.size = m.register(newVec("http_response_size_bytes", "Response body sizes.", kindHistogram, cfg.SizeBuckets, "method", "route"))
+	m.connsActive = m.register(newVec("http_connections_active", "Connections currently open.", kindGauge, nil))
+	m.connsTotal = m.register(newVec("http_connections_total", "Connections accepted.", kindCounter, nil))
+	m.bytesRead = m.register(newVec("http_received_bytes_total", "Bytes read from clients, TLS included.", kindCounter, nil))
+	m.bytesWritten = m.register(newVec("http_sent_bytes_total", "Bytes written to clients, TLS included.", kindCounter, nil))
+	m.parseErrors = m.register(newVec("http_parse_errors_total", "Requests rejected before reaching the handler.", kindCounter, nil, "reason"))
+	m.panics = m.register(newVec("http_handler_panics_total", "Handlers that panicked.", kindCounter, nil))
+	return m
+}
+
+var _ server.Observer = (*Metrics)(nil)
+
+func (m *Metrics) register(v *vec) *vec {
+	m.vecs = append(m.vecs, v)
+	return v
+}
+
+// Wrap serves the metrics at Config.Path and records every other request
+// next serves. Requests to the metrics path are not recorded themselves.
+func (m *Metrics) Wrap(next server.Handler) server.Handler {
+	return func(w *response.Writer, r *request.Request) {
+		method := request.StandardMethod(r.RequestLine.Method)
+		if (method == "GET" || method == "HEAD") && requestPath(r) == m.cfg.Path {
+			m.Handler(w, r)
+			return
+		}
+		start := time.Now()
+		returned := false
+		defer func() {
+			code := w.Status()
+			// The server answers a handler that panicked before writing
+			// anything with a 500.
+			if !returned && code == 0 {
+				code = response.INTERNAL_SERVER_ERROR
+			}
+			route := m.cfg.Route(r)
+			m.requests.add(1, method, route, statusClass(code))
+			m.latency.observe(time.Since(start).Seconds(), method, route)
+			m.size.observe(float64(w.BytesWritten()), method, route)
+		}()
+		next(w, r)
+		returned = true
+	}
+}
+
+// Handler writes the metrics in the text exposition format.
+func (m *Metrics) Handler(w *response.Writer, r *request.Request) {
+	var buf bytes.Buffer
+	for _, v := range m.vecs {
+		v.write(&buf)
+	}
+	h := response.GetDefaultHeaders()
+	h.Replace("Content-Type", ContentType)
+	h.Replace("Content-Length", strconv.Itoa(buf.Len()))
+	h.Replace("Cache-Control", "no-store")
+	if err := w.WriteStatusLine(response.OK); err != nil {
+		return
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return
+	}
+	if r.RequestLine.Method != "HEAD" {
+		w.WriteBody(buf.Bytes())
+	}
+}
+
+func (m *Metrics) ConnOpened() {
+	m.connsActive.add(1)
+	m.connsTotal.add(1)
+}
+
+func (m *Metrics) ConnClosed() {
+	m.connsActive.add(-1)
+}
+
+func (m *Metrics) BytesRead(n int) {
+	m.bytesRead.add(float64(n))
+}
+
+func (m *Metrics) BytesWritten(n int) {
+	m.bytesWritten.add(float64(n))
+}
+
+func (m *Metrics) ParseError(reason string) {
+	m.parseErrors.add(1, reason)
+}
+
+func (m *Metrics) HandlerPanic() {
+	m.panics.add(1)
+}
+
+func requestPath(r *request.Request) string {
+	path, _, _ := strings.Cut(r.RequestLine.RequestTarget, "?")
+	return path
+}
+
+// statusClass gives 2xx for 200 and so on. A handler that wrote nothing at
+// all is counted under its own class, since the client got no response.
+func statusClass(code response.Code) string {
+	if code < 100 || code > 599 {
+		return "none"
+	}
+	return strconv.Itoa(int(code)/100) + "xx"
+}
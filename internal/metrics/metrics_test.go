@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	server "github.com/Barrioslopezfd/httpfromtcp/cmd/server"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func send(t *testing.T, addr string, raw string) (*http.Response, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte(raw))
+	require.NoError(t, err)
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	return res, string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	handler := func(w *response.Writer, r *request.Request) {
+		code := response.OK
+		body := "hello world"
+		switch r.RequestLine.RequestTarget {
+		case "/panic":
+			panic("boom")
+		case "/missing":
+			code, body = response.NOT_FOUND, ""
+		}
+		h := response.GetDefaultHeaders()
+		h.Replace("Content-Length", fmt.Sprint(len(body)))
+		w.WriteStatusLine(code)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	}
+	m := New(Config{
+		Path: "/_metrics",
+		Route: func(r *request.Request) string {
+			return r.RequestLine.RequestTarget
+		},
+	})
+	srv, err := server.Serve(m.Wrap(handler), 0, server.WithObserver(m))
+	require.NoError(t, err)
+	defer srv.Close()
+	addr := srv.Addr().String()
+
+	send(t, addr, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	send(t, addr, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	send(t, addr, "POST /missing HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	send(t, addr, "GET /panic HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	send(t, addr, "BREW / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	send(t, addr, "GET /\r\n\r\n")
+
+	// Test: The metrics path serves the exposition format
+	var body string
+	require.Eventually(t, func() bool {
+		res, b := send(t, addr, "GET /_metrics HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, ContentType, res.Header.Get("Content-Type"))
+		body = b
+		return strings.Contains(body, `http_requests_total{method="GET",route="/panic",code="5xx"} 1`)
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// Test: Requests are counted by method, route and status class
+	assert.Contains(t, body, "# TYPE http_requests_total counter\n")
+	assert.Contains(t, body, `http_requests_total{method="GET",route="/",code="2xx"} 2`)
+	assert.Contains(t, body, `http_requests_total{method="POST",route="/missing",code="4xx"} 1`)
+	assert.NotContains(t, body, `route="/_metrics"`)
+
+	// Test: Non-standard methods share one label
+	assert.Contains(t, body, `http_requests_total{method="OTHER",route="/",code="2xx"} 1`)
+	assert.NotContains(t, body, "BREW")
+
+	// Test: Latency and response sizes are histograms
+	assert.Contains(t, body, "# TYPE http_request_duration_seconds histogram\n")
+	assert.Contains(t, body, `http_request_duration_seconds_bucket{method="GET",route="/",le="+Inf"} 2`)
+	assert.Contains(t, body, `http_request_duration_seconds_count{method="GET",route="/"} 2`)
+	assert.Contains(t, body, `http_response_size_bytes_bucket{method="GET",route="/",le="100"} 2`)
+	assert.Contains(t, body, `http_response_size_bytes_sum{method="GET",route="/"} 22`)
+
+	// Test: Connections, traffic, parse errors and panics come from the server
+	assert.Contains(t, body, "http_connections_total 7\n")
+	assert.Contains(t, body, "http_connections_active 1\n")
+	assert.Contains(t, body, `http_parse_errors_total{reason="malformed"} 1`)
+	assert.Contains(t, body, "http_handler_panics_total 1\n")
+	assert.NotContains(t, body, "http_received_bytes_total 0\n")
+	assert.NotContains(t, body, "http_sent_bytes_total 0\n")
+}
+
+func TestVecWrite(t *testing.T) {
+	v := newVec("latency", "Help with a \\ and\na newline.", kindHistogram, []float64{0.5, 1}, "path")
+	v.observe(0.25, `/a"b`)
+	v.observe(1, `/a"b`)
+	v.observe(3, `/a"b`)
+
+	// Test: Buckets are cumulative and labels and help are escaped
+	var b strings.Builder
+	v.write(&b)
+	assert.Equal(t, `# HELP latency Help with a \\ and\na newline.
+# TYPE latency histogram
+latency_bucket{path="/a\"b",le="0.5"} 1
+latency_bucket{path="/a\"b",le="1"} 2
+latency_bucket{path="/a\"b",le="+Inf"} 3
+latency_sum{path="/a\"b"} 4.25
+latency_count{path="/a\"b"} 3
+`, b.String())
+
+	// Test: Unlabelled metrics read 0 before anything happens
+	b.Reset()
+	newVec("things_total", "Things.", kindCounter, nil).write(&b)
+	assert.Equal(t, "# HELP things_total Things.\n# TYPE things_total counter\nthings_total 0\n", b.String())
+}
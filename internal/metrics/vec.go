@@ -0,0 +1,168 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	kindCounter   = "counter"
+	kindGauge     = "gauge"
+	kindHistogram = "histogram"
+)
+
+// vec is one metric and its series, one per combination of label values.
+// Unlabelled metrics have a single series, present from the start so they
+// read 0 rather than being missing before anything happens.
+type vec struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	values []string
+	value  float64
+	// counts holds observations per bucket, not cumulative; the last one
+	// is +Inf.
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newVec(name, help, kind string, buckets []float64, labels ...string) *vec {
+	v := &vec{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]*series{},
+	}
+	if len(labels) == 0 {
+		v.with()
+	}
+	return v
+}
+
+// with returns the series for values, creating it. v.mu must be held.
+func (v *vec) with(values ...string) *series {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{values: values}
+		if v.kind == kindHistogram {
+			s.counts = make([]uint64, len(v.buckets)+1)
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+func (v *vec) add(delta float64, values ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.with(values...).value += delta
+}
+
+func (v *vec) observe(x float64, values ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s := v.with(values...)
+	s.counts[sort.SearchFloat64s(v.buckets, x)]++
+	s.count++
+	s.sum += x
+}
+
+// write renders v in the Prometheus text exposition format, series sorted
+// by label values so the output is stable.
+func (v *vec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP %s %s\n", v.name, escapeHelp(v.help))
+	fmt.Fprintf(&b, "# TYPE %s %s\n", v.name, v.kind)
+	for _, key := range keys {
+		s := v.series[key]
+		if v.kind != kindHistogram {
+			fmt.Fprintf(&b, "%s%s %s\n", v.name, v.labelSet(s.values, ""), formatFloat(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range v.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", v.name, v.labelSet(s.values, formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(&b, "%s_bucket%s %d\n", v.name, v.labelSet(s.values, "+Inf"), s.count)
+		fmt.Fprintf(&b, "%s_sum%s %s\n", v.name, v.labelSet(s.values, ""), formatFloat(s.sum))
+		fmt.Fprintf(&b, "%s_count%s %d\n", v.name, v.labelSet(s.values, ""), s.count)
+	}
+	io.WriteString(w, b.String())
+}
+
+// labelSet renders {name="value",...}, with le last for histogram buckets.
+func (v *vec) labelSet(values []string, le string) string {
+	if len(values) == 0 && le == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range v.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", name, escapeLabel(values[i]))
+	}
+	if le != "" {
+		if len(values) > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "le=\"%s\"", le)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
@@ -0,0 +1,299 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	server "github.com/Barrioslopezfd/httpfromtcp/cmd/server"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/response"
+)
+
+const (
+	defaultDialTimeout = 10 * time.Second
+	defaultRealm       = "proxy"
+)
+
+var errDenied = errors.New("proxy: destination denied")
+
+type ForwardConfig struct {
+	// Allow and Deny list destinations as host names, "*.example.com" for
+	// any subdomain, IP addresses or CIDR blocks. Any entry may end in
+	// ":port" to cover that port alone. Deny wins over Allow, and an empty
+	// Allow lets through everything not denied. Addresses are checked after
+	// name resolution, so a name cannot smuggle a denied address past.
+	Allow []string
+	Deny  []string
+	// Authenticate checks the Basic credentials in Proxy-Authorization.
+	// Nil lets every client through.
+	Authenticate func(user string, password string) bool
+	// Realm is sent in Proxy-Authenticate. Empty means "proxy".
+	Realm string
+	// DialTimeout bounds connecting to a destination. Zero means 10s.
+	DialTimeout time.Duration
+	// Timeout, Via and MaxBodySize are as in Config, for forwarded
+	// requests.
+	Timeout     time.Duration
+	Via         string
+	MaxBodySize int64
+}
+
+type forwardProxy struct {
+	cfg   ForwardConfig
+	allow []rule
+	deny  []rule
+	rp    *reverseProxy
+}
+
+// NewForward serves as a forward proxy: requests with an absolute-form
+// target are sent on to it, and CONNECT opens a TCP tunnel to host:port
+// that carries bytes both ways until either side closes.
+func NewForward(cfg ForwardConfig) (server.Handler, error) {
+	if cfg.Realm == "" {
+		cfg.Realm = defaultRealm
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = defaultDialTimeout
+	}
+	fp := &forwardProxy{cfg: cfg}
+	var err error
+	if fp.allow, err = parseRules(cfg.Allow); err != nil {
+		return nil, err
+	}
+	if fp.deny, err = parseRules(cfg.Deny); err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Going through another proxy would bypass the rules.
+	transport.Proxy = nil
+	transport.DialContext = fp.dial
+	fp.rp = &reverseProxy{cfg: withDefaults(Config{
+		Transport:   transport,
+		Timeout:     cfg.Timeout,
+		Via:         cfg.Via,
+		MaxBodySize: cfg.MaxBodySize,
+	})}
+	return fp.serve, nil
+}
+
+func (fp *forwardProxy) serve(w *response.Writer, r *request.Request) {
+	if !fp.authorized(r) {
+		h := response.GetDefaultHeaders()
+		h.Replace("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", fp.cfg.Realm))
+		if err := w.WriteStatusLine(response.PROXY_AUTH_REQUIRED); err == nil {
+			w.WriteHeaders(h)
+		}
+		return
+	}
+	if r.RequestLine.Method == "CONNECT" {
+		fp.tunnel(w, r)
+		return
+	}
+
+	u, err := url.Parse(r.RequestLine.RequestTarget)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		writeStatus(w, response.BAD_REQUEST)
+		return
+	}
+	body, length, ok := fp.rp.bodyReader(w, r)
+	if !ok {
+		return
+	}
+	fp.rp.forward(w, r, body, length, &url.URL{Scheme: u.Scheme, Host: u.Host}, nil)
+}
+
+func (fp *forwardProxy) authorized(r *request.Request) bool {
+	if fp.cfg.Authenticate == nil {
+		return true
+	}
+	v, ok := r.Headers.Get("proxy-authorization")
+	if !ok {
+		return false
+	}
+	scheme, credentials, _ := strings.Cut(strings.TrimSpace(v), " ")
+	if !strings.EqualFold(scheme, "basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return false
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	return ok && fp.cfg.Authenticate(user, password)
+}
+
+func (fp *forwardProxy) tunnel(w *response.Writer, r *request.Request) {
+	upstream, err := fp.dial(r.Context(), "tcp", r.RequestLine.RequestTarget)
+	if err != nil {
+		writeStatus(w, upstreamErrorCode(err))
+		return
+	}
+	defer upstream.Close()
+	conn, rest, err := w.Hijack()
+	if err != nil {
+		writeStatus(w, response.NOT_IMPLEMENTED)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+	// A client may send its first bytes, such as a TLS hello, without
+	// waiting for the 200.
+	if len(rest) > 0 {
+		if _, err := upstream.Write(rest); err != nil {
+			return
+		}
+	}
+	done := make(chan struct{}, 2)
+	go pipe(upstream, conn, done)
+	go pipe(conn, upstream, done)
+	<-done
+	<-done
+}
+
+// pipe copies src to dst and then half-closes dst, so the far end sees EOF
+// while the other direction keeps going.
+func pipe(dst net.Conn, src net.Conn, done chan<- struct{}) {
+	io.Copy(dst, src)
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+	done <- struct{}{}
+}
+
+// dial connects to addr if the rules allow it. Names are checked here and
+// the addresses they resolve to just before each connect.
+func (fp *forwardProxy) dial(ctx context.Context, network string, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	byName, err := fp.checkName(host, port)
+	if err != nil {
+		return nil, err
+	}
+	d := net.Dialer{
+		Timeout: fp.cfg.DialTimeout,
+		ControlContext: func(ctx context.Context, network string, address string, c syscall.RawConn) error {
+			ip, port, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			return fp.checkIP(net.ParseIP(ip), port, byName)
+		},
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+// checkName applies the name rules to host. It reports whether host is
+// allowed by name, leaving addresses to decide otherwise.
+func (fp *forwardProxy) checkName(host string, port string) (bool, error) {
+	for _, ru := range fp.deny {
+		if ru.matchName(host, port) {
+			return false, errDenied
+		}
+	}
+	if len(fp.allow) == 0 {
+		return true, nil
+	}
+	for _, ru := range fp.allow {
+		if ru.matchName(host, port) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (fp *forwardProxy) checkIP(ip net.IP, port string, byName bool) error {
+	if ip == nil {
+		return errDenied
+	}
+	for _, ru := range fp.deny {
+		if ru.matchIP(ip, port) {
+			return errDenied
+		}
+	}
+	if byName {
+		return nil
+	}
+	for _, ru := range fp.allow {
+		if ru.matchIP(ip, port) {
+			return nil
+		}
+	}
+	return errDenied
+}
+
+// rule is one Allow or Deny entry. Either name or network is set.
+type rule struct {
+	name     string
+	wildcard bool
+	network  *net.IPNet
+	port     string
+}
+
+func parseRules(entries []string) ([]rule, error) {
+	rules := make([]rule, 0, len(entries))
+	for _, entry := range entries {
+		var ru rule
+		host := strings.ToLower(strings.TrimSpace(entry))
+		// IPv6 blocks have colons of their own, so only a bracketed or
+		// single colon marks a port.
+		if h, p, err := net.SplitHostPort(host); err == nil {
+			host, ru.port = h, p
+		}
+		switch {
+		case strings.Contains(host, "/"):
+			_, network, err := net.ParseCIDR(host)
+			if err != nil {
+				return nil, fmt.Errorf("proxy: invalid rule %q: %w", entry, err)
+			}
+			ru.network = network
+		case net.ParseIP(host) != nil:
+			ip := net.ParseIP(host)
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			ru.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		case strings.HasPrefix(host, "*."):
+			ru.name, ru.wildcard = host[1:], true
+		case host != "":
+			ru.name = host
+		default:
+			return nil, fmt.Errorf("proxy: invalid rule %q", entry)
+		}
+		rules = append(rules, ru)
+	}
+	return rules, nil
+}
+
+func (ru rule) matchName(host string, port string) bool {
+	if ru.name == "" || (ru.port != "" && ru.port != port) {
+		return false
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if ru.wildcard {
+		return strings.HasSuffix(host, ru.name)
+	}
+	return host == ru.name
+}
+
+func (ru rule) matchIP(ip net.IP, port string) bool {
+	if ru.network == nil || (ru.port != "" && ru.port != port) {
+		return false
+	}
+	return ru.network.Contains(ip)
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	server "github.com/Barrioslopezfd/httpfromtcp/cmd/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func serveForward(t *testing.T, cfg ForwardConfig) *url.URL {
+	t.Helper()
+	handler, err := NewForward(cfg)
+	require.NoError(t, err)
+	srv, err := server.Serve(handler, 0)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	return &url.URL{Scheme: "http", Host: "127.0.0.1:" + portOf(srv.Addr().String())}
+}
+
+func portOf(addr string) string {
+	_, port, _ := net.SplitHostPort(addr)
+	return port
+}
+
+func proxyClient(proxyURL *url.URL) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+}
+
+func TestForwardProxy(t *testing.T) {
+	var via string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		via = r.Header.Get("Via")
+		w.Write([]byte("plain " + r.URL.RequestURI()))
+	}))
+	defer upstream.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	defer secure.Close()
+
+	proxyURL := serveForward(t, ForwardConfig{
+		Authenticate: func(user, password string) bool {
+			return user == "ci" && password == "s3cret"
+		},
+	})
+
+	// Test: Proxy authentication is required
+	res, err := proxyClient(proxyURL).Get(upstream.URL + "/a?b=c")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 407, res.StatusCode)
+	assert.Equal(t, `Basic realm="proxy"`, res.Header.Get("Proxy-Authenticate"))
+	wrong := *proxyURL
+	wrong.User = url.UserPassword("ci", "guess")
+	res, err = proxyClient(&wrong).Get(upstream.URL)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 407, res.StatusCode)
+
+	authed := *proxyURL
+	authed.User = url.UserPassword("ci", "s3cret")
+	client := proxyClient(&authed)
+
+	// Test: Absolute-form requests are forwarded
+	res, err = client.Get(upstream.URL + "/a?b=c")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "plain /a?b=c", string(body))
+	assert.Equal(t, "1.1 httpfromtcp", via)
+
+	// Test: CONNECT tunnels TLS through
+	res, err = client.Get(secure.URL)
+	require.NoError(t, err)
+	body, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "secure", string(body))
+}
+
+func TestForwardProxyRules(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer secure.Close()
+	port := portOf(upstream.Listener.Addr().String())
+	localhost := "http://localhost:" + port
+
+	get := func(proxyURL *url.URL, target string) int {
+		t.Helper()
+		res, err := proxyClient(proxyURL).Get(target)
+		if err != nil {
+			// A refused CONNECT surfaces as an error from the client.
+			return 0
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// Test: Denied block, also when reached through a name
+	p := serveForward(t, ForwardConfig{Deny: []string{"127.0.0.0/8"}})
+	assert.Equal(t, 403, get(p, upstream.URL))
+	assert.Equal(t, 403, get(p, localhost))
+	assert.Equal(t, 0, get(p, secure.URL))
+
+	// Test: Allow list by name, with and without a port
+	p = serveForward(t, ForwardConfig{Allow: []string{"localhost:" + port}})
+	assert.Equal(t, 200, get(p, localhost))
+	assert.Equal(t, 403, get(p, upstream.URL))
+	assert.Equal(t, 0, get(p, secure.URL))
+
+	// Test: Allow list by address, narrowed by Deny
+	p = serveForward(t, ForwardConfig{Allow: []string{"127.0.0.1"}, Deny: []string{"*.localhost", "127.0.0.1:" + portOf(secure.Listener.Addr().String())}})
+	assert.Equal(t, 200, get(p, upstream.URL))
+	assert.Equal(t, 200, get(p, localhost))
+	assert.Equal(t, 0, get(p, secure.URL))
+
+	// Test: Bad rules
+	_, err := NewForward(ForwardConfig{Deny: []string{"10.0.0.0/99"}})
+	assert.Error(t, err)
+}
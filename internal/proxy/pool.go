@@ -0,0 +1,351 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"hash/crc32"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+)
+
+const (
+	defaultMaxFails      = 3
+	defaultFailTimeout   = 10 * time.Second
+	defaultCheckInterval = 10 * time.Second
+	defaultCheckTimeout  = 2 * time.Second
+	ringReplicas         = 100
+)
+
+var ErrNoBackends = errors.New("proxy: pool needs at least one backend")
+
+// Strategy picks which backend of a pool gets a request.
+type Strategy int
+
+const (
+	// RoundRobin takes the available backends in turn.
+	RoundRobin Strategy = iota
+	// Weighted takes backends in proportion to their Weight, interleaved
+	// rather than in bursts.
+	Weighted
+	// LeastConn takes the backend with the fewest requests in flight
+	// relative to its Weight.
+	LeastConn
+	// ConsistentHash sends every request with the same key to the same
+	// backend for as long as it stays available. The key is the HashHeader
+	// value, or the client IP.
+	ConsistentHash
+)
+
+type Backend struct {
+	URL *url.URL
+	// Weight is the backend's share under Weighted and LeastConn and its
+	// share of the hash ring under ConsistentHash. Zero means 1.
+	Weight int
+}
+
+type HealthCheck struct {
+	// Path is requested on every backend each Interval; any status below
+	// 400 counts as healthy. Empty disables active checks.
+	Path string
+	// Interval between probes. Zero means 10s.
+	Interval time.Duration
+	// Timeout for one probe. Zero means 2s.
+	Timeout time.Duration
+}
+
+type PoolConfig struct {
+	Strategy Strategy
+	// HashHeader names the request header hashed under ConsistentHash.
+	// Empty, or a request without it, hashes the client IP.
+	HashHeader string
+	// HealthCheck configures active probing.
+	HealthCheck HealthCheck
+	// MaxFails consecutive failed requests eject a backend for FailTimeout.
+	// Zero means 3, negative disables passive checks.
+	MaxFails int
+	// FailTimeout is how long an ejected backend gets no requests. Zero
+	// means 10s.
+	FailTimeout time.Duration
+}
+
+type backend struct {
+	url    *url.URL
+	weight int
+
+	healthy      atomic.Bool
+	active       atomic.Int64
+	fails        atomic.Int64
+	ejectedUntil atomic.Int64
+	// current is the smooth weighted round robin counter, guarded by the
+	// pool's mutex.
+	current int
+}
+
+func (b *backend) available(now time.Time) bool {
+	return b.healthy.Load() && now.UnixNano() >= b.ejectedUntil.Load()
+}
+
+type ringEntry struct {
+	hash    uint32
+	backend *backend
+}
+
+// Pool is a set of interchangeable backends for NewBalancer.
+type Pool struct {
+	backends []*backend
+	cfg      PoolConfig
+	ring     []ringEntry
+	next     atomic.Uint64
+
+	mu sync.Mutex
+
+	client *http.Client
+	stop   chan struct{}
+	wg     sync.WaitGroup
+	closed sync.Once
+}
+
+// NewPool starts the health checks, if any, of a pool over backends. Close
+// stops them.
+func NewPool(backends []Backend, cfg PoolConfig) (*Pool, error) {
+	if len(backends) == 0 {
+		return nil, ErrNoBackends
+	}
+	if cfg.MaxFails == 0 {
+		cfg.MaxFails = defaultMaxFails
+	}
+	if cfg.FailTimeout <= 0 {
+		cfg.FailTimeout = defaultFailTimeout
+	}
+	if cfg.HealthCheck.Interval <= 0 {
+		cfg.HealthCheck.Interval = defaultCheckInterval
+	}
+	if cfg.HealthCheck.Timeout <= 0 {
+		cfg.HealthCheck.Timeout = defaultCheckTimeout
+	}
+
+	p := &Pool{
+		cfg:  cfg,
+		stop: make(chan struct{}),
+	}
+	for _, b := range backends {
+		if b.URL == nil {
+			return nil, errors.New("proxy: backend without a URL")
+		}
+		be := &backend{url: b.URL, weight: max(b.Weight, 1)}
+		be.healthy.Store(true)
+		p.backends = append(p.backends, be)
+	}
+	if cfg.Strategy == ConsistentHash {
+		p.buildRing()
+	}
+	if cfg.HealthCheck.Path != "" {
+		p.client = &http.Client{
+			Timeout: cfg.HealthCheck.Timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		p.wg.Add(1)
+		go p.healthLoop()
+	}
+	return p, nil
+}
+
+// Close stops the active health checks.
+func (p *Pool) Close() {
+	p.closed.Do(func() {
+		close(p.stop)
+	})
+	p.wg.Wait()
+}
+
+// pick returns the backend for r, or nil when none is available.
+func (p *Pool) pick(r *request.Request) *backend {
+	now := time.Now()
+	switch p.cfg.Strategy {
+	case Weighted:
+		return p.pickWeighted(now)
+	case LeastConn:
+		return p.pickLeastConn(now)
+	case ConsistentHash:
+		return p.pickHash(r, now)
+	}
+	return p.pickRoundRobin(now)
+}
+
+// pickRoundRobin counts turns over the available backends only, so the
+// share of one that is out does not all fall on its neighbour.
+func (p *Pool) pickRoundRobin(now time.Time) *backend {
+	available := make([]*backend, 0, len(p.backends))
+	for _, b := range p.backends {
+		if b.available(now) {
+			available = append(available, b)
+		}
+	}
+	if len(available) == 0 {
+		return nil
+	}
+	return available[p.next.Add(1)%uint64(len(available))]
+}
+
+// pickWeighted is nginx's smooth weighted round robin: every available
+// backend gains its weight, the richest is picked and pays back the total.
+func (p *Pool) pickWeighted(now time.Time) *backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var best *backend
+	total := 0
+	for _, b := range p.backends {
+		if !b.available(now) {
+			continue
+		}
+		b.current += b.weight
+		total += b.weight
+		if best == nil || b.current > best.current {
+			best = b
+		}
+	}
+	if best != nil {
+		best.current -= total
+	}
+	return best
+}
+
+func (p *Pool) pickLeastConn(now time.Time) *backend {
+	n := len(p.backends)
+	// Ties go to whoever is next in turn so idle backends share the load.
+	start := int(p.next.Add(1) % uint64(n))
+	var best *backend
+	var bestActive int64
+	for i := range n {
+		b := p.backends[(start+i)%n]
+		if !b.available(now) {
+			continue
+		}
+		active := b.active.Load()
+		if best == nil || active*int64(best.weight) < bestActive*int64(b.weight) {
+			best, bestActive = b, active
+		}
+	}
+	return best
+}
+
+func (p *Pool) pickHash(r *request.Request, now time.Time) *backend {
+	key := ""
+	if p.cfg.HashHeader != "" {
+		key, _ = r.Headers.Get(p.cfg.HashHeader)
+	}
+	if key == "" && r.ClientIP.IsValid() {
+		key = r.ClientIP.String()
+	}
+	if key == "" && r.RemoteAddr != nil {
+		key = r.RemoteAddr.String()
+		if host, _, err := net.SplitHostPort(key); err == nil {
+			key = host
+		}
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(p.ring), func(i int) bool {
+		return p.ring[i].hash >= h
+	})
+	// Walking on from the key's point means only the keys of a backend that
+	// goes away move, and they spread over the rest.
+	for j := range len(p.ring) {
+		if b := p.ring[(i+j)%len(p.ring)].backend; b.available(now) {
+			return b
+		}
+	}
+	return nil
+}
+
+func (p *Pool) buildRing() {
+	for _, b := range p.backends {
+		for i := range ringReplicas * b.weight {
+			h := crc32.ChecksumIEEE([]byte(b.url.String() + "#" + strconv.Itoa(i)))
+			p.ring = append(p.ring, ringEntry{hash: h, backend: b})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool {
+		return p.ring[i].hash < p.ring[j].hash
+	})
+}
+
+// report feeds the outcome of a proxied request to the passive checks.
+func (p *Pool) report(b *backend, err error) {
+	if p.cfg.MaxFails < 0 {
+		return
+	}
+	if err == nil {
+		b.fails.Store(0)
+		return
+	}
+	if b.fails.Add(1) >= int64(p.cfg.MaxFails) {
+		// Back from ejection it gets MaxFails more tries, not one.
+		b.fails.Store(0)
+		b.ejectedUntil.Store(time.Now().Add(p.cfg.FailTimeout).UnixNano())
+	}
+}
+
+func (p *Pool) healthLoop() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.cfg.HealthCheck.Interval)
+	defer ticker.Stop()
+	p.checkAll()
+	for {
+		select {
+		case <-ticker.C:
+			p.checkAll()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *Pool) checkAll() {
+	var wg sync.WaitGroup
+	for _, b := range p.backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			healthy := p.probe(b)
+			// A recovered backend starts over on the passive checks too.
+			if !b.healthy.Swap(healthy) && healthy {
+				b.fails.Store(0)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *Pool) probe(b *backend) bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-p.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	u := *b.url
+	u.Path, u.RawPath = joinPath(b.url, &url.URL{Path: p.cfg.HealthCheck.Path})
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return false
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
+	return res.StatusCode < 400
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	server "github.com/Barrioslopezfd/httpfromtcp/cmd/server"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/headers"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testPool(t *testing.T, cfg PoolConfig, weights ...int) *Pool {
+	t.Helper()
+	var backends []Backend
+	for i, w := range weights {
+		backends = append(backends, Backend{URL: &url.URL{Scheme: "http", Host: fmt.Sprintf("b%d", i)}, Weight: w})
+	}
+	p, err := NewPool(backends, cfg)
+	require.NoError(t, err)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func countPicks(p *Pool, n int, r *request.Request) map[string]int {
+	counts := map[string]int{}
+	for range n {
+		if b := p.pick(r); b != nil {
+			counts[b.url.Host]++
+		}
+	}
+	return counts
+}
+
+func TestPoolStrategies(t *testing.T) {
+	r := &request.Request{Headers: headers.NewHeaders(), RemoteAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.7"), Port: 1234}}
+
+	// Test: Round robin spreads evenly and skips ejected backends
+	p := testPool(t, PoolConfig{}, 1, 1, 1)
+	assert.Equal(t, map[string]int{"b0": 10, "b1": 10, "b2": 10}, countPicks(p, 30, r))
+	p.backends[1].ejectedUntil.Store(time.Now().Add(time.Minute).UnixNano())
+	assert.Equal(t, map[string]int{"b0": 15, "b2": 15}, countPicks(p, 30, r))
+
+	// Test: Weighted follows the weights, interleaved
+	p = testPool(t, PoolConfig{Strategy: Weighted}, 5, 1, 1)
+	assert.Equal(t, map[string]int{"b0": 50, "b1": 10, "b2": 10}, countPicks(p, 70, r))
+	var seq string
+	for range 7 {
+		seq += p.pick(r).url.Host[1:]
+	}
+	assert.Equal(t, "0010200", seq)
+
+	// Test: Least connections
+	p = testPool(t, PoolConfig{Strategy: LeastConn}, 1, 1, 2)
+	p.backends[0].active.Store(3)
+	p.backends[1].active.Store(1)
+	p.backends[2].active.Store(3)
+	assert.Equal(t, "b1", p.pick(r).url.Host)
+	p.backends[1].active.Store(2)
+	assert.Equal(t, "b2", p.pick(r).url.Host)
+
+	// Test: Consistent hash by client IP and by header
+	p = testPool(t, PoolConfig{Strategy: ConsistentHash, HashHeader: "X-User"}, 1, 1, 1, 1)
+	first := p.pick(r)
+	assert.Equal(t, map[string]int{first.url.Host: 20}, countPicks(p, 20, r))
+	moved := 0
+	for i := range 100 {
+		r.Headers.Replace("X-User", fmt.Sprint("user-", i))
+		before := p.pick(r)
+		if before == first {
+			continue
+		}
+		first.healthy.Store(false)
+		if p.pick(r) != before {
+			moved++
+		}
+		first.healthy.Store(true)
+	}
+	assert.Zero(t, moved, "keys of other backends must stay put")
+
+	// Test: Nothing available
+	p = testPool(t, PoolConfig{}, 1)
+	p.backends[0].healthy.Store(false)
+	assert.Nil(t, p.pick(r))
+
+	_, err := NewPool(nil, PoolConfig{})
+	assert.ErrorIs(t, err, ErrNoBackends)
+}
+
+func TestPoolPassiveChecks(t *testing.T) {
+	p := testPool(t, PoolConfig{MaxFails: 2, FailTimeout: 50 * time.Millisecond}, 1)
+	b := p.backends[0]
+	errUpstream := fmt.Errorf("upstream failed")
+
+	// Test: MaxFails consecutive errors eject the backend
+	p.report(b, errUpstream)
+	assert.True(t, b.available(time.Now()))
+	p.report(b, errUpstream)
+	assert.False(t, b.available(time.Now()))
+
+	// Test: Once re-admitted it takes MaxFails errors again to be ejected
+	require.Eventually(t, func() bool {
+		return b.available(time.Now())
+	}, time.Second, 10*time.Millisecond)
+	p.report(b, errUpstream)
+	assert.True(t, b.available(time.Now()))
+	p.report(b, nil)
+	p.report(b, errUpstream)
+	assert.True(t, b.available(time.Now()))
+	p.report(b, errUpstream)
+	assert.False(t, b.available(time.Now()))
+}
+
+func TestBalancer(t *testing.T) {
+	var aHealthy atomic.Bool
+	aHealthy.Store(true)
+	a := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" && !aHealthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("a"))
+	}))
+	defer a.Close()
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("b"))
+	}))
+	defer b.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dead := "http://" + ln.Addr().String()
+	ln.Close()
+
+	serve := func(raws []string, cfg PoolConfig) (*Pool, string) {
+		var backends []Backend
+		for _, raw := range raws {
+			u, err := url.Parse(raw)
+			require.NoError(t, err)
+			backends = append(backends, Backend{URL: u})
+		}
+		pool, err := NewPool(backends, cfg)
+		require.NoError(t, err)
+		t.Cleanup(pool.Close)
+		srv, err := server.Serve(NewBalancer(pool, Config{}), 0)
+		require.NoError(t, err)
+		t.Cleanup(func() { srv.Close() })
+		return pool, srv.Addr().String()
+	}
+	get := func(addr string) (int, string) {
+		res, body := roundTrip(t, addr, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		return res.StatusCode, body
+	}
+
+	// Test: A failing backend is ejected after MaxFails errors
+	_, addr := serve([]string{a.URL, b.URL, dead}, PoolConfig{MaxFails: 2, FailTimeout: time.Minute})
+	bodies := map[string]int{}
+	for range 12 {
+		code, body := get(addr)
+		if code == 502 {
+			body = "dead"
+		}
+		bodies[body]++
+	}
+	assert.Equal(t, 2, bodies["dead"])
+	assert.Equal(t, 10, bodies["a"]+bodies["b"])
+
+	pool, addr := serve([]string{a.URL, b.URL}, PoolConfig{
+		HealthCheck: HealthCheck{Path: "/healthz", Interval: 50 * time.Millisecond},
+	})
+
+	// Test: An unhealthy backend is taken out by the active checks
+	aHealthy.Store(false)
+	require.Eventually(t, func() bool {
+		return !pool.backends[0].healthy.Load()
+	}, 2*time.Second, 10*time.Millisecond)
+	for range 4 {
+		_, body := get(addr)
+		assert.Equal(t, "b", body)
+	}
+
+	// Test: And brought back once it recovers
+	aHealthy.Store(true)
+	require.Eventually(t, func() bool {
+		return pool.backends[0].healthy.Load()
+	}, 2*time.Second, 10*time.Millisecond)
+	bodies = map[string]int{}
+	for range 4 {
+		_, body := get(addr)
+		bodies[body]++
+	}
+	assert.Equal(t, map[string]int{"a": 2, "b": 2}, bodies)
+
+	// Test: No backend left
+	b.Close()
+	aHealthy.Store(false)
+	require.Eventually(t, func() bool {
+		return !pool.backends[0].healthy.Load() && !pool.backends[1].healthy.Load()
+	}, 2*time.Second, 10*time.Millisecond)
+	code, _ := get(addr)
+	assert.Equal(t, 503, code)
+}
@@ -0,0 +1,478 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	server "github.com/Barrioslopezfd/httpfromtcp/cmd/server"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/headers"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/requestid"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/response"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/trace"
+)
+
+const (
+	defaultVia = "httpfromtcp"
+	bufferSize = 32 << 10
+)
+
+var (
+	// errClientBody marks failures reading the request body, which are the
+	// client's doing rather than the backend's.
+	errClientBody   = errors.New("reading request body")
+	errBodyTooLarge = fmt.Errorf("%w: over MaxBodySize", errClientBody)
+)
+
+// hopHeaders apply to a single connection and are never forwarded, in either
+// direction, along with any field the Connection header names.
+var hopHeaders = []string{
+	"connection",
+	"keep-alive",
+	"proxy-connection",
+	"proxy-authenticate",
+	"proxy-authorization",
+	"te",
+	"trailer",
+	"transfer-encoding",
+	"upgrade",
+	"expect",
+}
+
+type Config struct {
+	// Transport sends the upstream requests. Nil means a clone of
+	// http.DefaultTransport.
+	Transport http.RoundTripper
+	// StripPrefix is removed from the request path before it is joined
+	// onto the target's path.
+	StripPrefix string
+	// Timeout bounds the whole upstream exchange, body included. Running
+	// out before the response head arrives is answered with 504. Zero means
+	// no limit beyond the request's own context.
+	Timeout time.Duration
+	// Via is the pseudonym this proxy adds to the Via header. Empty means
+	// "httpfromtcp".
+	Via string
+	// MaxBodySize caps the request bodies forwarded; larger ones get 413.
+	// Zero means no limit.
+	MaxBodySize int64
+}
+
+type reverseProxy struct {
+	// Exactly one of target and pool is set.
+	target *url.URL
+	pool   *Pool
+	cfg    Config
+}
+
+// New forwards requests to target: method, path under target's path, query,
+// end-to-end headers and body. Responses come back with their status,
+// headers, body and trailers. Bodies of unknown length or with trailers are
+// relayed chunked as they arrive. Request bodies stream upstream the same
+// way, with the client's Content-Length or chunked when it sent none.
+func New(target *url.URL, cfg Config) server.Handler {
+	p := &reverseProxy{target: target, cfg: withDefaults(cfg)}
+	return p.serve
+}
+
+// NewBalancer is New over a pool of backends, picked per request by the
+// pool's Strategy. Requests that find no backend available get 503.
+func NewBalancer(pool *Pool, cfg Config) server.Handler {
+	p := &reverseProxy{pool: pool, cfg: withDefaults(cfg)}
+	return p.serve
+}
+
+func withDefaults(cfg Config) Config {
+	if cfg.Transport == nil {
+		cfg.Transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	if cfg.Via == "" {
+		cfg.Via = defaultVia
+	}
+	return cfg
+}
+
+func (p *reverseProxy) serve(w *response.Writer, r *request.Request) {
+	body, length, ok := p.bodyReader(w, r)
+	if !ok {
+		return
+	}
+
+	target := p.target
+	var b *backend
+	if p.pool != nil {
+		if b = p.pool.pick(r); b == nil {
+			writeStatus(w, response.SERVICE_UNAVAILABLE)
+			return
+		}
+		target = b.url
+		b.active.Add(1)
+		defer b.active.Add(-1)
+	}
+	p.forward(w, r, body, length, target, b)
+}
+
+// bodyReader returns the body to forward and its length, -1 when the client
+// did not say, answering r itself when it cannot. A declared size over the
+// limit is refused before anything is read, so a client waiting for 100
+// Continue never sends the body at all.
+func (p *reverseProxy) bodyReader(w *response.Writer, r *request.Request) (io.Reader, int64, bool) {
+	length := int64(-1)
+	if _, ok := r.Headers.Get("transfer-encoding"); !ok {
+		length = 0
+		if v, ok := r.Headers.Get("content-length"); ok {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				writeStatus(w, response.BAD_REQUEST)
+				return nil, 0, false
+			}
+			length = n
+		}
+	}
+	if p.cfg.MaxBodySize > 0 && length > p.cfg.MaxBodySize {
+		writeStatus(w, response.CONTENT_TOO_LARGE)
+		return nil, 0, false
+	}
+	body, err := r.BodyReader()
+	if err != nil {
+		writeStatus(w, response.BAD_REQUEST)
+		return nil, 0, false
+	}
+	// A body that was read already, as over HTTP/2, has a known length.
+	if r.ParserState == request.DONE {
+		length = int64(len(r.Body))
+	}
+	if length == 0 {
+		// Reading the empty body to its end still tells the server it is
+		// done with.
+		io.Copy(io.Discard, body)
+		return nil, 0, true
+	}
+	limit := int64(-1)
+	if p.cfg.MaxBodySize > 0 && length < 0 {
+		limit = p.cfg.MaxBodySize
+	}
+	return &clientBody{r: body, left: limit}, length, true
+}
+
+// clientBody is the request body on its way upstream. Its errors are marked
+// with errClientBody, and it fails once more than left bytes have been
+// read, where io.LimitReader would quietly cut the body short. A negative
+// left means no limit.
+type clientBody struct {
+	r    io.Reader
+	left int64
+}
+
+func (cb *clientBody) Read(p []byte) (int, error) {
+	n, err := cb.r.Read(p)
+	if cb.left >= 0 {
+		if cb.left -= int64(n); cb.left < 0 {
+			return n, errBodyTooLarge
+		}
+	}
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%w: %w", errClientBody, err)
+	}
+	return n, err
+}
+
+// forward sends r to target and relays the answer. b is the pool backend
+// behind target, if any, to be told how it went.
+func (p *reverseProxy) forward(w *response.Writer, r *request.Request, body io.Reader, length int64, target *url.URL, b *backend) {
+	ctx := r.Context()
+	if p.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.cfg.Timeout)
+		defer cancel()
+	}
+	method := request.StandardMethod(r.RequestLine.Method)
+	ctx, span := trace.Start(ctx, method, trace.KindClient)
+	defer span.End()
+	span.SetAttribute("http.request.method", method)
+	span.SetAttribute("server.address", target.Host)
+	out, err := p.outRequest(ctx, target, r, body, length)
+	if err != nil {
+		writeStatus(w, response.BAD_REQUEST)
+		return
+	}
+
+	res, err := p.cfg.Transport.RoundTrip(out)
+	if err != nil {
+		span.RecordError(err)
+		// A client that went away gets nothing; it is not listening, and
+		// it says nothing about the backend. Neither does a body that
+		// could not be read, which the server answers for.
+		switch {
+		case errors.Is(err, errBodyTooLarge):
+			writeStatus(w, response.CONTENT_TOO_LARGE)
+			return
+		case r.Context().Err() != nil, errors.Is(err, errClientBody):
+			return
+		}
+		if b != nil {
+			p.pool.report(b, err)
+		}
+		writeStatus(w, upstreamErrorCode(err))
+		return
+	}
+	if b != nil {
+		p.pool.report(b, nil)
+	}
+	span.SetAttribute("http.response.status_code", res.StatusCode)
+	if res.StatusCode >= 500 {
+		span.SetStatus(trace.StatusError, "")
+	}
+	defer res.Body.Close()
+	p.relay(w, r, res)
+}
+
+// outRequest builds the request to target from r.
+func (p *reverseProxy) outRequest(ctx context.Context, target *url.URL, r *request.Request, body io.Reader, length int64) (*http.Request, error) {
+	in, err := url.ParseRequestURI(r.RequestLine.RequestTarget)
+	if err != nil {
+		return nil, err
+	}
+	u := *target
+	u.Path, u.RawPath = joinPath(target, stripPrefix(in, p.cfg.StripPrefix))
+	switch {
+	case target.RawQuery == "":
+		u.RawQuery = in.RawQuery
+	case in.RawQuery != "":
+		u.RawQuery = target.RawQuery + "&" + in.RawQuery
+	}
+
+	out, err := http.NewRequestWithContext(ctx, r.RequestLine.Method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	out.ContentLength = length
+	h := endToEnd(r.Headers)
+	for key, value := range h {
+		out.Header.Set(key, value)
+	}
+	// Content-Length is set from the body's length, Host from the target.
+	out.Header.Del("Content-Length")
+	out.Header.Del("Host")
+	// TE is hop-by-hop, but whether the client takes trailers matters to
+	// servers deciding how to end a response.
+	if te, ok := r.Headers.Get("te"); ok && hasToken(te, "trailers") {
+		out.Header.Set("Te", "trailers")
+	}
+
+	if host, ok := r.Headers.Get("host"); ok {
+		out.Header.Set("X-Forwarded-Host", host)
+	}
+	if r.RemoteAddr != nil {
+		ip := r.RemoteAddr.String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+		if prior, ok := r.Headers.Get("x-forwarded-for"); ok {
+			ip = prior + ", " + ip
+		}
+		out.Header.Set("X-Forwarded-For", ip)
+	}
+	proto := r.Scheme
+	if proto == "" {
+		proto = "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+	}
+	out.Header.Set("X-Forwarded-Proto", proto)
+	if id, ok := requestid.FromContext(r.Context()); ok {
+		out.Header.Set(requestid.Header, id)
+	}
+	// Upstreams see the proxy's own span as the parent.
+	if span := trace.SpanFromContext(ctx); span != nil && span.Context().IsValid() {
+		sc := span.Context()
+		out.Header.Set("Traceparent", sc.Traceparent())
+		out.Header.Del("Tracestate")
+		if sc.TraceState != "" {
+			out.Header.Set("Tracestate", sc.TraceState)
+		}
+	}
+	out.Header.Set("Via", appendVia(out.Header.Get("Via"), r.RequestLine.HttpVersion, p.cfg.Via))
+	return out, nil
+}
+
+// relay copies the upstream response to w.
+func (p *reverseProxy) relay(w *response.Writer, r *request.Request, res *http.Response) {
+	h := headers.NewHeaders()
+	for key, values := range res.Header {
+		h.Replace(key, strings.Join(values, ", "))
+	}
+	h = endToEnd(h)
+	h.Replace("Via", appendVia(res.Header.Get("Via"), strconv.Itoa(res.ProtoMajor)+"."+strconv.Itoa(res.ProtoMinor), p.cfg.Via))
+
+	code := res.StatusCode
+	bodyless := r.RequestLine.Method == "HEAD" || code == 204 || code == 304 || (code >= 100 && code < 200)
+	chunked := !bodyless && (res.ContentLength < 0 || len(res.Trailer) > 0)
+	switch {
+	case chunked:
+		h.Remove("Content-Length")
+		h.Replace("Transfer-Encoding", "chunked")
+		if len(res.Trailer) > 0 {
+			names := make([]string, 0, len(res.Trailer))
+			for key := range res.Trailer {
+				names = append(names, key)
+			}
+			h.Replace("Trailer", strings.Join(names, ", "))
+		}
+	case !bodyless:
+		h.Replace("Content-Length", strconv.FormatInt(res.ContentLength, 10))
+	}
+
+	if err := w.WriteStatusLine(response.Code(code)); err != nil {
+		return
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return
+	}
+	if bodyless {
+		return
+	}
+	if !chunked {
+		io.CopyBuffer(bodyWriter{w}, res.Body, make([]byte, bufferSize))
+		return
+	}
+
+	// Chunks go out as they arrive, which keeps streams such as server-sent
+	// events flowing through the proxy.
+	buf := make([]byte, bufferSize)
+	for {
+		n, err := res.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.WriteChunkedBody(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Ending the body cleanly would pass off a truncated response
+			// as complete, so the connection is left to be closed.
+			return
+		}
+	}
+	if _, err := w.WriteChunkedBodyDone(); err != nil {
+		return
+	}
+	trailers := headers.NewHeaders()
+	for key, values := range res.Trailer {
+		if len(values) > 0 {
+			trailers.Replace(key, strings.Join(values, ", "))
+		}
+	}
+	w.WriteTrailers(trailers)
+}
+
+// endToEnd returns a copy of h without hop-by-hop fields.
+func endToEnd(h headers.Headers) headers.Headers {
+	out := headers.NewHeaders()
+	for key, value := range h {
+		out.Replace(key, value)
+	}
+	if conn, ok := h.Get("connection"); ok {
+		for _, name := range strings.Split(conn, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				out.Remove(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		out.Remove(name)
+	}
+	return out
+}
+
+func upstreamErrorCode(err error) response.Code {
+	if errors.Is(err, errDenied) {
+		return response.FORBIDDEN
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return response.GATEWAY_TIMEOUT
+	}
+	return response.BAD_GATEWAY
+}
+
+func stripPrefix(u *url.URL, prefix string) *url.URL {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" || (u.Path != prefix && !strings.HasPrefix(u.Path, prefix+"/")) {
+		return u
+	}
+	out := *u
+	out.Path = strings.TrimPrefix(u.Path, prefix)
+	out.RawPath = ""
+	if u.RawPath != "" {
+		out.RawPath = strings.TrimPrefix(u.RawPath, prefix)
+	}
+	return &out
+}
+
+// joinPath appends the request path to the target's path with exactly one
+// slash between them, keeping any escaping of either.
+func joinPath(a, b *url.URL) (path string, rawPath string) {
+	if a.RawPath == "" && b.RawPath == "" {
+		return singleJoiningSlash(a.Path, b.Path), ""
+	}
+	return singleJoiningSlash(a.Path, b.Path), singleJoiningSlash(a.EscapedPath(), b.EscapedPath())
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash && b != "":
+		return a + "/" + b
+	case b == "" && a == "":
+		return "/"
+	}
+	return a + b
+}
+
+func appendVia(prior string, version string, pseudonym string) string {
+	via := version + " " + pseudonym
+	if prior != "" {
+		return prior + ", " + via
+	}
+	return via
+}
+
+func hasToken(list string, token string) bool {
+	for _, t := range strings.Split(list, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeStatus(w *response.Writer, code response.Code) {
+	if err := w.WriteStatusLine(code); err != nil {
+		return
+	}
+	w.WriteHeaders(response.GetDefaultHeaders())
+}
+
+type bodyWriter struct {
+	w *response.Writer
+}
+
+func (bw bodyWriter) Write(p []byte) (int, error) {
+	return bw.w.WriteBody(p)
+}
@@ -0,0 +1,253 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	server "github.com/Barrioslopezfd/httpfromtcp/cmd/server"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/trace"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func roundTrip(t *testing.T, addr string, raw string) (*http.Response, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte(raw))
+	require.NoError(t, err)
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	return res, string(body)
+}
+
+func TestReverseProxy(t *testing.T) {
+	var got *http.Request
+	var gotBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		b, _ := io.ReadAll(r.Body)
+		gotBody = string(b)
+		switch r.URL.Path {
+		case "/api/teapot":
+			w.Header().Set("X-Upstream", "yes")
+			w.Header().Set("Connection", "X-Hop")
+			w.Header().Set("X-Hop", "secret")
+			w.Header().Set("Content-Length", "5")
+			w.WriteHeader(http.StatusTeapot)
+			w.Write([]byte("short"))
+		case "/api/stream":
+			w.Header().Set("Trailer", "X-Checksum")
+			w.Write([]byte("part one,"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("part two"))
+			w.Header().Set("X-Checksum", "abc")
+		case "/api/slow":
+			time.Sleep(500 * time.Millisecond)
+		}
+	}))
+	defer upstream.Close()
+
+	target, err := url.Parse(upstream.URL + "/api")
+	require.NoError(t, err)
+	srv, err := server.Serve(New(target, Config{StripPrefix: "/proxy", Timeout: 200 * time.Millisecond}), 0)
+	require.NoError(t, err)
+	defer srv.Close()
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(srv.Addr().(*net.TCPAddr).Port))
+
+	// Test: Method, path, query, body and end-to-end headers are forwarded
+	res, body := roundTrip(t, addr, "PUT /proxy/teapot?a=1 HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\nX-Custom: kept\r\nConnection: X-Drop\r\nX-Drop: gone\r\nKeep-Alive: timeout=5\r\nX-Forwarded-For: 10.0.0.1\r\n\r\nhello")
+	require.NotNil(t, got)
+	assert.Equal(t, "PUT", got.Method)
+	assert.Equal(t, "/api/teapot", got.URL.Path)
+	assert.Equal(t, "a=1", got.URL.RawQuery)
+	assert.Equal(t, "hello", gotBody)
+	assert.Equal(t, "kept", got.Header.Get("X-Custom"))
+	assert.Empty(t, got.Header.Get("X-Drop"))
+	assert.Empty(t, got.Header.Get("Keep-Alive"))
+	assert.Equal(t, "10.0.0.1, 127.0.0.1", got.Header.Get("X-Forwarded-For"))
+	assert.Equal(t, "http", got.Header.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "example.com", got.Header.Get("X-Forwarded-Host"))
+	assert.Equal(t, "1.1 httpfromtcp", got.Header.Get("Via"))
+
+	// Test: Upstream status, headers and body are relayed
+	assert.Equal(t, http.StatusTeapot, res.StatusCode)
+	assert.Equal(t, "yes", res.Header.Get("X-Upstream"))
+	assert.Empty(t, res.Header.Get("X-Hop"))
+	assert.Equal(t, "1.1 httpfromtcp", res.Header.Get("Via"))
+	assert.Equal(t, "short", body)
+
+	// Test: Chunked body and trailers
+	res, body = roundTrip(t, addr, "GET /proxy/stream HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, []string{"chunked"}, res.TransferEncoding)
+	assert.Equal(t, "part one,part two", body)
+	assert.Equal(t, "abc", res.Trailer.Get("X-Checksum"))
+
+	// Test: Slow upstream times out with 504
+	res, _ = roundTrip(t, addr, "GET /proxy/slow HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, 504, res.StatusCode)
+}
+
+func TestReverseProxyBadGateway(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	target := &url.URL{Scheme: "http", Host: ln.Addr().String()}
+	ln.Close()
+
+	srv, err := server.Serve(New(target, Config{}), 0)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: Unreachable upstream
+	res, _ := roundTrip(t, srv.Addr().String(), "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, 502, res.StatusCode)
+}
+
+func TestReverseProxyBodyLimit(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.Copy(w, r.Body)
+	}))
+	defer upstream.Close()
+
+	target, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	srv, err := server.Serve(New(target, Config{MaxBodySize: 4}), 0)
+	require.NoError(t, err)
+	defer srv.Close()
+	addr := srv.Addr().String()
+
+	// Test: Bodies within the limit are forwarded
+	res, body := roundTrip(t, addr, "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\n\r\nfour")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "four", body)
+
+	// Test: Larger ones get 413 and never reach the upstream
+	res, _ = roundTrip(t, addr, "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello")
+	assert.Equal(t, 413, res.StatusCode)
+	assert.EqualValues(t, 1, hits.Load())
+
+	// Test: A client waiting on 100 Continue is refused without sending the body
+	res, _ = roundTrip(t, addr, "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n")
+	assert.Equal(t, 413, res.StatusCode)
+	assert.EqualValues(t, 1, hits.Load())
+
+	// Test: A chunked body is cut off once it goes over
+	res, _ = roundTrip(t, addr, "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n")
+	assert.Equal(t, 413, res.StatusCode)
+}
+
+func TestReverseProxyStreamsBody(t *testing.T) {
+	started := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		first := make([]byte, 5)
+		if _, err := io.ReadFull(r.Body, first); err != nil {
+			return
+		}
+		started <- struct{}{}
+		rest, _ := io.ReadAll(r.Body)
+		w.Write(append(first, rest...))
+	}))
+	defer upstream.Close()
+
+	target, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	srv, err := server.Serve(New(target, Config{}), 0)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: The upstream reads the start of the body before the client has
+	// sent the rest, with and without a Content-Length
+	for _, parts := range [][3]string{
+		{"Content-Length: 10\r\n", "hello", "world"},
+		{"Transfer-Encoding: chunked\r\n", "5\r\nhello\r\n", "5\r\nworld\r\n0\r\n\r\n"},
+	} {
+		conn, err := net.Dial("tcp", srv.Addr().String())
+		require.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: example.com\r\n" + parts[0] + "\r\n" + parts[1]))
+		require.NoError(t, err)
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("upstream got nothing before the body was finished")
+		}
+		_, err = conn.Write([]byte(parts[2]))
+		require.NoError(t, err)
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		body, _ := io.ReadAll(res.Body)
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, "helloworld", string(body))
+		conn.Close()
+	}
+}
+
+func TestReverseProxyRequestID(t *testing.T) {
+	var got string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("X-Request-ID")
+	}))
+	defer upstream.Close()
+
+	target, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	srv, err := server.Serve(New(target, Config{}), 0, server.WithRequestID(func() string { return "generated" }))
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: The ID the server assigned goes upstream and back to the client
+	res, _ := roundTrip(t, srv.Addr().String(), "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, "generated", got)
+	assert.Equal(t, "generated", res.Header.Get("X-Request-ID"))
+
+	// Test: A client's own ID is kept
+	res, _ = roundTrip(t, srv.Addr().String(), "GET / HTTP/1.1\r\nHost: example.com\r\nX-Request-ID: abc-123\r\n\r\n")
+	assert.Equal(t, "abc-123", got)
+	assert.Equal(t, "abc-123", res.Header.Get("X-Request-ID"))
+}
+
+func TestReverseProxyTraceContext(t *testing.T) {
+	var got http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer upstream.Close()
+
+	target, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	tracer := trace.New(trace.Config{})
+	defer tracer.Close()
+	srv, err := server.Serve(tracer.Wrap(New(target, Config{})), 0)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: Upstreams get the trace with the proxy's client span as parent
+	roundTrip(t, srv.Addr().String(), "GET / HTTP/1.1\r\nHost: example.com\r\nTraceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\r\nTracestate: rojo=1\r\n\r\n")
+	sc, err := trace.ParseTraceparent(got.Get("Traceparent"))
+	require.NoError(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.NotEqual(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.True(t, sc.Sampled)
+	assert.Equal(t, "rojo=1", got.Get("Tracestate"))
+
+	// Test: A trace starts here when the client sent none
+	roundTrip(t, srv.Addr().String(), "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	_, err = trace.ParseTraceparent(got.Get("Traceparent"))
+	assert.NoError(t, err)
+	assert.Empty(t, got.Get("Tracestate"))
+}
@@ -0,0 +1,387 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHeaderTimeout = 5 * time.Second
+	// maxV1Length is the longest v1 line the spec allows, CRLF included.
+	maxV1Length = 107
+	v2HeaderLen = 16
+)
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	ErrNoHeader      = errors.New("proxyproto: trusted peer sent no PROXY header")
+	ErrInvalidHeader = errors.New("proxyproto: invalid PROXY header")
+)
+
+// TLV types defined by the v2 spec.
+const (
+	TypeALPN      byte = 0x01
+	TypeAuthority byte = 0x02
+	TypeCRC32C    byte = 0x03
+	TypeNoop      byte = 0x04
+	TypeUniqueID  byte = 0x05
+	TypeSSL       byte = 0x20
+	TypeNetNS     byte = 0x30
+)
+
+type Config struct {
+	// Trusted lists the peers allowed to send a header, normally the load
+	// balancers. Connections from anywhere else are served as they are, so
+	// a client cannot claim an address of its choosing. Empty trusts none.
+	Trusted []netip.Prefix
+	// Required refuses connections from trusted peers that do not start
+	// with a header. Otherwise the header is optional, which helps while
+	// the balancer is being switched over.
+	Required bool
+	// HeaderTimeout bounds reading the header. Zero means 5s.
+	HeaderTimeout time.Duration
+}
+
+// Header is what the balancer said about the connection it relays.
+type Header struct {
+	Version int
+	// Local is set for v1 UNKNOWN and v2 LOCAL headers, such as the
+	// balancer's own health checks. Source and Destination are then nil
+	// and the connection's own addresses stand.
+	Local       bool
+	Source      net.Addr
+	Destination net.Addr
+	TLVs        []TLV
+}
+
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Authority returns the host name the client asked the balancer for, as
+// with TLS SNI, if it was passed on.
+func (h *Header) Authority() (string, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == TypeAuthority {
+			return string(tlv.Value), true
+		}
+	}
+	return "", false
+}
+
+// NewListener wraps ln so connections from trusted peers have their PROXY
+// header read and stripped, and report the addresses it carries from
+// RemoteAddr and LocalAddr. The header is read on the connection's first
+// Read or RemoteAddr call rather than in Accept, so a slow peer cannot hold
+// up the accept loop.
+func NewListener(ln net.Listener, cfg Config) net.Listener {
+	if cfg.HeaderTimeout <= 0 {
+		cfg.HeaderTimeout = defaultHeaderTimeout
+	}
+	return &listener{Listener: ln, cfg: cfg}
+}
+
+type listener struct {
+	net.Listener
+	cfg Config
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &Conn{Conn: conn, cfg: &l.cfg}, nil
+}
+
+func (l *listener) trusted(addr net.Addr) bool {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := ap.Addr().Unmap()
+	for _, prefix := range l.cfg.Trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection from a trusted peer.
+type Conn struct {
+	net.Conn
+	cfg *Config
+
+	once   sync.Once
+	reader *bufio.Reader
+	header *Header
+	err    error
+
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+// HeaderOf returns the header conn, or the connection under a TLS conn,
+// opened with, or nil if it had none.
+func HeaderOf(conn net.Conn) *Header {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	c, ok := conn.(*Conn)
+	if !ok {
+		return nil
+	}
+	h, err := c.Header()
+	if err != nil {
+		return nil
+	}
+	return h
+}
+
+// Header reads the header if that has not happened yet. It is nil when an
+// optional header was left out.
+func (c *Conn) Header() (*Header, error) {
+	c.once.Do(c.readHeader)
+	return c.header, c.err
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if _, err := c.Header(); err != nil {
+		return 0, err
+	}
+	if c.reader.Buffered() > 0 {
+		return c.reader.Read(p)
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if h, err := c.Header(); err == nil && h != nil && h.Source != nil {
+		return h.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	if h, err := c.Header(); err == nil && h != nil && h.Destination != nil {
+		return h.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite half-closes the underlying connection, so tunnels and lingering
+// closes work through the wrapper.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// SetDeadline and SetReadDeadline are tracked so reading the header, which
+// may happen inside the caller's first Read, puts the caller's read
+// deadline back when it is done.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *Conn) readHeader() {
+	c.mu.Lock()
+	restore := c.readDeadline
+	c.mu.Unlock()
+	deadline := time.Now().Add(c.cfg.HeaderTimeout)
+	if !restore.IsZero() && restore.Before(deadline) {
+		deadline = restore
+	}
+	c.Conn.SetReadDeadline(deadline)
+	defer c.Conn.SetReadDeadline(restore)
+
+	c.reader = bufio.NewReaderSize(c.Conn, 256)
+	c.header, c.err = parse(c.reader, c.cfg.Required)
+}
+
+// parse reads a v1 or v2 header from r. Without one it returns nil and
+// leaves r untouched, unless required.
+func parse(r *bufio.Reader, required bool) (*Header, error) {
+	// The first byte rules out a header for almost every request; only
+	// then is the whole signature looked at, which no HTTP client would
+	// send in pieces.
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch b[0] {
+	case v1Prefix[0]:
+		if b, err := r.Peek(len(v1Prefix)); err == nil && bytes.Equal(b, v1Prefix) {
+			return parseV1(r)
+		}
+	case v2Signature[0]:
+		if b, err := r.Peek(len(v2Signature)); err == nil && bytes.Equal(b, v2Signature) {
+			return parseV2(r)
+		}
+	}
+	if required {
+		return nil, ErrNoHeader
+	}
+	return nil, nil
+}
+
+func parseV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < maxV1Length {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, fmt.Errorf("%w: v1 line not terminated by CRLF", ErrInvalidHeader)
+	}
+	fields := strings.Split(s, " ")
+	h := &Header{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		h.Local = true
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidHeader, s)
+	}
+	src, err := parseV1Addr(fields[2], fields[4], fields[1] == "TCP4")
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseV1Addr(fields[3], fields[5], fields[1] == "TCP4")
+	if err != nil {
+		return nil, err
+	}
+	h.Source, h.Destination = src, dst
+	return h, nil
+}
+
+func parseV1Addr(ip string, port string, v4 bool) (net.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Is4() != v4 {
+		return nil, fmt.Errorf("%w: bad address %q", ErrInvalidHeader, ip)
+	}
+	// Ports are decimal without leading zeros.
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, fmt.Errorf("%w: bad port %q", ErrInvalidHeader, port)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(n))), nil
+}
+
+func parseV2(r *bufio.Reader) (*Header, error) {
+	head := make([]byte, v2HeaderLen)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if head[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: version %d", ErrInvalidHeader, head[12]>>4)
+	}
+	command := head[12] & 0x0f
+	if command > 1 {
+		return nil, fmt.Errorf("%w: command %d", ErrInvalidHeader, command)
+	}
+	family, transport := head[13]>>4, head[13]&0x0f
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	h := &Header{Version: 2, Local: command == 0}
+	var addrLen int
+	switch family {
+	case 0x1:
+		addrLen = 12
+	case 0x2:
+		addrLen = 36
+	case 0x3:
+		addrLen = 216
+	}
+	if len(body) < addrLen {
+		return nil, fmt.Errorf("%w: address block too short", ErrInvalidHeader)
+	}
+	// Only TCP over IP says anything about the client the server can use;
+	// for UDP, unix sockets and LOCAL the connection's addresses stand.
+	if !h.Local && transport == 0x1 && (family == 0x1 || family == 0x2) {
+		n := addrLen/2 - 2
+		src, _ := netip.AddrFromSlice(body[:n])
+		dst, _ := netip.AddrFromSlice(body[n : 2*n])
+		h.Source = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, binary.BigEndian.Uint16(body[2*n:])))
+		h.Destination = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst, binary.BigEndian.Uint16(body[2*n+2:])))
+	}
+
+	tlvs := body[addrLen:]
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return nil, fmt.Errorf("%w: truncated TLV", ErrInvalidHeader)
+		}
+		n := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+n {
+			return nil, fmt.Errorf("%w: truncated TLV", ErrInvalidHeader)
+		}
+		tlv := TLV{Type: tlvs[0], Value: tlvs[3 : 3+n]}
+		if tlv.Type == TypeCRC32C {
+			if !checksumValid(head, body, len(body)-len(tlvs), tlv.Value) {
+				return nil, fmt.Errorf("%w: checksum mismatch", ErrInvalidHeader)
+			}
+		}
+		if tlv.Type != TypeNoop {
+			h.TLVs = append(h.TLVs, tlv)
+		}
+		tlvs = tlvs[3+n:]
+	}
+	return h, nil
+}
+
+// checksumValid verifies a CRC32C TLV, which covers the whole header with
+// the checksum itself zeroed. at is the TLV's offset into body.
+func checksumValid(head []byte, body []byte, at int, sum []byte) bool {
+	if len(sum) != 4 {
+		return false
+	}
+	zeroed := bytes.Clone(body)
+	clear(zeroed[at+3 : at+7])
+	crc := crc32.Update(0, castagnoli, head)
+	crc = crc32.Update(crc, castagnoli, zeroed)
+	return crc == binary.BigEndian.Uint32(sum)
+}
@@ -0,0 +1,167 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// v2 builds a v2 PROXY command for TCP over IPv4 with the given TLVs,
+// adding a correct CRC32C when withCRC is set.
+func v2(src, dst string, tlvs []TLV, withCRC bool) []byte {
+	s, d := netip.MustParseAddrPort(src), netip.MustParseAddrPort(dst)
+	var body []byte
+	body = append(body, s.Addr().AsSlice()...)
+	body = append(body, d.Addr().AsSlice()...)
+	body = binary.BigEndian.AppendUint16(body, s.Port())
+	body = binary.BigEndian.AppendUint16(body, d.Port())
+	if withCRC {
+		tlvs = append(tlvs, TLV{Type: TypeCRC32C, Value: make([]byte, 4)})
+	}
+	for _, tlv := range tlvs {
+		body = append(body, tlv.Type)
+		body = binary.BigEndian.AppendUint16(body, uint16(len(tlv.Value)))
+		body = append(body, tlv.Value...)
+	}
+	out := append(bytes.Clone(v2Signature), 0x21, 0x11)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(body)))
+	out = append(out, body...)
+	if withCRC {
+		binary.BigEndian.PutUint32(out[len(out)-4:], crc32.Checksum(out, castagnoli))
+	}
+	return out
+}
+
+func TestParse(t *testing.T) {
+	rest := "GET / HTTP/1.1\r\n\r\n"
+	read := func(t *testing.T, header []byte, required bool) (*Header, error) {
+		t.Helper()
+		r := bufio.NewReader(io.MultiReader(bytes.NewReader(header), strings.NewReader(rest)))
+		h, err := parse(r, required)
+		if err == nil {
+			left, _ := io.ReadAll(r)
+			assert.Equal(t, rest, string(left))
+		}
+		return h, err
+	}
+
+	// Test: v1 TCP4 and TCP6
+	h, err := read(t, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n"), true)
+	require.NoError(t, err)
+	assert.Equal(t, 1, h.Version)
+	assert.Equal(t, "203.0.113.7:51234", h.Source.String())
+	assert.Equal(t, "10.0.0.1:443", h.Destination.String())
+	h, err = read(t, []byte("PROXY TCP6 2001:db8::7 2001:db8::1 51234 443\r\n"), true)
+	require.NoError(t, err)
+	assert.Equal(t, "[2001:db8::7]:51234", h.Source.String())
+
+	// Test: v1 UNKNOWN keeps the connection's addresses
+	h, err = read(t, []byte("PROXY UNKNOWN\r\n"), true)
+	require.NoError(t, err)
+	assert.True(t, h.Local)
+	assert.Nil(t, h.Source)
+
+	// Test: v2 with TLVs and a checksum
+	h, err = read(t, v2("198.51.100.9:40000", "10.0.0.1:80", []TLV{
+		{Type: TypeAuthority, Value: []byte("api.example.com")},
+		{Type: TypeNoop, Value: []byte{0, 0}},
+		{Type: TypeUniqueID, Value: []byte("abc123")},
+	}, true), true)
+	require.NoError(t, err)
+	assert.Equal(t, 2, h.Version)
+	assert.Equal(t, "198.51.100.9:40000", h.Source.String())
+	assert.Equal(t, "10.0.0.1:80", h.Destination.String())
+	authority, ok := h.Authority()
+	assert.True(t, ok)
+	assert.Equal(t, "api.example.com", authority)
+	require.Len(t, h.TLVs, 3)
+	assert.Equal(t, TypeUniqueID, h.TLVs[1].Type)
+
+	// Test: v2 LOCAL
+	local := v2("198.51.100.9:40000", "10.0.0.1:80", nil, false)
+	local[12] = 0x20
+	h, err = read(t, local, true)
+	require.NoError(t, err)
+	assert.True(t, h.Local)
+	assert.Nil(t, h.Source)
+
+	// Test: No header is fine unless required
+	h, err = read(t, nil, false)
+	require.NoError(t, err)
+	assert.Nil(t, h)
+	_, err = read(t, nil, true)
+	assert.ErrorIs(t, err, ErrNoHeader)
+
+	// Test: Malformed headers
+	badCRC := v2("198.51.100.9:40000", "10.0.0.1:80", nil, true)
+	badCRC[len(badCRC)-1] ^= 0xff
+	truncatedTLV := v2("198.51.100.9:40000", "10.0.0.1:80", []TLV{{Type: TypeALPN, Value: []byte("h2")}}, false)
+	truncatedTLV[15]--
+	for name, header := range map[string][]byte{
+		"v1 no CRLF":         []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\n"),
+		"v1 family mixup":    []byte("PROXY TCP4 2001:db8::7 10.0.0.1 51234 443\r\n"),
+		"v1 leading zero":    []byte("PROXY TCP4 203.0.113.7 10.0.0.1 051234 443\r\n"),
+		"v1 too long":        []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"),
+		"v2 bad checksum":    badCRC,
+		"v2 truncated TLV":   truncatedTLV,
+		"v2 unknown command": append(append(bytes.Clone(v2Signature), 0x22, 0x11), 0, 0),
+	} {
+		_, err = read(t, header, true)
+		assert.ErrorIs(t, err, ErrInvalidHeader, name)
+	}
+}
+
+func TestListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dial := func(trusted string) (net.Conn, net.Conn) {
+		t.Helper()
+		pl := NewListener(ln, Config{Trusted: []netip.Prefix{netip.MustParsePrefix(trusted)}, HeaderTimeout: time.Second})
+		client, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { client.Close() })
+		client.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\nhello"))
+		conn, err := pl.Accept()
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn, client
+	}
+	defer ln.Close()
+
+	// Test: Trusted peers have the header applied and stripped
+	conn, client := dial("127.0.0.0/8")
+	assert.Equal(t, "203.0.113.7:51234", conn.RemoteAddr().String())
+	assert.Equal(t, "10.0.0.1:443", conn.LocalAddr().String())
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+	require.NotNil(t, HeaderOf(conn))
+
+	// Test: Half-closing reaches the underlying connection
+	cw, ok := conn.(interface{ CloseWrite() error })
+	require.True(t, ok)
+	require.NoError(t, cw.CloseWrite())
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Read(buf)
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Others are left alone
+	conn, _ = dial("192.0.2.0/24")
+	assert.Contains(t, conn.RemoteAddr().String(), "127.0.0.1:")
+	assert.Nil(t, HeaderOf(conn))
+	buf = make([]byte, 6)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "PROXY ", string(buf))
+}
@@ -0,0 +1,78 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+var errBodyStreamed = errors.New("body already taken by BodyReader")
+
+// bodyReader returns a reader over the body on the wire, as framed by
+// Content-Length or chunked transfer coding.
+func (r *Request) bodyReader() (io.Reader, error) {
+	if _, ok := r.Headers.Get("transfer-encoding"); ok {
+		return &chunkedReader{r: r.body}, nil
+	}
+	value, ok := r.Headers.Get("content-length")
+	if !ok {
+		return &lengthReader{}, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid content-length, got=%s", value)
+	}
+	return &lengthReader{r: r.body, left: n}, nil
+}
+
+// lengthReader reads a Content-Length body. Running out before the end
+// means the client went away.
+type lengthReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (lr *lengthReader) Read(p []byte) (int, error) {
+	if lr.left == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > lr.left {
+		p = p[:lr.left]
+	}
+	n, err := lr.r.Read(p)
+	lr.left -= int64(n)
+	if err == io.EOF {
+		if lr.left > 0 {
+			return n, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	return n, err
+}
+
+// bodyStream is what BodyReader hands out. It runs the End hook when the
+// body is done, however that happens.
+type bodyStream struct {
+	r   *Request
+	src io.Reader
+	err error
+}
+
+func (bs *bodyStream) Read(p []byte) (int, error) {
+	if bs.err != nil {
+		return 0, bs.err
+	}
+	n, err := bs.src.Read(p)
+	if err == nil {
+		return n, nil
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	if err = bs.r.endBody(err); err == nil {
+		err = io.EOF
+	}
+	bs.err = err
+	return n, err
+}
@@ -0,0 +1,137 @@
+package request
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxChunkedSize caps a chunked body, trailers included, since the client
+// never says up front how large it will be.
+const maxChunkedSize = 10 << 20
+
+var (
+	ErrUnsupportedTransferEncoding = errors.New("unsupported transfer-encoding")
+	ErrContentTooLarge             = errors.New("request body too large")
+	errAmbiguousLength             = errors.New("both transfer-encoding and content-length")
+	errMalformedChunk              = errors.New("malformed chunked body")
+)
+
+// checkFraming refuses requests whose body length cannot be told apart
+// from the next request on the connection. Chunked is the only transfer
+// coding understood, and it may not come with a Content-Length.
+func (r *Request) checkFraming() error {
+	te, ok := r.Headers.Get("transfer-encoding")
+	if !ok {
+		return nil
+	}
+	if _, ok := r.Headers.Get("content-length"); ok {
+		return errAmbiguousLength
+	}
+	if !strings.EqualFold(strings.TrimSpace(te), "chunked") {
+		return fmt.Errorf("%w: %s", ErrUnsupportedTransferEncoding, te)
+	}
+	return nil
+}
+
+// chunkedReader decodes a chunked body, discarding extensions and
+// trailers. It stops at the end of the body, leaving whatever follows for
+// the next request.
+type chunkedReader struct {
+	r     *bufio.Reader
+	left  int64
+	total int64
+	err   error
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	if cr.left == 0 {
+		if cr.err = cr.nextChunk(); cr.err != nil {
+			return 0, cr.err
+		}
+	}
+	if int64(len(p)) > cr.left {
+		p = p[:cr.left]
+	}
+	n, err := cr.r.Read(p)
+	cr.left -= int64(n)
+	if cr.left == 0 && err == nil {
+		err = cr.readCRLF()
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	cr.err = err
+	return n, err
+}
+
+// nextChunk reads a chunk size line. After the last chunk it reads the
+// trailers and returns io.EOF.
+func (cr *chunkedReader) nextChunk() error {
+	line, err := cr.readLine()
+	if err != nil {
+		return err
+	}
+	size, _, _ := strings.Cut(line, ";")
+	n, err := strconv.ParseUint(strings.TrimRight(size, " \t"), 16, 63)
+	if err != nil {
+		return fmt.Errorf("%w: chunk size %q", errMalformedChunk, size)
+	}
+	if int64(n) > maxChunkedSize-cr.total {
+		return ErrContentTooLarge
+	}
+	cr.total += int64(n)
+	if n > 0 {
+		cr.left = int64(n)
+		return nil
+	}
+	for {
+		line, err := cr.readLine()
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			return io.EOF
+		}
+	}
+}
+
+// readLine returns the next CRLF terminated line without its CRLF. It
+// counts against maxChunkedSize so trailers cannot go on forever.
+func (cr *chunkedReader) readLine() (string, error) {
+	line, err := cr.r.ReadSlice('\n')
+	switch {
+	case err == bufio.ErrBufferFull:
+		return "", ErrLineTooLong
+	case err == io.EOF:
+		return "", io.ErrUnexpectedEOF
+	case err != nil:
+		return "", err
+	}
+	cr.total += int64(len(line))
+	if cr.total > maxChunkedSize {
+		return "", ErrContentTooLarge
+	}
+	s, ok := strings.CutSuffix(string(line), CRLF)
+	if !ok {
+		return "", fmt.Errorf("%w: line %q", errMalformedChunk, line)
+	}
+	return s, nil
+}
+
+func (cr *chunkedReader) readCRLF() error {
+	var crlf [2]byte
+	if _, err := io.ReadFull(cr.r, crlf[:]); err != nil {
+		return err
+	}
+	if string(crlf[:]) != CRLF {
+		return fmt.Errorf("%w: chunk not followed by CRLF", errMalformedChunk)
+	}
+	return nil
+}
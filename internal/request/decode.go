@@ -0,0 +1,76 @@
+package request
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+	ErrBodyTooLarge        = errors.New("decoded body too large")
+)
+
+// DecodeBody undoes the Content-Encoding of a body that has been read,
+// innermost coding last as the header lists them. The decoded body may not
+// exceed maxSize bytes nor grow more than maxRatio times over what was sent,
+// which stops small zip bombs from inflating into gigabytes. On success the
+// Content-Encoding header is dropped and Content-Length describes the new
+// body.
+func (r *Request) DecodeBody(maxSize int64, maxRatio int64) error {
+	if r.ParserState != DONE {
+		return fmt.Errorf("body not read, \"Parse State\"=%d", r.ParserState)
+	}
+	value, ok := r.Headers.Get("content-encoding")
+	if !ok {
+		return nil
+	}
+
+	var codings []string
+	for _, c := range strings.Split(value, ",") {
+		c = strings.ToLower(strings.TrimSpace(c))
+		switch c {
+		case "", "identity":
+		case "gzip", "x-gzip", "deflate":
+			codings = append(codings, c)
+		default:
+			return fmt.Errorf("%w: %s", ErrUnsupportedEncoding, c)
+		}
+	}
+
+	limit := maxSize
+	if ratioLimit := int64(len(r.Body)) * maxRatio; maxRatio > 0 && ratioLimit < limit {
+		limit = ratioLimit
+	}
+	body := r.Body
+	for i := len(codings) - 1; i >= 0; i-- {
+		var zr io.ReadCloser
+		var err error
+		if codings[i] == "deflate" {
+			zr, err = zlib.NewReader(bytes.NewReader(body))
+		} else {
+			zr, err = gzip.NewReader(bytes.NewReader(body))
+		}
+		if err != nil {
+			return fmt.Errorf("decoding %s body, err=%w", codings[i], err)
+		}
+		body, err = io.ReadAll(io.LimitReader(zr, limit+1))
+		zr.Close()
+		if err != nil {
+			return fmt.Errorf("decoding %s body, err=%w", codings[i], err)
+		}
+		if int64(len(body)) > limit {
+			return ErrBodyTooLarge
+		}
+	}
+
+	r.Body = body
+	r.Headers.Remove("content-encoding")
+	r.Headers.Replace("content-length", strconv.Itoa(len(body)))
+	return nil
+}
@@ -0,0 +1,79 @@
+package request
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipped(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func deflated(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	_, err := zw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func encodedRequest(t *testing.T, encoding string, body []byte) *Request {
+	raw := fmt.Sprintf("POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Encoding: %s\r\nContent-Length: %d\r\n\r\n%s", encoding, len(body), body)
+	r, err := RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	return r
+}
+
+func TestDecodeBody(t *testing.T) {
+	text := []byte(strings.Repeat("some json, probably ", 50))
+
+	// Test: gzip
+	r := encodedRequest(t, "gzip", gzipped(t, text))
+	require.NoError(t, r.DecodeBody(1<<20, 100))
+	assert.Equal(t, text, r.Body)
+	_, ok := r.Headers.Get("content-encoding")
+	assert.False(t, ok)
+	assert.Equal(t, fmt.Sprint(len(text)), r.Headers["content-length"])
+
+	// Test: deflate
+	r = encodedRequest(t, "deflate", deflated(t, text))
+	require.NoError(t, r.DecodeBody(1<<20, 100))
+	assert.Equal(t, text, r.Body)
+
+	// Test: Stacked codings are undone last to first
+	r = encodedRequest(t, "deflate, gzip", gzipped(t, deflated(t, text)))
+	require.NoError(t, r.DecodeBody(1<<20, 100))
+	assert.Equal(t, text, r.Body)
+
+	// Test: Decoded size limit
+	r = encodedRequest(t, "gzip", gzipped(t, text))
+	assert.ErrorIs(t, r.DecodeBody(100, 100), ErrBodyTooLarge)
+
+	// Test: Compression ratio limit
+	bomb := gzipped(t, make([]byte, 1<<20))
+	r = encodedRequest(t, "gzip", bomb)
+	assert.ErrorIs(t, r.DecodeBody(10<<20, 100), ErrBodyTooLarge)
+
+	// Test: Unsupported encoding
+	r = encodedRequest(t, "br", []byte("whatever"))
+	assert.ErrorIs(t, r.DecodeBody(1<<20, 100), ErrUnsupportedEncoding)
+
+	// Test: Corrupt data
+	r = encodedRequest(t, "gzip", []byte("not gzip at all"))
+	err := r.DecodeBody(1<<20, 100)
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrBodyTooLarge)
+}
@@ -0,0 +1,227 @@
+package request
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/Barrioslopezfd/httpfromtcp/internal/headers"
+)
+
+// hop is one proxy's account of the request it received: the address it
+// came from and the scheme and host it was made with. Fields are empty or
+// invalid when the proxy did not say.
+type hop struct {
+	ip    netip.Addr
+	proto string
+	host  string
+}
+
+// ResolveForwarded fills in ClientIP, Scheme and Host. They start out as
+// the connection's peer, TLS state and Host header. If the peer is one of
+// trusted, the Forwarded header, or failing that X-Forwarded-For, Proto and
+// Host, is walked from the right, one hop per trusted proxy, and the first
+// address that is not trusted is the client. Anything short of a valid
+// address ends the walk at the last proxy that could be vouched for.
+func (r *Request) ResolveForwarded(trusted []netip.Prefix) {
+	r.ClientIP = addrOf(r.RemoteAddr)
+	r.Scheme = "http"
+	if r.TLS != nil {
+		r.Scheme = "https"
+	}
+	r.Host, _ = r.Headers.Get("host")
+
+	if !isTrusted(r.ClientIP, trusted) {
+		return
+	}
+	var hops []hop
+	if v, ok := r.Headers.Get("forwarded"); ok {
+		hops = parseForwarded(v)
+	} else if v, ok := r.Headers.Get("x-forwarded-for"); ok {
+		hops = parseXForwarded(v, r.Headers)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		h := hops[i]
+		if !h.ip.IsValid() {
+			return
+		}
+		r.ClientIP = h.ip
+		if h.proto != "" {
+			r.Scheme = h.proto
+		}
+		if h.host != "" {
+			r.Host = h.host
+		}
+		if !isTrusted(h.ip, trusted) {
+			return
+		}
+	}
+}
+
+func addrOf(addr net.Addr) netip.Addr {
+	if addr == nil {
+		return netip.Addr{}
+	}
+	if ap, err := netip.ParseAddrPort(addr.String()); err == nil {
+		return ap.Addr().Unmap()
+	}
+	ip, _ := netip.ParseAddr(addr.String())
+	return ip.Unmap()
+}
+
+func isTrusted(ip netip.Addr, trusted []netip.Prefix) bool {
+	if !ip.IsValid() {
+		return false
+	}
+	for _, prefix := range trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForwarded reads RFC 7239 elements, one per hop.
+func parseForwarded(v string) []hop {
+	var hops []hop
+	for _, element := range splitQuoted(v, ',') {
+		var h hop
+		for _, pair := range splitQuoted(element, ';') {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok {
+				continue
+			}
+			value = unquote(strings.TrimSpace(value))
+			switch strings.ToLower(strings.TrimSpace(key)) {
+			case "for":
+				h.ip = parseNode(value)
+			case "proto":
+				h.proto = parseProto(value)
+			case "host":
+				h.host = parseHost(value)
+			}
+		}
+		hops = append(hops, h)
+	}
+	return hops
+}
+
+// parseXForwarded lines X-Forwarded-Proto and X-Forwarded-Host up with the
+// hops of X-Forwarded-For when they list as many; otherwise only their last
+// value is known to come from the nearest proxy, and it goes with the last
+// hop.
+func parseXForwarded(v string, h headers.Headers) []hop {
+	ips := splitList(v)
+	hops := make([]hop, len(ips))
+	for i, ip := range ips {
+		hops[i].ip = parseNode(ip)
+	}
+	if len(hops) == 0 {
+		return nil
+	}
+	if v, ok := h.Get("x-forwarded-proto"); ok {
+		protos := splitList(v)
+		if len(protos) == len(hops) {
+			for i, proto := range protos {
+				hops[i].proto = parseProto(proto)
+			}
+		} else if len(protos) > 0 {
+			hops[len(hops)-1].proto = parseProto(protos[len(protos)-1])
+		}
+	}
+	if v, ok := h.Get("x-forwarded-host"); ok {
+		hosts := splitList(v)
+		if len(hosts) == len(hops) {
+			for i, host := range hosts {
+				hops[i].host = parseHost(host)
+			}
+		} else if len(hosts) > 0 {
+			hops[len(hops)-1].host = parseHost(hosts[len(hosts)-1])
+		}
+	}
+	return hops
+}
+
+// parseNode takes the address out of a node: a bare IP, "ip:port" or
+// "[ipv6]:port". Obfuscated identifiers and "unknown" give an invalid
+// address.
+func parseNode(node string) netip.Addr {
+	node = strings.TrimSpace(node)
+	if ip, err := netip.ParseAddr(node); err == nil {
+		return ip.Unmap()
+	}
+	if strings.HasPrefix(node, "[") {
+		end := strings.IndexByte(node, ']')
+		if end < 0 {
+			return netip.Addr{}
+		}
+		ip, _ := netip.ParseAddr(node[1:end])
+		return ip.Unmap()
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		ip, _ := netip.ParseAddr(host)
+		return ip.Unmap()
+	}
+	return netip.Addr{}
+}
+
+func parseProto(proto string) string {
+	proto = strings.ToLower(strings.TrimSpace(proto))
+	if proto == "http" || proto == "https" {
+		return proto
+	}
+	return ""
+}
+
+func parseHost(host string) string {
+	host = strings.TrimSpace(host)
+	if strings.ContainsAny(host, " \t/\\@") {
+		return ""
+	}
+	return host
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// splitQuoted splits v at sep, except inside quoted strings.
+func splitQuoted(v string, sep byte) []string {
+	var parts []string
+	quoted, escaped := false, false
+	start := 0
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, v[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, v[start:])
+}
+
+func unquote(v string) string {
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return v
+	}
+	var b strings.Builder
+	for i := 1; i < len(v)-1; i++ {
+		if v[i] == '\\' && i+1 < len(v)-1 {
+			i++
+		}
+		b.WriteByte(v[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,120 @@
+package request
+
+import (
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/Barrioslopezfd/httpfromtcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveForwarded(t *testing.T) {
+	trusted := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("2001:db8:ffff::/48"),
+	}
+	tests := []struct {
+		name    string
+		peer    string
+		tls     bool
+		headers map[string]string
+		ip      string
+		scheme  string
+		host    string
+	}{
+		{
+			name:    "Untrusted peer's headers are ignored",
+			peer:    "198.51.100.1:5000",
+			headers: map[string]string{"x-forwarded-for": "1.2.3.4", "x-forwarded-proto": "https", "forwarded": "for=1.2.3.4"},
+			ip:      "198.51.100.1", scheme: "http", host: "origin.example",
+		},
+		{
+			name: "No headers from a trusted peer",
+			peer: "10.0.0.2:5000",
+			tls:  true,
+			ip:   "10.0.0.2", scheme: "https", host: "origin.example",
+		},
+		{
+			name:    "X-Forwarded-For walked from the right",
+			peer:    "10.0.0.2:5000",
+			headers: map[string]string{"x-forwarded-for": "6.6.6.6, 203.0.113.5, 10.1.1.1", "x-forwarded-proto": "https", "x-forwarded-host": "shop.example"},
+			ip:      "203.0.113.5", scheme: "https", host: "shop.example",
+		},
+		{
+			name:    "X-Forwarded-Proto and Host aligned with the hops",
+			peer:    "10.0.0.2:5000",
+			headers: map[string]string{"x-forwarded-for": "203.0.113.5, 10.1.1.1", "x-forwarded-proto": "https, http", "x-forwarded-host": "shop.example, inner.local"},
+			ip:      "203.0.113.5", scheme: "https", host: "shop.example",
+		},
+		{
+			name:    "All hops trusted",
+			peer:    "10.0.0.2:5000",
+			headers: map[string]string{"x-forwarded-for": "10.9.9.9, 10.1.1.1"},
+			ip:      "10.9.9.9", scheme: "http", host: "origin.example",
+		},
+		{
+			name:    "Garbage stops the walk at the last trusted hop",
+			peer:    "10.0.0.2:5000",
+			headers: map[string]string{"x-forwarded-for": "203.0.113.5, not-an-ip, 10.1.1.1"},
+			ip:      "10.1.1.1", scheme: "http", host: "origin.example",
+		},
+		{
+			name: "Forwarded wins over X-Forwarded-*",
+			peer: "10.0.0.2:5000",
+			headers: map[string]string{
+				"forwarded":       `for=192.0.2.60;proto=https;host="a.example", for="[2001:db8:ffff::1]:4711";proto=http;host=inner`,
+				"x-forwarded-for": "6.6.6.6",
+			},
+			ip: "192.0.2.60", scheme: "https", host: "a.example",
+		},
+		{
+			name:    "Forwarded IPv6 client",
+			peer:    "10.0.0.2:5000",
+			headers: map[string]string{"forwarded": `For="[2001:db8:cafe::17]:4711"`},
+			ip:      "2001:db8:cafe::17", scheme: "http", host: "origin.example",
+		},
+		{
+			name:    "Forwarded IPv4-mapped node in brackets",
+			peer:    "10.0.0.2:5000",
+			headers: map[string]string{"forwarded": `for=203.0.113.9, for="[::ffff:10.1.1.1]:4711"`},
+			ip:      "203.0.113.9", scheme: "http", host: "origin.example",
+		},
+		{
+			name:    "Forwarded obfuscated node",
+			peer:    "10.0.0.2:5000",
+			headers: map[string]string{"forwarded": `for=_hidden, for=10.3.3.3;proto=https`},
+			ip:      "10.3.3.3", scheme: "https", host: "origin.example",
+		},
+		{
+			name:    "Quoted commas do not split elements",
+			peer:    "10.0.0.2:5000",
+			headers: map[string]string{"forwarded": `for=192.0.2.43;host="odd,host"`},
+			ip:      "192.0.2.43", scheme: "http", host: "odd,host",
+		},
+		{
+			name:    "Bad proto and host values are dropped",
+			peer:    "10.0.0.2:5000",
+			headers: map[string]string{"forwarded": `for=192.0.2.43;proto=gopher;host="a/b"`},
+			ip:      "192.0.2.43", scheme: "http", host: "origin.example",
+		},
+	}
+	for _, tt := range tests {
+		// Test: each case
+		r := &Request{Headers: headers.NewHeaders()}
+		r.Headers.Replace("host", "origin.example")
+		for k, v := range tt.headers {
+			r.Headers.Replace(k, v)
+		}
+		ap := netip.MustParseAddrPort(tt.peer)
+		r.RemoteAddr = net.TCPAddrFromAddrPort(ap)
+		if tt.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		r.ResolveForwarded(trusted)
+		assert.Equal(t, tt.ip, r.ClientIP.String(), tt.name)
+		assert.Equal(t, tt.scheme, r.Scheme, tt.name)
+		assert.Equal(t, tt.host, r.Host, tt.name)
+	}
+}
@@ -1,15 +1,20 @@
 package request
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
-	"slices"
+	"net"
+	"net/netip"
 	"strconv"
 	"strings"
 
 	"github.com/Barrioslopezfd/httpfromtcp/internal/headers"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/proxyproto"
 )
 
 type State int
@@ -23,11 +28,44 @@ const (
 
 const CRLF = "\r\n"
 
+var ErrLineTooLong = errors.New("request line or header too long")
+
 type Request struct {
 	RequestLine RequestLine
 	ParserState State
 	Headers     headers.Headers
 	Body        []byte
+
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+	// TLS is nil for plain TCP connections.
+	TLS *tls.ConnectionState
+	// Proxy is the PROXY protocol header the connection opened with, nil
+	// without one. RemoteAddr and LocalAddr already reflect it.
+	Proxy *proxyproto.Header
+	// ClientIP, Scheme and Host describe the request as the client made it,
+	// behind any trusted proxies. See ResolveForwarded.
+	ClientIP netip.Addr
+	Scheme   string
+	Host     string
+
+	body      *bufio.Reader
+	hooks     BodyHooks
+	end       func(r *Request, err error) error
+	streaming bool
+	ctx       context.Context
+}
+
+// BodyHooks let the server step in around a body it left on the wire. See
+// DeferBody.
+type BodyHooks struct {
+	// Start runs before the body is read. It may fill the body itself
+	// through SetBody, as HTTP/2 does, in which case End is not run.
+	Start func(r *Request) error
+	// End runs once the body has been read from the wire, to its end or up
+	// to err, and returns the error to report in its place. ParserState is
+	// DONE only when the body was read whole into Body.
+	End func(r *Request, err error) error
 }
 
 type RequestLine struct {
@@ -36,104 +74,231 @@ type RequestLine struct {
 	Method        string
 }
 
+// standardMethods are the methods of RFC 9110 plus PATCH.
+var standardMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"POST":    true,
+	"PUT":     true,
+	"DELETE":  true,
+	"CONNECT": true,
+	"OPTIONS": true,
+	"TRACE":   true,
+	"PATCH":   true,
+}
+
+// StandardMethod returns method if it is a standard one and "OTHER" if not,
+// for metric labels and span names that must not grow with whatever
+// methods clients make up.
+func StandardMethod(method string) string {
+	if standardMethods[method] {
+		return method
+	}
+	return "OTHER"
+}
+
 func RequestFromReader(reader io.Reader) (*Request, error) {
+	req, err := ReadRequest(bufio.NewReader(reader))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := req.ReadBody(); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// ReadRequest parses the request line and headers from reader and leaves the
+// body unread, so the caller can apply its own deadline before ReadBody. Bytes
+// past the end of this request stay buffered in reader for the next one.
+func ReadRequest(reader *bufio.Reader) (*Request, error) {
 	req := &Request{
 		ParserState: INITIALIZED,
-		Headers:     make(map[string]string),
+		Headers:     headers.NewHeaders(),
+		body:        reader,
 	}
 
-	buffer := make([]byte, 8)
-	var readBuffer bytes.Buffer
-	bytesRead := 0
-	bytesParsed := 0
-	for {
-		n, err := reader.Read(buffer)
-		if err != nil {
-			return nil, err
+	for req.ParserState != PARSING_BODY {
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return nil, ErrLineTooLong
 		}
-		bytesRead += n
-		_, err = readBuffer.Write(buffer[:n])
 		if err != nil {
+			if err == io.EOF && (len(line) > 0 || req.ParserState != INITIALIZED) {
+				return nil, io.ErrUnexpectedEOF
+			}
 			return nil, err
 		}
-		consumed, err := req.parse(readBuffer.Bytes())
+		consumed, err := req.parse(line)
 		if err != nil {
 			return nil, err
 		}
 		if consumed == 0 {
-			buffer = make([]byte, bytesRead)
-			continue
-		}
-		bytesParsed += consumed
-		if req.ParserState == DONE {
-			break
+			return nil, fmt.Errorf("malformed line, expected CRLF, got=%q", line)
 		}
 	}
+	if err := req.checkFraming(); err != nil {
+		return nil, err
+	}
 
 	return req, nil
 }
 
 func (r *Request) parse(data []byte) (int, error) {
-	if r.ParserState == DONE {
-		return 0, errors.New("\"Parse State\"=done")
-	}
-	reqLine, consumed, err := parseRequestLine(data)
-	if err != nil {
-		return 0, err
-	}
-	if consumed == 0 {
-		return 0, nil
-	}
-	r.RequestLine = *reqLine
-	r.ParserState = PARSING_HEADERS
-	for r.ParserState == PARSING_HEADERS {
-		parsed, done, err := r.Headers.Parse(data[consumed:])
+	switch r.ParserState {
+	case INITIALIZED:
+		reqLine, consumed, err := parseRequestLine(data)
 		if err != nil {
 			return 0, err
 		}
-		consumed += parsed
-		if parsed == 0 {
-			r.ParserState = INITIALIZED
-		}
-		if done {
-			r.ParserState = PARSING_BODY
+		if consumed == 0 {
+			return 0, nil
 		}
-	}
-
-	for r.ParserState == PARSING_BODY {
-		parsed, done, err := r.parseBody(data[consumed:])
+		r.RequestLine = *reqLine
+		r.ParserState = PARSING_HEADERS
+		return consumed, nil
+	case PARSING_HEADERS:
+		parsed, done, err := r.Headers.Parse(data)
 		if err != nil {
 			return 0, err
 		}
-		consumed += parsed
-		if parsed == 0 {
-			r.ParserState = INITIALIZED
-		}
 		if done {
-			r.ParserState = DONE
+			r.ParserState = PARSING_BODY
 		}
+		return parsed, nil
+	default:
+		return 0, fmt.Errorf("\"Parse State\"=%d", r.ParserState)
 	}
+}
 
-	return consumed, nil
+// ReadBody reads the body that follows the headers into Body, as framed by
+// Content-Length or chunked transfer coding. It is safe to call more than
+// once; later calls return the stored body.
+func (r *Request) ReadBody() ([]byte, error) {
+	if err := r.startBody(); err != nil {
+		return nil, err
+	}
+	if r.ParserState == DONE {
+		return r.Body, nil
+	}
+	if err := r.endBody(r.readBody()); err != nil {
+		return nil, err
+	}
+	return r.Body, nil
 }
 
-func (r *Request) parseBody(body []byte) (int, bool, error) {
-	value, ok := r.Headers.Get("content-length")
-	if !ok {
-		return 0, true, nil
+// BodyReader returns the body as it comes off the wire, for handlers that
+// pass it on rather than hold it whole. Body is left empty, and ReadBody
+// fails once the stream has been taken. A body that was already read is
+// returned from memory.
+func (r *Request) BodyReader() (io.Reader, error) {
+	if err := r.startBody(); err != nil {
+		return nil, err
 	}
-	r.Body = body
-	val, err := strconv.Atoi(value)
+	if r.ParserState == DONE {
+		return bytes.NewReader(r.Body), nil
+	}
+	src, err := r.bodyReader()
 	if err != nil {
-		return 0, false, fmt.Errorf("invalid content-length, got=%s", value)
+		return nil, r.endBody(err)
+	}
+	r.streaming = true
+	return &bodyStream{r: r, src: src}, nil
+}
+
+// startBody checks the body is still there to read and runs the Start hook
+// the first time.
+func (r *Request) startBody() error {
+	if r.ParserState == DONE {
+		return nil
 	}
-	if len(r.Body) > val {
-		return 0, false, fmt.Errorf("body is too long, expected=%d, got=%d", val, len(r.Body))
+	if r.ParserState != PARSING_BODY {
+		return fmt.Errorf("headers not parsed, \"Parse State\"=%d", r.ParserState)
 	}
-	if len(r.Body) < val {
-		return 0, false, nil
+	if r.streaming {
+		return errBodyStreamed
 	}
-	return val, true, nil
+	hooks := r.hooks
+	r.hooks = BodyHooks{}
+	if hooks.End != nil {
+		r.end = hooks.End
+	}
+	if hooks.Start != nil {
+		return hooks.Start(r)
+	}
+	return nil
+}
+
+// endBody runs the End hook, if there is one left, once the body is off
+// the wire.
+func (r *Request) endBody(err error) error {
+	end := r.end
+	r.end = nil
+	if end != nil {
+		return end(r, err)
+	}
+	return err
+}
+
+func (r *Request) readBody() error {
+	src, err := r.bodyReader()
+	if err != nil {
+		return err
+	}
+	body, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	r.Body = body
+	r.ParserState = DONE
+	return nil
+}
+
+// ExpectsContinue reports whether the client is waiting for 100 Continue
+// before it sends the body.
+func (r *Request) ExpectsContinue() bool {
+	v, ok := r.Headers.Get("expect")
+	return ok && strings.EqualFold(strings.TrimSpace(v), "100-continue")
+}
+
+// DeferBody leaves the body on the wire for the handler to read. The first
+// ReadBody or BodyReader call runs hooks.Start with the request it was
+// called on, which may be a WithContext copy, and hooks.End once the body
+// has been read. A streamed body may be read on another goroutine, and End
+// runs there. The server uses them to send 100 Continue and manage
+// deadlines.
+func (r *Request) DeferBody(hooks BodyHooks) {
+	r.hooks = hooks
+}
+
+// SetBody fills in a body that arrived some other way than the request's
+// reader, as it does over HTTP/2, and marks the request done.
+func (r *Request) SetBody(body []byte) {
+	r.Body = body
+	r.hooks = BodyHooks{}
+	r.end = nil
+	r.ParserState = DONE
+}
+
+// Context is canceled when the client goes away, the server shuts down or
+// the request deadline passes. It is never nil.
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of r using ctx, so handlers can attach
+// values for whatever runs after them.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("nil context")
+	}
+	r2 := new(Request)
+	*r2 = *r
+	r2.ctx = ctx
+	return r2
 }
 
 func parseRequestLine(b []byte) (*RequestLine, int, error) {
@@ -176,15 +341,8 @@ func parseRequestLineString(requestLine string) (*RequestLine, error) {
 		return nil, fmt.Errorf("path must contain at least 1 character, got=%d", len(target))
 	}
 
-	if target[0] != '/' {
-		return nil, fmt.Errorf("path must start with '/', got=%c", target[0])
-	}
-
-	if len(target) > 1 {
-		err := isValidToken(target[1:])
-		if err != nil {
-			return nil, err
-		}
+	if err := validateTarget(method, target); err != nil {
+		return nil, err
 	}
 
 	if httpVer != "HTTP/1.1" {
@@ -199,12 +357,81 @@ func parseRequestLineString(requestLine string) (*RequestLine, error) {
 	}, nil
 }
 
+// validateTarget checks the three request target forms a server meets:
+// origin-form ("/path?query") for ordinary requests, absolute-form
+// ("http://host/path") as sent to proxies, and authority-form ("host:port")
+// for CONNECT alone.
+func validateTarget(method string, target string) error {
+	if method == "CONNECT" {
+		host, port, err := net.SplitHostPort(target)
+		if err != nil || host == "" || port == "" {
+			return fmt.Errorf("CONNECT target must be host:port, got=%s", target)
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return fmt.Errorf("invalid port, got=%s", port)
+		}
+		if strings.Contains(host, ":") {
+			// SplitHostPort has already taken the brackets off an IPv6
+			// literal.
+			if net.ParseIP(host) == nil {
+				return fmt.Errorf("invalid host, got=%s", host)
+			}
+			return nil
+		}
+		return isValidToken(host)
+	}
+	if target[0] == '/' {
+		if len(target) > 1 {
+			return isValidToken(target[1:])
+		}
+		return nil
+	}
+	scheme, rest, ok := strings.Cut(target, "://")
+	if !ok || !isScheme(scheme) || rest == "" || rest[0] == '/' {
+		return fmt.Errorf("path must start with '/', got=%c", target[0])
+	}
+	// Brackets are only valid around an IPv6 host, which comes first.
+	authority, _, _ := strings.Cut(rest, "/")
+	if strings.HasPrefix(authority, "[") {
+		end := strings.IndexByte(authority, ']')
+		if end < 0 || net.ParseIP(authority[1:end]) == nil {
+			return fmt.Errorf("invalid host, got=%s", authority)
+		}
+		rest = rest[end+1:]
+	}
+	return isValidToken(rest)
+}
+
+func isScheme(s string) bool {
+	if s == "" || !(s[0] >= 'a' && s[0] <= 'z' || s[0] >= 'A' && s[0] <= 'Z') {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '+' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// isValidToken accepts the characters RFC 3986 allows in a path and query,
+// with percent signs only as the start of an escape.
 func isValidToken(t string) error {
-	specialChars := []rune{'/', '.', '-'}
-	for _, char := range t {
-		if (char < '0' || char > '9') && (char < 'a' || char > 'z') && !(slices.Contains(specialChars, char)) {
-			return fmt.Errorf("invalid path at %d, got=%s", char, t)
+	for i := 0; i < len(t); i++ {
+		char := t[i]
+		switch {
+		case char >= '0' && char <= '9', char >= 'a' && char <= 'z', char >= 'A' && char <= 'Z':
+		case strings.IndexByte("/.-_~!$&'()*+,;=:@?", char) >= 0:
+		case char == '%' && i+2 < len(t) && isHex(t[i+1]) && isHex(t[i+2]):
+			i += 2
+		default:
+			return fmt.Errorf("invalid path at %d, got=%s", i, t)
 		}
 	}
 	return nil
 }
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
@@ -1,7 +1,11 @@
 package request
 
 import (
+	"bufio"
+	"context"
 	"io"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -268,3 +272,206 @@ func TestRequestLineParse(t *testing.T) {
 	require.NotNil(t, r)
 	assert.Equal(t, "body with ", string(r.Body))
 }
+
+func TestReadRequestPipelined(t *testing.T) {
+	// Test: Two requests on one reader, body left for the caller
+	reader := bufio.NewReader(&chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /next HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"\r\n",
+		numBytesPerRead: 7,
+	})
+	r, err := ReadRequest(reader)
+	require.NoError(t, err)
+	assert.Equal(t, PARSING_BODY, r.ParserState)
+	assert.Nil(t, r.Body)
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, DONE, r.ParserState)
+
+	r, err = ReadRequest(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+	_, err = r.ReadBody()
+	require.NoError(t, err)
+
+	// Test: Clean EOF between requests
+	_, err = ReadRequest(reader)
+	assert.Equal(t, io.EOF, err)
+
+	// Test: Line longer than the reader buffer
+	reader = bufio.NewReaderSize(&chunkReader{
+		data:            "GET /" + strings.Repeat("a", 64) + " HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 64,
+	}, 16)
+	_, err = ReadRequest(reader)
+	assert.ErrorIs(t, err, ErrLineTooLong)
+}
+
+func TestRequestContext(t *testing.T) {
+	// Test: Default context is never nil
+	r, err := RequestFromReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 8,
+	})
+	require.NoError(t, err)
+	require.NotNil(t, r.Context())
+
+	// Test: WithContext copies the request and leaves the original alone
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "value")
+	r2 := r.WithContext(ctx)
+	assert.Equal(t, "value", r2.Context().Value(key{}))
+	assert.Nil(t, r.Context().Value(key{}))
+	assert.Equal(t, r.RequestLine, r2.RequestLine)
+}
+
+func TestRequestTargetCharacters(t *testing.T) {
+	// Test: Capitals, escapes and a query string
+	r, err := RequestFromReader(strings.NewReader("GET /Files/My%20Doc_v2.txt?dl=1&x=~a HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "/Files/My%20Doc_v2.txt?dl=1&x=~a", r.RequestLine.RequestTarget)
+
+	// Test: Broken escapes and spaces-like characters are refused
+	for _, target := range []string{"/a%2", "/a%zz", "/a\"b", "/a<b>", "/a\\b"} {
+		_, err = RequestFromReader(strings.NewReader("GET " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		assert.Error(t, err, target)
+	}
+}
+
+func TestRequestTargetForms(t *testing.T) {
+	// Test: Absolute-form, as sent to a forward proxy
+	r, err := RequestFromReader(strings.NewReader("GET http://example.com:8080/a?b=c HTTP/1.1\r\nHost: example.com:8080\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "http://example.com:8080/a?b=c", r.RequestLine.RequestTarget)
+	r, err = RequestFromReader(strings.NewReader("GET http://[::1]:8080/ HTTP/1.1\r\nHost: [::1]:8080\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "http://[::1]:8080/", r.RequestLine.RequestTarget)
+
+	// Test: Authority-form for CONNECT
+	r, err = RequestFromReader(strings.NewReader("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "example.com:443", r.RequestLine.RequestTarget)
+	_, err = RequestFromReader(strings.NewReader("CONNECT [::1]:443 HTTP/1.1\r\nHost: [::1]:443\r\n\r\n"))
+	require.NoError(t, err)
+
+	// Test: Forms used where they do not belong, and malformed ones
+	for _, line := range []string{
+		"GET example.com:443",
+		"CONNECT /path",
+		"CONNECT example.com",
+		"CONNECT example.com:https",
+		"GET ://example.com/",
+		"GET 1http://example.com/",
+		"GET http:///path",
+		"GET http://[nope]/",
+		"GET http://exa mple.com/",
+	} {
+		_, err = RequestFromReader(strings.NewReader(line + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		assert.Error(t, err, line)
+	}
+}
+
+func TestChunkedBody(t *testing.T) {
+	read := func(raw string) (*Request, *bufio.Reader, error) {
+		reader := bufio.NewReader(&chunkReader{data: raw, numBytesPerRead: 3})
+		r, err := ReadRequest(reader)
+		if err != nil {
+			return nil, reader, err
+		}
+		_, err = r.ReadBody()
+		return r, reader, err
+	}
+
+	// Test: Chunks are joined, extensions and trailers dropped, and the next request left alone
+	r, reader, err := read("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5;name=value\r\nhello\r\n6\r\n world\r\n0\r\nX-Sum: 42\r\n\r\n" +
+		"GET /next HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(r.Body))
+	r, err = ReadRequest(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+
+	// Test: Transfer-Encoding with Content-Length is refused
+	_, _, err = read("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\nContent-Length: 5\r\n\r\n")
+	assert.ErrorIs(t, err, errAmbiguousLength)
+
+	// Test: So is any coding other than chunked
+	_, _, err = read("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: gzip, chunked\r\n\r\n")
+	assert.ErrorIs(t, err, ErrUnsupportedTransferEncoding)
+
+	// Test: Malformed sizes and missing CRLFs
+	_, _, err = read("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n+5\r\nhello\r\n0\r\n\r\n")
+	assert.ErrorIs(t, err, errMalformedChunk)
+	_, _, err = read("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhelloX\r\n0\r\n\r\n")
+	assert.ErrorIs(t, err, errMalformedChunk)
+
+	// Test: A body that stops short
+	_, _, err = read("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhel")
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Chunks past the cap
+	_, _, err = read("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" + strconv.FormatInt(maxChunkedSize+1, 16) + "\r\n")
+	assert.ErrorIs(t, err, ErrContentTooLarge)
+}
+
+func TestBodyReader(t *testing.T) {
+	var ended []error
+	read := func(raw string) (*Request, *bufio.Reader) {
+		reader := bufio.NewReader(&chunkReader{data: raw, numBytesPerRead: 3})
+		r, err := ReadRequest(reader)
+		require.NoError(t, err)
+		r.DeferBody(BodyHooks{End: func(r *Request, err error) error {
+			ended = append(ended, err)
+			return err
+		}})
+		return r, reader
+	}
+
+	// Test: Both framings stream to their end, leaving the next request
+	for _, raw := range []string{
+		"POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 11\r\n\r\nhello world",
+		"POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n",
+	} {
+		ended = nil
+		r, reader := read(raw + "GET /next HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		rd, err := r.BodyReader()
+		require.NoError(t, err)
+		assert.Empty(t, ended)
+		body, err := io.ReadAll(rd)
+		require.NoError(t, err)
+		assert.Equal(t, "hello world", string(body))
+		assert.Equal(t, []error{nil}, ended)
+		assert.Nil(t, r.Body)
+		_, err = r.ReadBody()
+		assert.Error(t, err)
+		next, err := ReadRequest(reader)
+		require.NoError(t, err)
+		assert.Equal(t, "/next", next.RequestLine.RequestTarget)
+	}
+
+	// Test: A body cut short ends with the error
+	ended = nil
+	r, _ := read("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 11\r\n\r\nhello")
+	rd, err := r.BodyReader()
+	require.NoError(t, err)
+	_, err = io.ReadAll(rd)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Len(t, ended, 1)
+
+	// Test: A body already read comes from memory
+	r, _ = read("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello")
+	_, err = r.ReadBody()
+	require.NoError(t, err)
+	rd, err = r.BodyReader()
+	require.NoError(t, err)
+	body, _ := io.ReadAll(rd)
+	assert.Equal(t, "hello", string(body))
+}
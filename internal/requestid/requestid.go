@@ -0,0 +1,52 @@
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+)
+
+// Header carries the ID between clients, this server and upstreams.
+const Header = "X-Request-ID"
+
+// maxLength bounds an ID taken from a client, which ends up in every log
+// line for its request.
+const maxLength = 200
+
+type contextKey struct{}
+
+// New returns a random version 4 UUID.
+func New() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// Valid reports whether id, as sent by a client, is fit to pass on: not
+// empty, not too long and visible ASCII only, so it cannot break a log
+// line or a header.
+func Valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// NewContext returns a copy of ctx carrying id.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the ID of the request ctx belongs to, if the server
+// assigned one.
+func FromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(contextKey{}).(string)
+	return id, ok
+}
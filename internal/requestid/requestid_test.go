@@ -0,0 +1,42 @@
+package requestid
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	// Test: IDs are version 4 UUIDs and do not repeat
+	seen := map[string]bool{}
+	for range 100 {
+		id := New()
+		assert.Regexp(t, uuid, id)
+		assert.False(t, seen[id])
+		seen[id] = true
+	}
+}
+
+func TestValid(t *testing.T) {
+	assert.True(t, Valid("abc-123"))
+	assert.True(t, Valid(New()))
+	assert.False(t, Valid(""))
+	assert.False(t, Valid("has space"))
+	assert.False(t, Valid("line\nbreak"))
+	assert.False(t, Valid("caf\xc3\xa9"))
+	assert.False(t, Valid(strings.Repeat("a", maxLength+1)))
+}
+
+func TestContext(t *testing.T) {
+	_, ok := FromContext(context.Background())
+	assert.False(t, ok)
+
+	id, ok := FromContext(NewContext(context.Background(), "abc"))
+	assert.True(t, ok)
+	assert.Equal(t, "abc", id)
+}
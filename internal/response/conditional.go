@@ -0,0 +1,147 @@
+package response
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Barrioslopezfd/httpfromtcp/internal/headers"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+)
+
+// CheckPreconditions evaluates If-Match, If-Unmodified-Since, If-None-Match
+// and If-Modified-Since in the order RFC 9110 section 13.2.2 gives them,
+// against the current representation's ETag and modification time. Either
+// may be empty or zero when unknown, but the representation must exist, as
+// it does for a 2xx response: "*" matches it either way. It returns 0 when
+// the request should proceed, or NOT_MODIFIED or PRECONDITION_FAILED to
+// answer with instead.
+//
+// Handlers of unsafe methods call it before making a change, so a client
+// holding a stale ETag gets 412 rather than overwriting someone else's edit.
+func CheckPreconditions(r *request.Request, etag string, modTime time.Time) Code {
+	method := r.RequestLine.Method
+	safe := method == "GET" || method == "HEAD"
+	modTime = modTime.Truncate(time.Second)
+
+	if v, ok := r.Headers.Get("if-match"); ok {
+		if !matchETag(v, etag, false) {
+			return PRECONDITION_FAILED
+		}
+	} else if v, ok := r.Headers.Get("if-unmodified-since"); ok && !modTime.IsZero() {
+		if t, err := http.ParseTime(v); err == nil && modTime.After(t) {
+			return PRECONDITION_FAILED
+		}
+	}
+
+	if v, ok := r.Headers.Get("if-none-match"); ok {
+		if matchETag(v, etag, true) {
+			if safe {
+				return NOT_MODIFIED
+			}
+			return PRECONDITION_FAILED
+		}
+	} else if v, ok := r.Headers.Get("if-modified-since"); ok && safe && !modTime.IsZero() {
+		if t, err := http.ParseTime(v); err == nil && !modTime.After(t) {
+			return NOT_MODIFIED
+		}
+	}
+	return 0
+}
+
+// WriteNotModified answers with 304, keeping only the fields RFC 9110 says a
+// 304 should repeat from the 200 it stands for.
+func WriteNotModified(w *Writer, h headers.Headers) error {
+	out := headers.NewHeaders()
+	for _, field := range []string{"cache-control", "content-location", "date", "etag", "expires", "last-modified", "vary"} {
+		if v, ok := h.Get(field); ok {
+			out.Replace(field, v)
+		}
+	}
+	if err := w.WriteStatusLine(NOT_MODIFIED); err != nil {
+		return err
+	}
+	return w.WriteHeaders(out)
+}
+
+// WritePreconditionFailed answers with an empty 412.
+func WritePreconditionFailed(w *Writer) error {
+	if err := w.WriteStatusLine(PRECONDITION_FAILED); err != nil {
+		return err
+	}
+	return w.WriteHeaders(GetDefaultHeaders())
+}
+
+// CodingETag returns the strong etag of a representation sent with a
+// content coding, which RFC 9110 section 8.8.3 says must differ from the
+// uncoded one: "abc" becomes "abc-gzip". Weak tags already allow for it and
+// are returned as they are.
+func CodingETag(etag string, coding string) string {
+	if !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) || len(etag) < 2 {
+		return etag
+	}
+	return etag[:len(etag)-1] + "-" + coding + `"`
+}
+
+// stripCoding undoes CodingETag, so a tag the client got with a compressed
+// response still matches the representation it was compressed from.
+func stripCoding(tag string) string {
+	for _, coding := range []string{"gzip", "deflate"} {
+		if t, ok := strings.CutSuffix(tag, "-"+coding+`"`); ok && !strings.HasPrefix(tag, "W/") {
+			return t + `"`
+		}
+	}
+	return tag
+}
+
+// matchETag reports whether etag is in the list header. "*" matches the
+// representation whether or not it has an etag. Weak comparison ignores the W/ prefix, strong
+// comparison never matches a weak tag. Tags CodingETag added a coding to
+// match the uncoded etag.
+func matchETag(list string, etag string, weak bool) bool {
+	list = strings.TrimSpace(list)
+	if list == "*" {
+		return true
+	}
+	if etag == "" {
+		return false
+	}
+	if !weak && strings.HasPrefix(etag, "W/") {
+		return false
+	}
+	target := strings.TrimPrefix(etag, "W/")
+	for list != "" {
+		var tag string
+		tag, list = scanETag(list)
+		if tag == "" {
+			return false
+		}
+		if !weak && strings.HasPrefix(tag, "W/") {
+			continue
+		}
+		if strings.TrimPrefix(stripCoding(tag), "W/") == target {
+			return true
+		}
+	}
+	return false
+}
+
+// scanETag returns the first entity-tag of a comma separated list and the
+// rest of it, or "" if the list is malformed. Tags may contain commas, so a
+// plain split would not do.
+func scanETag(s string) (tag string, rest string) {
+	s = strings.TrimLeft(s, " \t,")
+	start := 0
+	if strings.HasPrefix(s, "W/") {
+		start = 2
+	}
+	if len(s) < start+2 || s[start] != '"' {
+		return "", ""
+	}
+	end := strings.IndexByte(s[start+1:], '"')
+	if end < 0 {
+		return "", ""
+	}
+	end += start + 2
+	return s[:end], strings.TrimLeft(s[end:], " \t,")
+}
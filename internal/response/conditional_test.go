@@ -0,0 +1,66 @@
+package response
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckPreconditions(t *testing.T) {
+	modTime := time.Date(2024, 5, 6, 7, 8, 9, 500, time.UTC)
+	before := "Mon, 06 May 2024 07:00:00 GMT"
+	same := "Mon, 06 May 2024 07:08:09 GMT"
+	etag := `"abc"`
+
+	tests := []struct {
+		name   string
+		method string
+		header string
+		want   Code
+	}{
+		{"no conditions", "GET", "", 0},
+		{"If-Match hit", "PUT", "If-Match: \"x\", \"abc\"\r\n", 0},
+		{"If-Match miss", "PUT", "If-Match: \"x\"\r\n", PRECONDITION_FAILED},
+		{"If-Match is strong", "PUT", "If-Match: W/\"abc\"\r\n", PRECONDITION_FAILED},
+		{"If-Match coded", "PUT", "If-Match: \"abc-gzip\"\r\n", 0},
+		{"If-Match star", "PUT", "If-Match: *\r\n", 0},
+		{"If-Unmodified-Since passes", "PUT", "If-Unmodified-Since: " + same + "\r\n", 0},
+		{"If-Unmodified-Since fails", "PUT", "If-Unmodified-Since: " + before + "\r\n", PRECONDITION_FAILED},
+		{"If-Match wins over If-Unmodified-Since", "PUT", "If-Match: \"abc\"\r\nIf-Unmodified-Since: " + before + "\r\n", 0},
+		{"If-None-Match hit on GET", "GET", "If-None-Match: W/\"abc\"\r\n", NOT_MODIFIED},
+		{"If-None-Match hit on PUT", "PUT", "If-None-Match: \"abc\"\r\n", PRECONDITION_FAILED},
+		{"If-None-Match coded", "GET", "If-None-Match: \"abc-deflate\"\r\n", NOT_MODIFIED},
+		{"If-None-Match miss", "GET", "If-None-Match: \"x\"\r\n", 0},
+		{"If-None-Match star", "GET", "If-None-Match: *\r\n", NOT_MODIFIED},
+		{"If-Modified-Since not modified", "GET", "If-Modified-Since: " + same + "\r\n", NOT_MODIFIED},
+		{"If-Modified-Since modified", "GET", "If-Modified-Since: " + before + "\r\n", 0},
+		{"If-Modified-Since ignored on POST", "POST", "If-Modified-Since: " + same + "\r\n", 0},
+		{"If-None-Match wins over If-Modified-Since", "GET", "If-None-Match: \"x\"\r\nIf-Modified-Since: " + same + "\r\n", 0},
+		{"If-Match failure comes first", "GET", "If-Match: \"x\"\r\nIf-None-Match: \"abc\"\r\n", PRECONDITION_FAILED},
+		{"bad date is ignored", "GET", "If-Modified-Since: yesterday\r\n", 0},
+	}
+	for _, tt := range tests {
+		r, err := request.RequestFromReader(strings.NewReader(tt.method + " / HTTP/1.1\r\nHost: localhost\r\n" + tt.header + "\r\n"))
+		require.NoError(t, err, tt.name)
+		assert.Equal(t, tt.want, CheckPreconditions(r, etag, modTime), tt.name)
+	}
+
+	// Test: "*" matches a representation that has no ETag
+	r, err := request.RequestFromReader(strings.NewReader("PUT / HTTP/1.1\r\nHost: localhost\r\nIf-Match: *\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, Code(0), CheckPreconditions(r, "", time.Time{}))
+	r, err = request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\nIf-None-Match: *\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, NOT_MODIFIED, CheckPreconditions(r, "", time.Time{}))
+}
+
+func TestCodingETag(t *testing.T) {
+	assert.Equal(t, `"abc-gzip"`, CodingETag(`"abc"`, "gzip"))
+	assert.Equal(t, `W/"abc"`, CodingETag(`W/"abc"`, "gzip"))
+	assert.Equal(t, `"abc"`, stripCoding(CodingETag(`"abc"`, "deflate")))
+	assert.Equal(t, `W/"abc-gzip"`, stripCoding(`W/"abc-gzip"`))
+}
@@ -0,0 +1,287 @@
+package response
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Barrioslopezfd/httpfromtcp/internal/headers"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+)
+
+const sniffLen = 512
+
+var (
+	errInvalidRange  = errors.New("invalid range")
+	errUnsatisfiable = errors.New("range not satisfiable")
+)
+
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+func (br byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", br.start, br.start+br.length-1, size)
+}
+
+// ServeContent replies with content, honoring conditional requests, Range
+// and If-Range. h carries whatever the caller already knows about the
+// representation, such as Content-Type, ETag or Content-Encoding; a missing
+// Content-Type is sniffed. A zero modTime leaves Last-Modified out.
+func ServeContent(w *Writer, r *request.Request, h headers.Headers, modTime time.Time, content io.ReadSeeker) error {
+	if h == nil {
+		h = headers.NewHeaders()
+	}
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		return serveError(w, err)
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return serveError(w, err)
+	}
+
+	if _, ok := h.Get("content-type"); !ok {
+		buf := make([]byte, sniffLen)
+		n, _ := io.ReadFull(content, buf)
+		h.Replace("Content-Type", http.DetectContentType(buf[:n]))
+		if _, err := content.Seek(0, io.SeekStart); err != nil {
+			return serveError(w, err)
+		}
+	}
+	if !modTime.IsZero() && modTime.Unix() > 0 {
+		if _, ok := h.Get("last-modified"); !ok {
+			h.Replace("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+		}
+	}
+	h.Replace("Accept-Ranges", "bytes")
+
+	etag, _ := h.Get("etag")
+	switch CheckPreconditions(r, etag, modTime) {
+	case NOT_MODIFIED:
+		return WriteNotModified(w, h)
+	case PRECONDITION_FAILED:
+		return WritePreconditionFailed(w)
+	}
+
+	var ranges []byteRange
+	method := r.RequestLine.Method
+	if v, ok := r.Headers.Get("range"); ok && (method == "GET" || method == "HEAD") && ifRangeMatches(r, h, modTime) {
+		ranges, err = parseRange(v, size)
+		switch {
+		case errors.Is(err, errInvalidRange):
+			// Syntax the server does not understand is ignored rather than
+			// refused, and so is a request for more bytes than the whole.
+			ranges = nil
+		case err != nil:
+			h.Replace("Content-Range", fmt.Sprintf("bytes */%d", size))
+			h.Replace("Content-Length", "0")
+			h.Remove("Content-Type")
+			if err := w.WriteStatusLine(RANGE_NOT_SATISFIABLE); err != nil {
+				return err
+			}
+			return w.WriteHeaders(h)
+		}
+		if sumLength(ranges) > size {
+			ranges = nil
+		}
+	}
+
+	switch len(ranges) {
+	case 0:
+		h.Replace("Content-Length", strconv.FormatInt(size, 10))
+		return writeContent(w, r, OK, h, func(dst io.Writer) error {
+			_, err := io.CopyN(dst, content, size)
+			return err
+		})
+	case 1:
+		br := ranges[0]
+		h.Replace("Content-Range", br.contentRange(size))
+		h.Replace("Content-Length", strconv.FormatInt(br.length, 10))
+		return writeContent(w, r, PARTIAL_CONTENT, h, func(dst io.Writer) error {
+			if _, err := content.Seek(br.start, io.SeekStart); err != nil {
+				return err
+			}
+			_, err := io.CopyN(dst, content, br.length)
+			return err
+		})
+	}
+
+	contentType, _ := h.Get("content-type")
+	boundary := randomBoundary()
+	partHeader := func(br byteRange) textproto.MIMEHeader {
+		return textproto.MIMEHeader{
+			"Content-Type":  {contentType},
+			"Content-Range": {br.contentRange(size)},
+		}
+	}
+	// Part headers and boundaries are rendered once without bodies to learn
+	// the total length up front.
+	counter := &countingWriter{}
+	mw := multipart.NewWriter(counter)
+	mw.SetBoundary(boundary)
+	for _, br := range ranges {
+		mw.CreatePart(partHeader(br))
+		counter.n += br.length
+	}
+	mw.Close()
+
+	h.Replace("Content-Type", "multipart/byteranges; boundary="+boundary)
+	h.Replace("Content-Length", strconv.FormatInt(counter.n, 10))
+	return writeContent(w, r, PARTIAL_CONTENT, h, func(dst io.Writer) error {
+		mw := multipart.NewWriter(dst)
+		mw.SetBoundary(boundary)
+		for _, br := range ranges {
+			part, err := mw.CreatePart(partHeader(br))
+			if err != nil {
+				return err
+			}
+			if _, err := content.Seek(br.start, io.SeekStart); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(part, content, br.length); err != nil {
+				return err
+			}
+		}
+		return mw.Close()
+	})
+}
+
+func writeContent(w *Writer, r *request.Request, code Code, h headers.Headers, body func(dst io.Writer) error) error {
+	if err := w.WriteStatusLine(code); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return err
+	}
+	if r.RequestLine.Method == "HEAD" {
+		return nil
+	}
+	return body(bodyWriter{w})
+}
+
+func serveError(w *Writer, err error) error {
+	if werr := w.WriteStatusLine(INTERNAL_SERVER_ERROR); werr == nil {
+		w.WriteHeaders(GetDefaultHeaders())
+	}
+	return err
+}
+
+// ifRangeMatches reports whether a Range request may be answered with parts:
+// when If-Range is absent or still names the current representation. Only a
+// strong ETag or an exact Last-Modified date counts as a match.
+func ifRangeMatches(r *request.Request, h headers.Headers, modTime time.Time) bool {
+	v, ok := r.Headers.Get("if-range")
+	if !ok {
+		return true
+	}
+	v = strings.TrimSpace(v)
+	if strings.HasPrefix(v, `"`) || strings.HasPrefix(v, "W/") {
+		etag, _ := h.Get("etag")
+		return !strings.HasPrefix(v, "W/") && v == etag
+	}
+	t, err := http.ParseTime(v)
+	return err == nil && !modTime.IsZero() && modTime.Truncate(time.Second).Equal(t)
+}
+
+// parseRange parses a "bytes=" Range value against a representation of size
+// bytes. Ranges past the end are dropped and errUnsatisfiable is returned if
+// none are left. Malformed values return errInvalidRange.
+func parseRange(v string, size int64) ([]byteRange, error) {
+	unit, specs, ok := strings.Cut(v, "=")
+	if !ok || strings.TrimSpace(unit) != "bytes" {
+		return nil, errInvalidRange
+	}
+	var ranges []byteRange
+	sawSpec := false
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		sawSpec = true
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, errInvalidRange
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		var br byteRange
+		if first == "" {
+			// Suffix range: the last n bytes.
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errInvalidRange
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			n = min(n, size)
+			br = byteRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errInvalidRange
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, errInvalidRange
+				}
+			}
+			if start >= size {
+				continue
+			}
+			end = min(end, size-1)
+			br = byteRange{start: start, length: end - start + 1}
+		}
+		ranges = append(ranges, br)
+	}
+	if !sawSpec {
+		return nil, errInvalidRange
+	}
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiable
+	}
+	return ranges, nil
+}
+
+func sumLength(ranges []byteRange) int64 {
+	var n int64
+	for _, br := range ranges {
+		n += br.length
+	}
+	return n
+}
+
+func randomBoundary() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+type bodyWriter struct {
+	w *Writer
+}
+
+func (bw bodyWriter) Write(p []byte) (int, error) {
+	return bw.w.WriteBody(p)
+}
@@ -0,0 +1,117 @@
+package response
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Barrioslopezfd/httpfromtcp/internal/headers"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const content = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+var modTime = time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+
+func serve(t *testing.T, method string, extra string) (*http.Response, string) {
+	t.Helper()
+	r, err := request.RequestFromReader(strings.NewReader(method + " /file HTTP/1.1\r\nHost: localhost\r\n" + extra + "\r\n"))
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	h := headers.NewHeaders()
+	h.Replace("Content-Type", "text/plain")
+	h.Replace("ETag", `"v1"`)
+	require.NoError(t, ServeContent(&Writer{Writer: buf}, r, h, modTime, strings.NewReader(content)))
+
+	res, err := http.ReadResponse(bufio.NewReader(buf), &http.Request{Method: method})
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res, string(body)
+}
+
+func TestServeContent(t *testing.T) {
+	// Test: No Range gets the whole thing
+	res, body := serve(t, "GET", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, content, body)
+	assert.Equal(t, "bytes", res.Header.Get("Accept-Ranges"))
+	assert.Equal(t, "Mon, 06 May 2024 07:08:09 GMT", res.Header.Get("Last-Modified"))
+
+	// Test: Single ranges, open-ended and suffix
+	for header, want := range map[string]string{
+		"bytes=0-4":    "01234",
+		"bytes=30-":    "uvwxyz",
+		"bytes=-3":     "xyz",
+		"bytes=34-100": "yz",
+	} {
+		res, body = serve(t, "GET", "Range: "+header+"\r\n")
+		assert.Equal(t, 206, res.StatusCode, header)
+		assert.Equal(t, want, body, header)
+	}
+	res, _ = serve(t, "GET", "Range: bytes=10-19\r\n")
+	assert.Equal(t, "bytes 10-19/36", res.Header.Get("Content-Range"))
+	assert.Equal(t, int64(10), res.ContentLength)
+
+	// Test: Multiple ranges come back as multipart/byteranges
+	res, body = serve(t, "GET", "Range: bytes=0-1, 10-11, -2\r\n")
+	assert.Equal(t, 206, res.StatusCode)
+	assert.Equal(t, int64(len(body)), res.ContentLength)
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+	mr := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	var parts, ranges []string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		b, _ := io.ReadAll(part)
+		parts = append(parts, string(b))
+		ranges = append(ranges, part.Header.Get("Content-Range"))
+		assert.Equal(t, "text/plain", part.Header.Get("Content-Type"))
+	}
+	assert.Equal(t, []string{"01", "ab", "yz"}, parts)
+	assert.Equal(t, []string{"bytes 0-1/36", "bytes 10-11/36", "bytes 34-35/36"}, ranges)
+
+	// Test: Unsatisfiable ranges get 416
+	res, _ = serve(t, "GET", "Range: bytes=36-40\r\n")
+	assert.Equal(t, 416, res.StatusCode)
+	assert.Equal(t, "bytes */36", res.Header.Get("Content-Range"))
+
+	// Test: Malformed ranges are ignored
+	for _, header := range []string{"bytes=5-1", "items=0-1", "bytes=abc", "bytes="} {
+		res, body = serve(t, "GET", "Range: "+header+"\r\n")
+		assert.Equal(t, 200, res.StatusCode, header)
+		assert.Equal(t, content, body, header)
+	}
+
+	// Test: If-Range with the current ETag or date keeps the range
+	res, _ = serve(t, "GET", "Range: bytes=0-1\r\nIf-Range: \"v1\"\r\n")
+	assert.Equal(t, 206, res.StatusCode)
+	res, _ = serve(t, "GET", "Range: bytes=0-1\r\nIf-Range: Mon, 06 May 2024 07:08:09 GMT\r\n")
+	assert.Equal(t, 206, res.StatusCode)
+
+	// Test: A stale or weak If-Range gets the full body
+	for _, header := range []string{`"v0"`, `W/"v1"`, "Mon, 06 May 2024 07:00:00 GMT"} {
+		res, body = serve(t, "GET", "Range: bytes=0-1\r\nIf-Range: "+header+"\r\n")
+		assert.Equal(t, 200, res.StatusCode, header)
+		assert.Equal(t, content, body, header)
+	}
+
+	// Test: HEAD gets the headers of the range without a body
+	res, body = serve(t, "HEAD", "Range: bytes=0-4\r\n")
+	assert.Equal(t, 206, res.StatusCode)
+	assert.Equal(t, "bytes 0-4/36", res.Header.Get("Content-Range"))
+	assert.Empty(t, body)
+}
@@ -1,8 +1,13 @@
 package response
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"net"
+	"net/http"
+	"time"
 
 	"github.com/Barrioslopezfd/httpfromtcp/internal/headers"
 )
@@ -10,15 +15,55 @@ import (
 type Code int
 
 const (
-	OK                    Code = 200
-	BAD_REQUEST           Code = 400
-	INTERNAL_SERVER_ERROR Code = 500
+	CONTINUE               Code = 100
+	SWITCHING_PROTOCOLS    Code = 101
+	EARLY_HINTS            Code = 103
+	OK                     Code = 200
+	PARTIAL_CONTENT        Code = 206
+	MOVED_PERMANENTLY      Code = 301
+	NOT_MODIFIED           Code = 304
+	BAD_REQUEST            Code = 400
+	FORBIDDEN              Code = 403
+	NOT_FOUND              Code = 404
+	METHOD_NOT_ALLOWED     Code = 405
+	PROXY_AUTH_REQUIRED    Code = 407
+	REQUEST_TIMEOUT        Code = 408
+	PRECONDITION_FAILED    Code = 412
+	CONTENT_TOO_LARGE      Code = 413
+	UNSUPPORTED_MEDIA_TYPE Code = 415
+	RANGE_NOT_SATISFIABLE  Code = 416
+	UPGRADE_REQUIRED       Code = 426
+	INTERNAL_SERVER_ERROR  Code = 500
+	NOT_IMPLEMENTED        Code = 501
+	BAD_GATEWAY            Code = 502
+	SERVICE_UNAVAILABLE    Code = 503
+	GATEWAY_TIMEOUT        Code = 504
 )
 
 var statusCode = map[Code]string{
-	OK:                    "HTTP/1.1 200 OK",
-	BAD_REQUEST:           "HTTP/1.1 400 Bad Request",
-	INTERNAL_SERVER_ERROR: "HTTP/1.1 500 Internal Server Error",
+	CONTINUE:               "HTTP/1.1 100 Continue",
+	SWITCHING_PROTOCOLS:    "HTTP/1.1 101 Switching Protocols",
+	EARLY_HINTS:            "HTTP/1.1 103 Early Hints",
+	OK:                     "HTTP/1.1 200 OK",
+	PARTIAL_CONTENT:        "HTTP/1.1 206 Partial Content",
+	MOVED_PERMANENTLY:      "HTTP/1.1 301 Moved Permanently",
+	NOT_MODIFIED:           "HTTP/1.1 304 Not Modified",
+	BAD_REQUEST:            "HTTP/1.1 400 Bad Request",
+	FORBIDDEN:              "HTTP/1.1 403 Forbidden",
+	NOT_FOUND:              "HTTP/1.1 404 Not Found",
+	METHOD_NOT_ALLOWED:     "HTTP/1.1 405 Method Not Allowed",
+	PROXY_AUTH_REQUIRED:    "HTTP/1.1 407 Proxy Authentication Required",
+	REQUEST_TIMEOUT:        "HTTP/1.1 408 Request Timeout",
+	PRECONDITION_FAILED:    "HTTP/1.1 412 Precondition Failed",
+	CONTENT_TOO_LARGE:      "HTTP/1.1 413 Content Too Large",
+	UNSUPPORTED_MEDIA_TYPE: "HTTP/1.1 415 Unsupported Media Type",
+	RANGE_NOT_SATISFIABLE:  "HTTP/1.1 416 Range Not Satisfiable",
+	UPGRADE_REQUIRED:       "HTTP/1.1 426 Upgrade Required",
+	INTERNAL_SERVER_ERROR:  "HTTP/1.1 500 Internal Server Error",
+	NOT_IMPLEMENTED:        "HTTP/1.1 501 Not Implemented",
+	BAD_GATEWAY:            "HTTP/1.1 502 Bad Gateway",
+	SERVICE_UNAVAILABLE:    "HTTP/1.1 503 Service Unavailable",
+	GATEWAY_TIMEOUT:        "HTTP/1.1 504 Gateway Timeout",
 }
 
 type state int
@@ -29,30 +74,92 @@ const (
 	BODY
 )
 
+// Sink receives a response as structured parts instead of HTTP/1.1 bytes.
+// Protocols with their own framing, such as HTTP/2, set one on the Writer so
+// handlers can be written once for every protocol. Chunk framing is the
+// sink's business: chunked and plain bodies both arrive through WriteData.
+type Sink interface {
+	WriteInformational(code Code, h headers.Headers) error
+	WriteHead(code Code, h headers.Headers) error
+	WriteData(p []byte) (int, error)
+	WriteTrailers(h headers.Headers) error
+}
+
+var (
+	ErrHijacked            = errors.New("connection has been hijacked")
+	ErrHijackUnsupported   = errors.New("connection cannot be hijacked")
+	ErrDeadlineUnsupported = errors.New("write deadline cannot be set")
+)
+
+// Hijacker is implemented by writers whose connection a handler may take
+// over, as protocol upgrades and CONNECT tunnels do. The returned bytes were
+// already read from the connection but not consumed by the request.
+type Hijacker interface {
+	Hijack() (net.Conn, []byte, error)
+}
+
 type Writer struct {
-	Writer      io.Writer
+	Writer io.Writer
+	Sink   Sink
+	// Extra headers go out with the final response unless the handler sets
+	// them itself, as the server does with the request ID.
+	Extra       headers.Headers
 	writerState state
+
+	status  Code
+	headers headers.Headers
+	written int
 }
 
 func (w *Writer) WriteStatusLine(code Code) error {
 	if w.writerState != STATUS_LINE {
 		return fmt.Errorf("error, you have to start from the status line")
 	}
-	msg, ok := statusCode[code]
-	if !ok {
-		msg = fmt.Sprintf("HTTP/1.1 %d ", code)
-	}
-
-	msg += "\r\n"
-	if _, err := w.Writer.Write([]byte(msg)); err != nil {
-		return err
+	if w.Sink == nil {
+		msg := statusLine(code) + "\r\n"
+		if _, err := w.Writer.Write([]byte(msg)); err != nil {
+			return err
+		}
 	}
 
 	w.writerState = HEADERS
+	w.status = code
 
 	return nil
 }
 
+// WriteInformational sends an interim 1xx response, such as 103 Early Hints,
+// ahead of the final status line. It may be called any number of times
+// before WriteStatusLine. 101 is final for the connection and goes through
+// WriteStatusLine instead.
+func (w *Writer) WriteInformational(code Code, h headers.Headers) error {
+	if w.writerState != STATUS_LINE {
+		return fmt.Errorf("error, informational responses must precede the status line")
+	}
+	if code < 100 || code > 199 || code == SWITCHING_PROTOCOLS {
+		return fmt.Errorf("error, %d is not an informational status", code)
+	}
+	if w.Sink != nil {
+		return w.Sink.WriteInformational(code, h)
+	}
+	buf := []byte(statusLine(code) + "\r\n")
+	for key, value := range h {
+		buf = fmt.Appendf(buf, "%s: %s\r\n", key, value)
+	}
+	buf = append(buf, "\r\n"...)
+	_, err := w.Writer.Write(buf)
+	return err
+}
+
+// statusLine falls back on the standard reason phrase for codes without a
+// constant, which a proxy may relay from upstream.
+func statusLine(code Code) string {
+	if msg, ok := statusCode[code]; ok {
+		return msg
+	}
+	return fmt.Sprintf("HTTP/1.1 %d %s", code, http.StatusText(int(code)))
+}
+
 func GetDefaultHeaders() headers.Headers {
 	h := headers.NewHeaders()
 
@@ -66,6 +173,19 @@ func (w *Writer) WriteHeaders(headers headers.Headers) error {
 	if w.writerState != HEADERS {
 		return fmt.Errorf("trying to write to header without write header state")
 	}
+	if len(w.Extra) > 0 {
+		merged := maps.Clone(w.Extra)
+		maps.Copy(merged, headers)
+		headers = merged
+	}
+	if w.Sink != nil {
+		if err := w.Sink.WriteHead(w.status, headers); err != nil {
+			return err
+		}
+		w.writerState = BODY
+		w.headers = headers
+		return nil
+	}
 	for key, value := range headers {
 		_, err := w.Writer.Write(fmt.Appendf(nil, "%s: %s\r\n", key, value))
 		if err != nil {
@@ -77,6 +197,7 @@ func (w *Writer) WriteHeaders(headers headers.Headers) error {
 		return fmt.Errorf("error while writing headers, err=%s", err.Error())
 	}
 	w.writerState = BODY
+	w.headers = headers
 	return nil
 }
 
@@ -84,9 +205,15 @@ func (w *Writer) WriteBody(body []byte) (int, error) {
 	if w.writerState != BODY {
 		return 0, fmt.Errorf("error, headers not found")
 	}
+	if w.Sink != nil {
+		n, err := w.Sink.WriteData(body)
+		w.written += n
+		return n, err
+	}
 	n, err := w.Writer.Write(body)
+	w.written += n
 	if err != nil {
-		return 0, fmt.Errorf("error writing body, err=%s", err.Error())
+		return n, fmt.Errorf("error writing body, err=%s", err.Error())
 	}
 	return n, nil
 }
@@ -95,6 +222,11 @@ func (w *Writer) WriteChunkedBody(body []byte) (int, error) {
 	if w.writerState != BODY {
 		return 0, fmt.Errorf("error, headers not found")
 	}
+	if w.Sink != nil {
+		n, err := w.Sink.WriteData(body)
+		w.written += n
+		return n, err
+	}
 	total := 0
 	lengthLine := fmt.Sprintf("%x\r\n", len(body))
 	read, err := w.Writer.Write(fmt.Appendf(nil, lengthLine))
@@ -103,6 +235,7 @@ func (w *Writer) WriteChunkedBody(body []byte) (int, error) {
 	}
 	total += read
 	read, err = w.Writer.Write(body)
+	w.written += read
 	if err != nil {
 		return total, err
 	}
@@ -119,10 +252,16 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
 	if w.writerState != BODY {
 		return 0, fmt.Errorf("error, headers not found")
 	}
+	if w.Sink != nil {
+		return 0, nil
+	}
 	return w.Writer.Write([]byte("0\r\n"))
 }
 
 func (w *Writer) WriteTrailers(h headers.Headers) error {
+	if w.Sink != nil {
+		return w.Sink.WriteTrailers(h)
+	}
 	buffer := ""
 	for key, value := range h {
 		buffer += fmt.Sprintf("%s: %s\r\n", key, value)
@@ -131,3 +270,49 @@ func (w *Writer) WriteTrailers(h headers.Headers) error {
 	_, err := w.Writer.Write([]byte(buffer))
 	return err
 }
+
+func (w *Writer) Status() Code {
+	return w.status
+}
+
+func (w *Writer) SentHeaders() headers.Headers {
+	return w.headers
+}
+
+// BytesWritten counts body bytes only, without chunk framing or trailers.
+func (w *Writer) BytesWritten() int {
+	return w.written
+}
+
+// Deadliner is implemented by writers and sinks whose write timeout a
+// long-lived response, such as an event stream, may push back. Middleware
+// sinks pass it on to the Writer they wrap.
+type Deadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// SetWriteDeadline moves the deadline for writes to the client to t, through
+// the Sink if there is one.
+func (w *Writer) SetWriteDeadline(t time.Time) error {
+	var d Deadliner
+	var ok bool
+	if w.Sink != nil {
+		d, ok = w.Sink.(Deadliner)
+	} else {
+		d, ok = w.Writer.(Deadliner)
+	}
+	if !ok {
+		return ErrDeadlineUnsupported
+	}
+	return d.SetWriteDeadline(t)
+}
+
+// Hijack takes the connection away from the server. Whatever was written
+// before is already on the wire; nothing can be written through w after.
+func (w *Writer) Hijack() (net.Conn, []byte, error) {
+	h, ok := w.Writer.(Hijacker)
+	if w.Sink != nil || !ok {
+		return nil, nil, ErrHijackUnsupported
+	}
+	return h.Hijack()
+}
@@ -0,0 +1,201 @@
+package sse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Barrioslopezfd/httpfromtcp/internal/headers"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/response"
+)
+
+const (
+	defaultHeartbeat    = 15 * time.Second
+	defaultWriteTimeout = 10 * time.Second
+)
+
+var ErrClosed = errors.New("sse: stream closed")
+
+type Config struct {
+	// Heartbeat is how often a comment is sent to keep proxies from timing
+	// out an idle stream. Zero means 15 seconds, a negative value disables it.
+	Heartbeat time.Duration
+	// WriteTimeout bounds each write to the client. Zero means 10 seconds.
+	WriteTimeout time.Duration
+}
+
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	// Retry tells the client how long to wait before reconnecting. Zero
+	// leaves the field out.
+	Retry time.Duration
+}
+
+// Writer streams events to one client. It is safe for concurrent use.
+type Writer struct {
+	w            *response.Writer
+	ctx          context.Context
+	lastEventID  string
+	writeTimeout time.Duration
+
+	mu     sync.Mutex
+	closed bool
+	stop   chan struct{}
+}
+
+// NewWriter writes the event-stream response head and starts the heartbeat.
+// The stream ends when Close is called or the request context is canceled,
+// which happens when the client disconnects.
+func NewWriter(w *response.Writer, r *request.Request, cfg Config) (*Writer, error) {
+	sw := &Writer{
+		w:            w,
+		ctx:          r.Context(),
+		writeTimeout: cfg.WriteTimeout,
+		stop:         make(chan struct{}),
+	}
+	sw.lastEventID, _ = r.Headers.Get("last-event-id")
+	if sw.writeTimeout <= 0 {
+		sw.writeTimeout = defaultWriteTimeout
+	}
+
+	h := headers.NewHeaders()
+	h.Replace("Content-Type", "text/event-stream")
+	h.Replace("Cache-Control", "no-cache")
+	h.Replace("Transfer-Encoding", "chunked")
+	sw.extendDeadline()
+	if err := w.WriteStatusLine(response.OK); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+
+	heartbeat := cfg.Heartbeat
+	if heartbeat == 0 {
+		heartbeat = defaultHeartbeat
+	}
+	go sw.run(heartbeat)
+	return sw, nil
+}
+
+// LastEventID is the id the client last saw before reconnecting, or "" on
+// a fresh connection.
+func (sw *Writer) LastEventID() string {
+	return sw.lastEventID
+}
+
+// Done is closed once the stream can no longer be written to.
+func (sw *Writer) Done() <-chan struct{} {
+	return sw.stop
+}
+
+func (sw *Writer) run(heartbeat time.Duration) {
+	var tick <-chan time.Time
+	if heartbeat > 0 {
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+			if err := sw.Comment("heartbeat"); err != nil {
+				sw.Close()
+				return
+			}
+		case <-sw.ctx.Done():
+			sw.Close()
+			return
+		case <-sw.stop:
+			return
+		}
+	}
+}
+
+// Send writes one event. Multi-line data is split into several data fields
+// so the client gets it back with the line breaks intact.
+func (sw *Writer) Send(ev Event) error {
+	if strings.ContainsAny(ev.ID, "\r\n\x00") {
+		return fmt.Errorf("sse: invalid event id %q", ev.ID)
+	}
+	if strings.ContainsAny(ev.Event, "\r\n") {
+		return fmt.Errorf("sse: invalid event name %q", ev.Event)
+	}
+
+	var b strings.Builder
+	if ev.ID != "" {
+		b.WriteString("id: " + ev.ID + "\n")
+	}
+	if ev.Event != "" {
+		b.WriteString("event: " + ev.Event + "\n")
+	}
+	if ev.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(ev.Retry.Milliseconds(), 10) + "\n")
+	}
+	for _, line := range splitLines(ev.Data) {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	return sw.write(b.String())
+}
+
+// Comment writes a line the client ignores.
+func (sw *Writer) Comment(text string) error {
+	var b strings.Builder
+	for _, line := range splitLines(text) {
+		b.WriteString(": " + line + "\n")
+	}
+	b.WriteString("\n")
+	return sw.write(b.String())
+}
+
+func splitLines(s string) []string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+	return strings.Split(s, "\n")
+}
+
+func (sw *Writer) write(s string) error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.closed {
+		return ErrClosed
+	}
+	if err := sw.ctx.Err(); err != nil {
+		return err
+	}
+	sw.extendDeadline()
+	_, err := sw.w.WriteChunkedBody([]byte(s))
+	return err
+}
+
+func (sw *Writer) extendDeadline() {
+	sw.w.SetWriteDeadline(time.Now().Add(sw.writeTimeout))
+}
+
+// Close ends the stream. It is called automatically when the client goes
+// away, and calling it more than once is harmless.
+func (sw *Writer) Close() error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.closed {
+		return nil
+	}
+	sw.closed = true
+	close(sw.stop)
+	if sw.ctx.Err() != nil {
+		return nil
+	}
+	sw.extendDeadline()
+	if _, err := sw.w.WriteChunkedBodyDone(); err != nil {
+		return err
+	}
+	return sw.w.WriteTrailers(headers.NewHeaders())
+}
@@ -0,0 +1,130 @@
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	server "github.com/Barrioslopezfd/httpfromtcp/cmd/server"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/compress"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/etag"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventFormat(t *testing.T) {
+	r, err := request.RequestFromReader(strings.NewReader("GET /events HTTP/1.1\r\nHost: localhost\r\nLast-Event-ID: 41\r\n\r\n"))
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	buf := &bytes.Buffer{}
+	sw, err := NewWriter(&response.Writer{Writer: buf}, r, Config{Heartbeat: -1})
+	require.NoError(t, err)
+
+	// Test: Last-Event-ID is read from the request
+	assert.Equal(t, "41", sw.LastEventID())
+
+	// Test: All fields, with data split on every kind of line break
+	require.NoError(t, sw.Send(Event{ID: "42", Event: "update", Data: "a\nb\r\nc\rd", Retry: 3 * time.Second}))
+	assert.Contains(t, buf.String(), "id: 42\nevent: update\nretry: 3000\ndata: a\ndata: b\ndata: c\ndata: d\n\n")
+
+	// Test: Ids with line breaks are refused
+	assert.Error(t, sw.Send(Event{ID: "4\n2", Data: "x"}))
+
+	// Test: Canceling the context ends the stream
+	cancel()
+	select {
+	case <-sw.Done():
+	case <-time.After(time.Second):
+		t.Fatal("stream not closed after cancel")
+	}
+	assert.ErrorIs(t, sw.Send(Event{Data: "late"}), ErrClosed)
+}
+
+func TestStream(t *testing.T) {
+	finished := make(chan struct{})
+	handler := func(w *response.Writer, r *request.Request) {
+		defer close(finished)
+		sw, err := NewWriter(w, r, Config{Heartbeat: 20 * time.Millisecond})
+		if err != nil {
+			return
+		}
+		defer sw.Close()
+		sw.Send(Event{ID: "1", Data: "hello"})
+		<-sw.Done()
+	}
+	srv, err := server.Serve(handler, 0)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("GET /events HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+
+	// Test: Event stream head, the event and at least one heartbeat
+	reader := bufio.NewReader(conn)
+	var got strings.Builder
+	for !strings.Contains(got.String(), ": heartbeat\n") {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		got.WriteString(line)
+	}
+	assert.True(t, strings.HasPrefix(got.String(), "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, got.String(), "content-type: text/event-stream\r\n")
+	assert.Contains(t, got.String(), "id: 1\ndata: hello\n\n")
+
+	// Test: The handler returns once the client disconnects
+	conn.Close()
+	select {
+	case <-finished:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler still running after disconnect")
+	}
+}
+
+func TestStreamBehindMiddleware(t *testing.T) {
+	handler := func(w *response.Writer, r *request.Request) {
+		sw, err := NewWriter(w, r, Config{Heartbeat: -1})
+		if err != nil {
+			return
+		}
+		defer sw.Close()
+		for i := range 6 {
+			time.Sleep(50 * time.Millisecond)
+			if err := sw.Send(Event{ID: strconv.Itoa(i), Data: "tick"}); err != nil {
+				return
+			}
+		}
+	}
+	wrapped := compress.New(etag.New(handler, etag.Config{}), compress.Config{})
+	srv, err := server.Serve(wrapped, 0, server.WithWriteTimeout(100*time.Millisecond))
+	require.NoError(t, err)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("GET /events HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n"))
+	require.NoError(t, err)
+
+	// Test: Events keep flowing past the server's write timeout
+	reader := bufio.NewReader(conn)
+	var got strings.Builder
+	for !strings.Contains(got.String(), "id: 5\n") {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err, got.String())
+		got.WriteString(line)
+	}
+}
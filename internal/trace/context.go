@@ -0,0 +1,186 @@
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrInvalidTraceparent = errors.New("trace: invalid traceparent")
+	ErrInvalidTracestate  = errors.New("trace: invalid tracestate")
+)
+
+const (
+	traceparentLen  = 55
+	maxStateMembers = 32
+	maxStateValue   = 256
+	flagSampled     = 0x01
+)
+
+type TraceID [16]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id TraceID) IsValid() bool {
+	return id != TraceID{}
+}
+
+type SpanID [8]byte
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id SpanID) IsValid() bool {
+	return id != SpanID{}
+}
+
+// SpanContext is the part of a span that crosses process boundaries, in
+// the traceparent and tracestate headers.
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Sampled    bool
+	TraceState string
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent formats sc as a version 00 traceparent header.
+func (sc SpanContext) Traceparent() string {
+	var flags byte
+	if sc.Sampled {
+		flags |= flagSampled
+	}
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceparent reads a traceparent header. Versions after 00 are read
+// as far as 00 defines them, as the spec asks, and the sampled flag is the
+// only one kept.
+func ParseTraceparent(v string) (SpanContext, error) {
+	var sc SpanContext
+	if len(v) < traceparentLen || v[2] != '-' || v[35] != '-' || v[52] != '-' {
+		return sc, ErrInvalidTraceparent
+	}
+	version, ok := decodeHex(v[:2])
+	if !ok || version[0] == 0xff {
+		return sc, ErrInvalidTraceparent
+	}
+	if version[0] == 0 && len(v) != traceparentLen {
+		return sc, ErrInvalidTraceparent
+	}
+	if len(v) > traceparentLen && v[traceparentLen] != '-' {
+		return sc, ErrInvalidTraceparent
+	}
+	traceID, ok1 := decodeHex(v[3:35])
+	spanID, ok2 := decodeHex(v[36:52])
+	flags, ok3 := decodeHex(v[53:55])
+	if !ok1 || !ok2 || !ok3 {
+		return sc, ErrInvalidTraceparent
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Sampled = flags[0]&flagSampled != 0
+	if !sc.IsValid() {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	return sc, nil
+}
+
+// decodeHex only takes lowercase hex, which is all traceparent allows.
+func decodeHex(s string) ([]byte, bool) {
+	if strings.ToLower(s) != s {
+		return nil, false
+	}
+	b, err := hex.DecodeString(s)
+	return b, err == nil
+}
+
+// ParseTracestate checks a tracestate header and returns it with empty
+// list members and surrounding whitespace dropped.
+func ParseTracestate(v string) (string, error) {
+	var members []string
+	seen := map[string]bool{}
+	for _, member := range strings.Split(v, ",") {
+		member = strings.Trim(member, " \t")
+		if member == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(member, "=")
+		if !ok || !validStateKey(key) || !validStateValue(value) || seen[key] {
+			return "", ErrInvalidTracestate
+		}
+		seen[key] = true
+		members = append(members, member)
+	}
+	if len(members) > maxStateMembers {
+		return "", ErrInvalidTracestate
+	}
+	return strings.Join(members, ","), nil
+}
+
+// validStateKey accepts a simple key, or a multi-tenant tenant@system one.
+func validStateKey(key string) bool {
+	tenant, system, multi := strings.Cut(key, "@")
+	if !multi {
+		return len(key) <= 256 && validKeyPart(key, true)
+	}
+	return len(tenant) <= 241 && len(system) <= 14 &&
+		validKeyPart(tenant, false) && validKeyPart(system, true)
+}
+
+func validKeyPart(s string, letterFirst bool) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		lower, digit := c >= 'a' && c <= 'z', c >= '0' && c <= '9'
+		if i == 0 {
+			if !lower && (letterFirst || !digit) {
+				return false
+			}
+			continue
+		}
+		if !lower && !digit && c != '_' && c != '-' && c != '*' && c != '/' {
+			return false
+		}
+	}
+	return true
+}
+
+func validStateValue(v string) bool {
+	if v == "" || len(v) > maxStateValue || v[len(v)-1] == ' ' {
+		return false
+	}
+	for i := 0; i < len(v); i++ {
+		if c := v[i]; c < 0x20 || c > 0x7e || c == ',' || c == '=' {
+			return false
+		}
+	}
+	return true
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
@@ -0,0 +1,66 @@
+package trace
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	// Test: A valid header round trips
+	v := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(v)
+	require.NoError(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.True(t, sc.Sampled)
+	assert.Equal(t, v, sc.Traceparent())
+
+	// Test: Unsampled, and unknown flags dropped
+	sc, err = ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-fe")
+	require.NoError(t, err)
+	assert.False(t, sc.Sampled)
+
+	// Test: Later versions are read as far as version 00 goes
+	sc, err = ParseTraceparent("cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-what-the-future-holds")
+	require.NoError(t, err)
+	assert.True(t, sc.Sampled)
+
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-0x",
+		"00_4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7_01",
+		"cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01x",
+	} {
+		_, err := ParseTraceparent(bad)
+		assert.ErrorIs(t, err, ErrInvalidTraceparent, bad)
+	}
+}
+
+func TestParseTracestate(t *testing.T) {
+	// Test: Valid lists are kept, with blank members and spaces dropped
+	v, err := ParseTracestate("rojo=00f067aa0ba902b7, ,congo=t61rcWkgMzE, tenant@vendor=x ")
+	require.NoError(t, err)
+	assert.Equal(t, "rojo=00f067aa0ba902b7,congo=t61rcWkgMzE,tenant@vendor=x", v)
+
+	for _, bad := range []string{
+		"novalue",
+		"Upper=1",
+		"rojo=a,rojo=b",
+		"rojo=a=b",
+		"rojo=a\tb",
+		"@vendor=x",
+		strings.Repeat("k", 257) + "=v",
+		strings.Repeat("a=1,", 33),
+	} {
+		_, err := ParseTracestate(bad)
+		assert.ErrorIs(t, err, ErrInvalidTracestate, bad)
+	}
+}
@@ -0,0 +1,380 @@
+package trace
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	server "github.com/Barrioslopezfd/httpfromtcp/cmd/server"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/response"
+)
+
+const (
+	defaultServiceName   = "httpfromtcp"
+	defaultBatchSize     = 512
+	defaultFlushInterval = 5 * time.Second
+)
+
+// SpanKind values are OTLP's.
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+// StatusCode values are OTLP's.
+type StatusCode int
+
+const (
+	StatusUnset StatusCode = 0
+	StatusOK    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+// Sampler decides whether a new trace is recorded. It is only asked about
+// traces that start here; an incoming traceparent's decision is kept.
+type Sampler func(TraceID) bool
+
+func AlwaysSample(TraceID) bool { return true }
+
+func NeverSample(TraceID) bool { return false }
+
+// RatioSampler records about ratio of traces, deciding from the trace ID
+// alone so every service using the same ratio makes the same choice.
+func RatioSampler(ratio float64) Sampler {
+	if ratio >= 1 {
+		return AlwaysSample
+	}
+	if ratio <= 0 {
+		return NeverSample
+	}
+	bound := uint64(ratio * math.MaxInt64)
+	return func(id TraceID) bool {
+		return binary.BigEndian.Uint64(id[8:])>>1 < bound
+	}
+}
+
+type Config struct {
+	// ServiceName is reported as the service.name resource attribute.
+	// Empty means httpfromtcp.
+	ServiceName string
+	// Sampler is asked about traces that start here. Nil records them all.
+	Sampler Sampler
+	// Exporter receives finished, sampled spans in batches. Nil still
+	// propagates trace context but records nothing.
+	Exporter Exporter
+	// BatchSize spans are sent at once, or whatever has finished every
+	// FlushInterval. Zero means 512 spans and 5s.
+	BatchSize     int
+	FlushInterval time.Duration
+	// Logger receives export failures. Nil means slog.Default.
+	Logger *slog.Logger
+}
+
+// Tracer starts a server span for every request and exports the spans of
+// sampled traces.
+type Tracer struct {
+	cfg   Config
+	queue chan *Span
+	done  chan struct{}
+	wg    sync.WaitGroup
+	once  sync.Once
+}
+
+func New(cfg Config) *Tracer {
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = defaultServiceName
+	}
+	if cfg.Sampler == nil {
+		cfg.Sampler = AlwaysSample
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultBatchSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = defaultFlushInterval
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	t := &Tracer{
+		cfg:   cfg,
+		queue: make(chan *Span, 4*cfg.BatchSize),
+		done:  make(chan struct{}),
+	}
+	if cfg.Exporter != nil {
+		t.wg.Add(1)
+		go t.export()
+	}
+	return t
+}
+
+// Close exports the spans that have finished and stops exporting.
+func (t *Tracer) Close() error {
+	t.once.Do(func() {
+		close(t.done)
+	})
+	t.wg.Wait()
+	return nil
+}
+
+func (t *Tracer) export() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(t.cfg.FlushInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), t.cfg.FlushInterval)
+		defer cancel()
+		if err := t.cfg.Exporter.Export(ctx, t.cfg.ServiceName, batch); err != nil {
+			t.cfg.Logger.Warn("span export failed", "spans", len(batch), "err", err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) >= t.cfg.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.done:
+			for {
+				select {
+				case s := <-t.queue:
+					batch = append(batch, s)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// finish queues an ended span for export. A full queue drops it rather
+// than hold up the request.
+func (t *Tracer) finish(s *Span) {
+	if t.cfg.Exporter == nil {
+		return
+	}
+	select {
+	case <-t.done:
+	case t.queue <- s:
+	default:
+	}
+}
+
+// Wrap starts a server span around next, continuing the trace in the
+// request's traceparent header if it has a valid one. Handlers find it
+// with SpanFromContext and add children with Start.
+func (t *Tracer) Wrap(next server.Handler) server.Handler {
+	return func(w *response.Writer, r *request.Request) {
+		method := request.StandardMethod(r.RequestLine.Method)
+		path, _, _ := strings.Cut(r.RequestLine.RequestTarget, "?")
+		ctx, span := t.start(r.Context(), Extract(r), method, KindServer)
+		span.SetAttribute("http.request.method", method)
+		if method != r.RequestLine.Method {
+			span.SetAttribute("http.request.method_original", r.RequestLine.Method)
+		}
+		span.SetAttribute("url.path", path)
+		span.SetAttribute("network.protocol.version", r.RequestLine.HttpVersion)
+		if r.Scheme != "" {
+			span.SetAttribute("url.scheme", r.Scheme)
+		}
+		if r.Host != "" {
+			span.SetAttribute("server.address", r.Host)
+		}
+		if r.ClientIP.IsValid() {
+			span.SetAttribute("client.address", r.ClientIP.String())
+		}
+		if ua, ok := r.Headers.Get("user-agent"); ok {
+			span.SetAttribute("user_agent.original", ua)
+		}
+
+		returned := false
+		defer func() {
+			code := w.Status()
+			// The server answers a handler that panicked before writing
+			// anything with a 500.
+			if !returned && code == 0 {
+				code = response.INTERNAL_SERVER_ERROR
+			}
+			if code != 0 {
+				span.SetAttribute("http.response.status_code", int(code))
+			}
+			if code >= 500 || !returned {
+				span.SetStatus(StatusError, "")
+			}
+			span.End()
+		}()
+		next(w, r.WithContext(ctx))
+		returned = true
+	}
+}
+
+// Extract returns the span context in r's traceparent and tracestate
+// headers, or the zero SpanContext if there is no valid traceparent. An
+// invalid tracestate is dropped on its own.
+func Extract(r *request.Request) SpanContext {
+	v, ok := r.Headers.Get("traceparent")
+	if !ok {
+		return SpanContext{}
+	}
+	sc, err := ParseTraceparent(strings.TrimSpace(v))
+	if err != nil {
+		return SpanContext{}
+	}
+	if v, ok := r.Headers.Get("tracestate"); ok {
+		sc.TraceState, _ = ParseTracestate(v)
+	}
+	return sc
+}
+
+func (t *Tracer) start(ctx context.Context, parent SpanContext, name string, kind SpanKind) (context.Context, *Span) {
+	s := &Span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+	}
+	if parent.IsValid() {
+		s.parent = parent.SpanID
+		s.sc = SpanContext{TraceID: parent.TraceID, Sampled: parent.Sampled, TraceState: parent.TraceState}
+	} else {
+		s.sc.TraceID = newTraceID()
+		s.sc.Sampled = t.cfg.Sampler(s.sc.TraceID)
+	}
+	s.sc.SpanID = newSpanID()
+	return ContextWithSpan(ctx, s), s
+}
+
+type contextKey struct{}
+
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, contextKey{}, s)
+}
+
+// SpanFromContext returns the span ctx is in, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(contextKey{}).(*Span)
+	return s
+}
+
+// Start begins a child of the span ctx is in. Without one, as when tracing
+// is off, the span it returns records nothing and ctx is returned as is.
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil || parent.tracer == nil {
+		return ctx, &Span{}
+	}
+	return parent.tracer.start(ctx, parent.sc, name, kind)
+}
+
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// Span is one timed operation in a trace. Its methods are safe to call
+// from several goroutines, and do nothing once it has ended.
+type Span struct {
+	tracer *Tracer
+	sc     SpanContext
+	parent SpanID
+	name   string
+	kind   SpanKind
+	start  time.Time
+
+	mu            sync.Mutex
+	end           time.Time
+	ended         bool
+	attributes    []Attribute
+	status        StatusCode
+	statusMessage string
+}
+
+func (s *Span) Context() SpanContext {
+	return s.sc
+}
+
+// IsRecording reports whether the span will be exported, so handlers can
+// skip working out attributes nobody will see.
+func (s *Span) IsRecording() bool {
+	return s.tracer != nil && s.sc.Sampled
+}
+
+// SetAttribute sets key to value, which is kept as a string, bool, int64
+// or float64; anything else is formatted with fmt.
+func (s *Span) SetAttribute(key string, value any) {
+	if !s.IsRecording() {
+		return
+	}
+	switch v := value.(type) {
+	case string, bool, int64, float64:
+	case int:
+		value = int64(v)
+	case int32:
+		value = int64(v)
+	case uint32:
+		value = int64(v)
+	case float32:
+		value = float64(v)
+	default:
+		value = fmt.Sprint(v)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	for i := range s.attributes {
+		if s.attributes[i].Key == key {
+			s.attributes[i].Value = value
+			return
+		}
+	}
+	s.attributes = append(s.attributes, Attribute{key, value})
+}
+
+func (s *Span) SetStatus(code StatusCode, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ended {
+		s.status, s.statusMessage = code, message
+	}
+}
+
+// RecordError marks the span failed with err's message.
+func (s *Span) RecordError(err error) {
+	if err != nil {
+		s.SetStatus(StatusError, err.Error())
+	}
+}
+
+func (s *Span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	if s.IsRecording() {
+		s.tracer.finish(s)
+	}
+}
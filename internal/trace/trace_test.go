@@ -0,0 +1,214 @@
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	server "github.com/Barrioslopezfd/httpfromtcp/cmd/server"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func send(t *testing.T, addr string, raw string) *http.Response {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte(raw))
+	require.NoError(t, err)
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	io.ReadAll(res.Body)
+	res.Body.Close()
+	return res
+}
+
+// exported decodes the spans in OTLP JSON lines, keyed by name.
+func exported(t *testing.T, out string) map[string]map[string]any {
+	t.Helper()
+	spans := map[string]map[string]any{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		var req struct {
+			ResourceSpans []struct {
+				Resource   map[string]any
+				ScopeSpans []struct {
+					Spans []map[string]any
+				}
+			}
+		}
+		require.NoError(t, json.Unmarshal([]byte(line), &req))
+		for _, rs := range req.ResourceSpans {
+			assert.Equal(t, []any{map[string]any{"key": "service.name", "value": map[string]any{"stringValue": "test"}}}, rs.Resource["attributes"])
+			for _, ss := range rs.ScopeSpans {
+				for _, span := range ss.Spans {
+					spans[span["name"].(string)] = span
+				}
+			}
+		}
+	}
+	return spans
+}
+
+func attributes(span map[string]any) map[string]any {
+	out := map[string]any{}
+	attrs, _ := span["attributes"].([]any)
+	for _, a := range attrs {
+		kv := a.(map[string]any)
+		for _, v := range kv["value"].(map[string]any) {
+			out[kv["key"].(string)] = v
+		}
+	}
+	return out
+}
+
+func TestTracer(t *testing.T) {
+	handler := func(w *response.Writer, r *request.Request) {
+		_, child := Start(r.Context(), "lookup", KindInternal)
+		child.SetAttribute("rows", 3)
+		child.SetAttribute("cached", true)
+		child.End()
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders())
+	}
+	var out syncBuffer
+	tracer := New(Config{ServiceName: "test", Exporter: NewFileExporter(&out)})
+	srv, err := server.Serve(tracer.Wrap(handler), 0)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: An incoming sampled trace is continued by a server span with a child
+	send(t, srv.Addr().String(), "GET /things?x=1 HTTP/1.1\r\nHost: localhost\r\nTraceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\r\nTracestate: rojo=1\r\n\r\n")
+	require.NoError(t, tracer.Close())
+
+	spans := exported(t, out.String())
+	require.Len(t, spans, 2)
+	parent, child := spans["GET"], spans["lookup"]
+	require.NotNil(t, parent)
+	require.NotNil(t, child)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", parent["traceId"])
+	assert.Equal(t, "00f067aa0ba902b7", parent["parentSpanId"])
+	assert.Equal(t, "rojo=1", parent["traceState"])
+	assert.EqualValues(t, KindServer, parent["kind"])
+	assert.Equal(t, parent["traceId"], child["traceId"])
+	assert.Equal(t, parent["spanId"], child["parentSpanId"])
+	assert.EqualValues(t, KindInternal, child["kind"])
+
+	attrs := attributes(parent)
+	assert.Equal(t, "GET", attrs["http.request.method"])
+	assert.Equal(t, "/things", attrs["url.path"])
+	assert.Equal(t, "200", attrs["http.response.status_code"])
+	attrs = attributes(child)
+	assert.Equal(t, "3", attrs["rows"])
+	assert.Equal(t, true, attrs["cached"])
+}
+
+func TestTracerOtherMethod(t *testing.T) {
+	handler := func(w *response.Writer, r *request.Request) {
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders())
+	}
+	var out syncBuffer
+	tracer := New(Config{ServiceName: "test", Exporter: NewFileExporter(&out)})
+	srv, err := server.Serve(tracer.Wrap(handler), 0)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: Non-standard methods are named OTHER, keeping the original as an attribute
+	send(t, srv.Addr().String(), "BREW /pot HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, tracer.Close())
+
+	spans := exported(t, out.String())
+	require.Len(t, spans, 1)
+	require.NotNil(t, spans["OTHER"])
+	attrs := attributes(spans["OTHER"])
+	assert.Equal(t, "OTHER", attrs["http.request.method"])
+	assert.Equal(t, "BREW", attrs["http.request.method_original"])
+}
+
+func TestSampling(t *testing.T) {
+	var got SpanContext
+	handler := func(w *response.Writer, r *request.Request) {
+		got = SpanFromContext(r.Context()).Context()
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders())
+	}
+	var out syncBuffer
+	tracer := New(Config{ServiceName: "test", Sampler: NeverSample, Exporter: NewFileExporter(&out)})
+	srv, err := server.Serve(tracer.Wrap(handler), 0)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: New traces follow the sampler, but still get a context to propagate
+	send(t, srv.Addr().String(), "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, got.IsValid())
+	assert.False(t, got.Sampled)
+
+	// Test: An incoming decision wins over the sampler
+	send(t, srv.Addr().String(), "GET / HTTP/1.1\r\nHost: localhost\r\nTraceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\r\n\r\n")
+	assert.True(t, got.Sampled)
+	require.NoError(t, tracer.Close())
+	assert.Len(t, exported(t, out.String()), 1)
+
+	// Test: The ratio sampler decides from the trace ID
+	half := RatioSampler(0.5)
+	assert.True(t, half(TraceID{8: 0x00}))
+	assert.False(t, half(TraceID{8: 0xff}))
+	kept := 0
+	for range 1000 {
+		if half(newTraceID()) {
+			kept++
+		}
+	}
+	assert.InDelta(t, 500, kept, 100)
+}
+
+func TestHTTPExporter(t *testing.T) {
+	var body []byte
+	var contentType string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer collector.Close()
+
+	// Test: Spans are posted as OTLP JSON when the tracer closes
+	tracer := New(Config{ServiceName: "test", Exporter: NewHTTPExporter(collector.URL + "/v1/traces")})
+	span := &Span{tracer: tracer, name: "job", kind: KindInternal, start: time.Now()}
+	span.sc = SpanContext{TraceID: newTraceID(), SpanID: newSpanID(), Sampled: true}
+	span.RecordError(io.ErrUnexpectedEOF)
+	span.End()
+	require.NoError(t, tracer.Close())
+
+	assert.Equal(t, "application/json", contentType)
+	job := exported(t, string(body))["job"]
+	require.NotNil(t, job)
+	assert.Equal(t, map[string]any{"code": float64(StatusError), "message": "unexpected EOF"}, job["status"])
+}
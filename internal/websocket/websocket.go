@@ -0,0 +1,531 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Barrioslopezfd/httpfromtcp/internal/headers"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/response"
+)
+
+const (
+	acceptGUID            = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	defaultMaxMessageSize = 1 << 20
+	maxControlPayload     = 125
+	closeTimeout          = 5 * time.Second
+)
+
+type MessageType int
+
+const (
+	TEXT_MESSAGE   MessageType = 0x1
+	BINARY_MESSAGE MessageType = 0x2
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+type StatusCode uint16
+
+const (
+	CLOSE_NORMAL              StatusCode = 1000
+	CLOSE_GOING_AWAY          StatusCode = 1001
+	CLOSE_PROTOCOL_ERROR      StatusCode = 1002
+	CLOSE_UNSUPPORTED_DATA    StatusCode = 1003
+	CLOSE_NO_STATUS           StatusCode = 1005
+	CLOSE_ABNORMAL            StatusCode = 1006
+	CLOSE_INVALID_PAYLOAD     StatusCode = 1007
+	CLOSE_POLICY_VIOLATION    StatusCode = 1008
+	CLOSE_MESSAGE_TOO_BIG     StatusCode = 1009
+	CLOSE_MANDATORY_EXTENSION StatusCode = 1010
+	CLOSE_INTERNAL_ERROR      StatusCode = 1011
+)
+
+// validCloseCode reports whether code may appear in a close frame. 1005 and
+// 1006 only exist for reporting locally.
+func validCloseCode(code StatusCode) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// CloseError is returned by ReadMessage once the connection is closing.
+type CloseError struct {
+	Code   StatusCode
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: closed with %d %s", e.Code, e.Reason)
+}
+
+var (
+	ErrBadHandshake = errors.New("websocket: bad handshake")
+	ErrClosed       = errors.New("websocket: close already sent")
+)
+
+type Config struct {
+	// MaxMessageSize caps a reassembled message. Defaults to 1MB.
+	MaxMessageSize int64
+	// FragmentSize splits outgoing messages into frames of at most this many
+	// bytes. Zero sends every message as a single frame.
+	FragmentSize int
+	// Subprotocols lists what the server speaks, in order of preference.
+	Subprotocols []string
+	// CheckOrigin rejects cross-origin handshakes when it returns false. Nil
+	// accepts any origin.
+	CheckOrigin func(r *request.Request) bool
+}
+
+type Conn struct {
+	conn           net.Conn
+	maxMessageSize int64
+	fragmentSize   int
+	Subprotocol    string
+
+	// rmu is held by whoever is reading frames: ReadMessage, or Close
+	// waiting for the peer's answer when nobody else is.
+	rmu    sync.Mutex
+	reader *bufio.Reader
+	// closeRecv is closed once the peer's close frame, or a read error,
+	// ends reading.
+	closeRecv chan struct{}
+	recvOnce  sync.Once
+
+	wmu       sync.Mutex
+	closeSent bool
+}
+
+// Upgrade validates the handshake in r, answers it with a 101 through w and
+// takes over the connection. On a bad handshake the error response has
+// already been written when it returns.
+func Upgrade(w *response.Writer, r *request.Request, cfg Config) (*Conn, error) {
+	if err := checkHandshake(r); err != nil {
+		h := response.GetDefaultHeaders()
+		code := response.BAD_REQUEST
+		if v, _ := r.Headers.Get("sec-websocket-version"); v != "13" {
+			code = response.UPGRADE_REQUIRED
+			h.Replace("Sec-WebSocket-Version", "13")
+		}
+		writeError(w, code, h)
+		return nil, err
+	}
+	if cfg.CheckOrigin != nil && !cfg.CheckOrigin(r) {
+		writeError(w, response.FORBIDDEN, response.GetDefaultHeaders())
+		return nil, fmt.Errorf("%w: origin not allowed", ErrBadHandshake)
+	}
+	if _, ok := w.Writer.(response.Hijacker); !ok || w.Sink != nil {
+		writeError(w, response.INTERNAL_SERVER_ERROR, response.GetDefaultHeaders())
+		return nil, response.ErrHijackUnsupported
+	}
+
+	key, _ := r.Headers.Get("sec-websocket-key")
+	h := headers.NewHeaders()
+	h.Replace("Upgrade", "websocket")
+	h.Replace("Connection", "Upgrade")
+	h.Replace("Sec-WebSocket-Accept", AcceptKey(key))
+	subprotocol := selectSubprotocol(r, cfg.Subprotocols)
+	if subprotocol != "" {
+		h.Replace("Sec-WebSocket-Protocol", subprotocol)
+	}
+	if err := w.WriteStatusLine(response.SWITCHING_PROTOCOLS); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+
+	conn, rest, err := w.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{
+		conn:           conn,
+		reader:         bufio.NewReader(io.MultiReader(bytes.NewReader(rest), conn)),
+		maxMessageSize: cfg.MaxMessageSize,
+		fragmentSize:   cfg.FragmentSize,
+		Subprotocol:    subprotocol,
+		closeRecv:      make(chan struct{}),
+	}
+	if c.maxMessageSize <= 0 {
+		c.maxMessageSize = defaultMaxMessageSize
+	}
+	return c, nil
+}
+
+func writeError(w *response.Writer, code response.Code, h headers.Headers) {
+	if err := w.WriteStatusLine(code); err != nil {
+		return
+	}
+	w.WriteHeaders(h)
+}
+
+func checkHandshake(r *request.Request) error {
+	if r.RequestLine.Method != "GET" {
+		return fmt.Errorf("%w: method %s", ErrBadHandshake, r.RequestLine.Method)
+	}
+	if r.RequestLine.HttpVersion != "1.1" {
+		return fmt.Errorf("%w: HTTP/%s", ErrBadHandshake, r.RequestLine.HttpVersion)
+	}
+	if v, _ := r.Headers.Get("connection"); !hasToken(v, "upgrade") {
+		return fmt.Errorf("%w: missing Connection: upgrade", ErrBadHandshake)
+	}
+	if v, _ := r.Headers.Get("upgrade"); !hasToken(v, "websocket") {
+		return fmt.Errorf("%w: missing Upgrade: websocket", ErrBadHandshake)
+	}
+	if v, _ := r.Headers.Get("sec-websocket-version"); v != "13" {
+		return fmt.Errorf("%w: unsupported version %q", ErrBadHandshake, v)
+	}
+	key, _ := r.Headers.Get("sec-websocket-key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return fmt.Errorf("%w: invalid Sec-WebSocket-Key", ErrBadHandshake)
+	}
+	return nil
+}
+
+func hasToken(value string, token string) bool {
+	for _, part := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
+
+func selectSubprotocol(r *request.Request, supported []string) string {
+	offered, _ := r.Headers.Get("sec-websocket-protocol")
+	for _, p := range supported {
+		if hasToken(offered, p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// AcceptKey computes Sec-WebSocket-Accept for a client's Sec-WebSocket-Key.
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// NetConn exposes the connection for deadlines and addresses.
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+type frame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+// nextFrame reads one client frame, noting when the peer's close or a
+// broken connection has ended reading. The caller must hold rmu.
+func (c *Conn) nextFrame(limit int64) (*frame, error) {
+	f, err := c.readFrame(limit)
+	var ce *CloseError
+	if (err != nil && !errors.As(err, &ce)) || (err == nil && f.opcode == opClose) {
+		c.recvOnce.Do(func() { close(c.closeRecv) })
+	}
+	return f, err
+}
+
+// readFrame reads one client frame, refusing anything larger than limit
+// before allocating for it.
+func (c *Conn) readFrame(limit int64) (*frame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.reader, head[:]); err != nil {
+		return nil, err
+	}
+	f := &frame{
+		fin:    head[0]&0x80 != 0,
+		opcode: head[0] & 0x0f,
+	}
+	if head[0]&0x70 != 0 {
+		return nil, &CloseError{CLOSE_PROTOCOL_ERROR, "reserved bits set"}
+	}
+	if head[1]&0x80 == 0 {
+		return nil, &CloseError{CLOSE_PROTOCOL_ERROR, "client frame not masked"}
+	}
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		if length>>63 != 0 {
+			return nil, &CloseError{CLOSE_PROTOCOL_ERROR, "invalid payload length"}
+		}
+	}
+
+	if f.opcode >= opClose {
+		if !f.fin || length > maxControlPayload {
+			return nil, &CloseError{CLOSE_PROTOCOL_ERROR, "invalid control frame"}
+		}
+	} else if length > uint64(limit) {
+		return nil, &CloseError{CLOSE_MESSAGE_TOO_BIG, "message too big"}
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+		return nil, err
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, f.payload); err != nil {
+		return nil, err
+	}
+	for i := range f.payload {
+		f.payload[i] ^= mask[i%4]
+	}
+	return f, nil
+}
+
+// ReadMessage returns the next complete message, answering pings and
+// reassembling fragments along the way. When the peer closes, or sends
+// something that forces a close, the close handshake is answered and a
+// *CloseError is returned. Only one goroutine may read at a time, though
+// Close may be called from another.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	var msgType MessageType
+	var msg []byte
+	inMessage := false
+	for {
+		f, err := c.nextFrame(c.maxMessageSize - int64(len(msg)))
+		if err != nil {
+			return 0, nil, c.failed(err)
+		}
+		switch f.opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, true, f.payload); err != nil && err != ErrClosed {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			return 0, nil, c.closeReceived(f.payload)
+		case opText, opBinary:
+			if inMessage {
+				return 0, nil, c.failed(&CloseError{CLOSE_PROTOCOL_ERROR, "new message before previous one ended"})
+			}
+			inMessage = true
+			msgType = MessageType(f.opcode)
+		case opContinuation:
+			if !inMessage {
+				return 0, nil, c.failed(&CloseError{CLOSE_PROTOCOL_ERROR, "continuation without a message"})
+			}
+		default:
+			return 0, nil, c.failed(&CloseError{CLOSE_PROTOCOL_ERROR, "unknown opcode"})
+		}
+
+		msg = append(msg, f.payload...)
+		if !f.fin {
+			continue
+		}
+		if msgType == TEXT_MESSAGE && !utf8.Valid(msg) {
+			return 0, nil, c.failed(&CloseError{CLOSE_INVALID_PAYLOAD, "invalid UTF-8"})
+		}
+		if msg == nil {
+			msg = []byte{}
+		}
+		return msgType, msg, nil
+	}
+}
+
+// failed runs the close handshake for protocol violations found while
+// reading. Plain I/O errors are returned as they are.
+func (c *Conn) failed(err error) error {
+	var ce *CloseError
+	if !errors.As(err, &ce) {
+		return err
+	}
+	if c.writeClose(ce.Code, ce.Reason) == nil {
+		c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+		c.drain()
+	}
+	c.conn.Close()
+	return err
+}
+
+func (c *Conn) closeReceived(payload []byte) error {
+	ce := &CloseError{Code: CLOSE_NO_STATUS}
+	switch {
+	case len(payload) == 1:
+		return c.failed(&CloseError{CLOSE_PROTOCOL_ERROR, "invalid close payload"})
+	case len(payload) >= 2:
+		ce.Code = StatusCode(binary.BigEndian.Uint16(payload))
+		ce.Reason = string(payload[2:])
+		if !validCloseCode(ce.Code) {
+			return c.failed(&CloseError{CLOSE_PROTOCOL_ERROR, "invalid close code"})
+		}
+		if !utf8.ValidString(ce.Reason) {
+			return c.failed(&CloseError{CLOSE_INVALID_PAYLOAD, "invalid UTF-8 in close reason"})
+		}
+	}
+
+	echo := ce.Code
+	if echo == CLOSE_NO_STATUS {
+		echo = CLOSE_NORMAL
+	}
+	c.writeClose(echo, "")
+	c.conn.Close()
+	return ce
+}
+
+func (c *Conn) writeFrame(opcode byte, fin bool, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	if opcode == opClose {
+		c.closeSent = true
+	}
+	return c.writeFrameLocked(opcode, fin, payload)
+}
+
+func (c *Conn) writeFrameLocked(opcode byte, fin bool, payload []byte) error {
+	buf := make([]byte, 0, 10+len(payload))
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	buf = append(buf, b0)
+	switch n := len(payload); {
+	case n <= 125:
+		buf = append(buf, byte(n))
+	case n <= 0xffff:
+		buf = append(buf, 126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, 127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+	buf = append(buf, payload...)
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// WriteMessage sends one message, split into fragments when the
+// configured FragmentSize calls for it.
+func (c *Conn) WriteMessage(t MessageType, data []byte) error {
+	if t != TEXT_MESSAGE && t != BINARY_MESSAGE {
+		return fmt.Errorf("websocket: invalid message type %d", t)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	opcode := byte(t)
+	for {
+		chunk := data
+		if c.fragmentSize > 0 && len(chunk) > c.fragmentSize {
+			chunk = chunk[:c.fragmentSize]
+		}
+		data = data[len(chunk):]
+		if err := c.writeFrameLocked(opcode, len(data) == 0, chunk); err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			return nil
+		}
+		opcode = opContinuation
+	}
+}
+
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > maxControlPayload {
+		return errors.New("websocket: ping payload too long")
+	}
+	return c.writeFrame(opPing, true, data)
+}
+
+func (c *Conn) writeClose(code StatusCode, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > maxControlPayload {
+		payload = payload[:maxControlPayload]
+	}
+	return c.writeFrame(opClose, true, payload)
+}
+
+// Close sends a close frame and waits briefly for the peer's answer before
+// closing the connection. A ReadMessage running meanwhile sees the answer;
+// otherwise Close reads up to it itself, discarding messages still in
+// flight from the peer.
+func (c *Conn) Close(code StatusCode, reason string) error {
+	if err := c.writeClose(code, reason); err != nil {
+		c.conn.Close()
+		if err == ErrClosed {
+			return nil
+		}
+		return err
+	}
+	// The deadline also bounds a ReadMessage that is in the way.
+	c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+	drained := make(chan struct{})
+	go func() {
+		c.rmu.Lock()
+		defer c.rmu.Unlock()
+		c.drain()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-c.closeRecv:
+	}
+	if err := c.conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// drain discards frames until the peer's close frame. The caller must hold
+// rmu.
+func (c *Conn) drain() {
+	for {
+		select {
+		case <-c.closeRecv:
+			return
+		default:
+		}
+		f, err := c.nextFrame(c.maxMessageSize)
+		if err != nil || f.opcode == opClose {
+			return
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	server "github.com/Barrioslopezfd/httpfromtcp/cmd/server"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/request"
+	"github.com/Barrioslopezfd/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func echoHandler(w *response.Writer, r *request.Request) {
+	conn, err := Upgrade(w, r, Config{MaxMessageSize: 1024, FragmentSize: 4, Subprotocols: []string{"chat"}})
+	if err != nil {
+		return
+	}
+	for {
+		t, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := conn.WriteMessage(t, msg); err != nil {
+			return
+		}
+	}
+}
+
+type testClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dial(t *testing.T, addr string, extra string) (*testClient, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("GET /ws HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		extra +
+		"\r\n"))
+	require.NoError(t, err)
+
+	reader := bufio.NewReader(conn)
+	var head strings.Builder
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		head.WriteString(line)
+		if line == "\r\n" {
+			break
+		}
+	}
+	return &testClient{conn: conn, reader: reader}, head.String()
+}
+
+func (c *testClient) writeFrame(t *testing.T, b0 byte, payload []byte) {
+	t.Helper()
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	buf := []byte{b0}
+	switch n := len(payload); {
+	case n <= 125:
+		buf = append(buf, 0x80|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, 0x80|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, 0x80|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+	buf = append(buf, mask[:]...)
+	for i, b := range payload {
+		buf = append(buf, b^mask[i%4])
+	}
+	_, err := c.conn.Write(buf)
+	require.NoError(t, err)
+}
+
+func (c *testClient) readFrame(t *testing.T) (byte, []byte) {
+	t.Helper()
+	var head [2]byte
+	_, err := io.ReadFull(c.reader, head[:])
+	require.NoError(t, err)
+	require.Zero(t, head[1]&0x80, "server frames must not be masked")
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(c.reader, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(c.reader, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(c.reader, payload)
+	require.NoError(t, err)
+	return head[0], payload
+}
+
+// readMessage joins fragments and returns the opcode of the first frame.
+func (c *testClient) readMessage(t *testing.T) (byte, []byte, int) {
+	t.Helper()
+	var msg []byte
+	var opcode byte
+	frames := 0
+	for {
+		b0, payload := c.readFrame(t)
+		if frames == 0 {
+			opcode = b0 & 0x0f
+		}
+		frames++
+		msg = append(msg, payload...)
+		if b0&0x80 != 0 {
+			return opcode, msg, frames
+		}
+	}
+}
+
+func closeCode(payload []byte) StatusCode {
+	if len(payload) < 2 {
+		return CLOSE_NO_STATUS
+	}
+	return StatusCode(binary.BigEndian.Uint16(payload))
+}
+
+func TestAcceptKey(t *testing.T) {
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestWebSocket(t *testing.T) {
+	srv, err := server.Serve(echoHandler, 0)
+	require.NoError(t, err)
+	defer srv.Close()
+	addr := srv.Addr().String()
+
+	// Test: Handshake
+	c, head := dial(t, addr, "Sec-WebSocket-Version: 13\r\nSec-WebSocket-Protocol: foo, chat\r\n")
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 101 Switching Protocols\r\n"))
+	assert.Contains(t, head, "sec-websocket-accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n")
+	assert.Contains(t, head, "sec-websocket-protocol: chat\r\n")
+
+	// Test: Text echo comes back fragmented
+	c.writeFrame(t, 0x81, []byte("hello world"))
+	opcode, msg, frames := c.readMessage(t)
+	assert.Equal(t, byte(opText), opcode)
+	assert.Equal(t, "hello world", string(msg))
+	assert.Equal(t, 3, frames)
+
+	// Test: Fragmented binary with a ping in the middle
+	c.writeFrame(t, 0x02, []byte{1, 2})
+	c.writeFrame(t, 0x89, []byte("are you there"))
+	c.writeFrame(t, 0x80, []byte{3})
+	b0, payload := c.readFrame(t)
+	assert.Equal(t, byte(0x8a), b0)
+	assert.Equal(t, "are you there", string(payload))
+	opcode, msg, _ = c.readMessage(t)
+	assert.Equal(t, byte(opBinary), opcode)
+	assert.Equal(t, []byte{1, 2, 3}, msg)
+
+	// Test: Close handshake echoes the code
+	c.writeFrame(t, 0x88, binary.BigEndian.AppendUint16(nil, uint16(CLOSE_GOING_AWAY)))
+	b0, payload = c.readFrame(t)
+	assert.Equal(t, byte(0x88), b0)
+	assert.Equal(t, CLOSE_GOING_AWAY, closeCode(payload))
+
+	// Test: Unmasked frames are a protocol error
+	c, _ = dial(t, addr, "Sec-WebSocket-Version: 13\r\n")
+	c.conn.Write([]byte{0x81, 0x02, 'h', 'i'})
+	_, payload = c.readFrame(t)
+	assert.Equal(t, CLOSE_PROTOCOL_ERROR, closeCode(payload))
+
+	// Test: Messages over the limit are refused
+	c, _ = dial(t, addr, "Sec-WebSocket-Version: 13\r\n")
+	c.writeFrame(t, 0x02, bytes.Repeat([]byte{'a'}, 1000))
+	c.writeFrame(t, 0x80, bytes.Repeat([]byte{'a'}, 100))
+	_, payload = c.readFrame(t)
+	assert.Equal(t, CLOSE_MESSAGE_TOO_BIG, closeCode(payload))
+
+	// Test: Text must be UTF-8
+	c, _ = dial(t, addr, "Sec-WebSocket-Version: 13\r\n")
+	c.writeFrame(t, 0x81, []byte{0xff, 0xfe})
+	_, payload = c.readFrame(t)
+	assert.Equal(t, CLOSE_INVALID_PAYLOAD, closeCode(payload))
+
+	// Test: Wrong version gets 426 with the supported one
+	_, head = dial(t, addr, "Sec-WebSocket-Version: 8\r\n")
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 426 Upgrade Required\r\n"))
+	assert.Contains(t, head, "sec-websocket-version: 13\r\n")
+}
+
+func TestCloseWhileReading(t *testing.T) {
+	var wg sync.WaitGroup
+	readErr := make(chan error, 1)
+	closeErr := make(chan error, 1)
+	handler := func(w *response.Writer, r *request.Request) {
+		conn, err := Upgrade(w, r, Config{})
+		if err != nil {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					readErr <- err
+					return
+				}
+			}
+		}()
+		time.Sleep(50 * time.Millisecond)
+		closeErr <- conn.Close(CLOSE_GOING_AWAY, "bye")
+		wg.Wait()
+	}
+	srv, err := server.Serve(handler, 0)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: Close from another goroutine leaves the reading to ReadMessage
+	c, _ := dial(t, srv.Addr().String(), "Sec-WebSocket-Version: 13\r\n")
+	c.writeFrame(t, 0x81, []byte("in flight"))
+	b0, payload := c.readFrame(t)
+	assert.Equal(t, byte(0x88), b0)
+	assert.Equal(t, CLOSE_GOING_AWAY, closeCode(payload))
+	c.writeFrame(t, 0x88, binary.BigEndian.AppendUint16(nil, uint16(CLOSE_GOING_AWAY)))
+
+	select {
+	case err := <-closeErr:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close did not see the answer")
+	}
+	var ce *CloseError
+	require.ErrorAs(t, <-readErr, &ce)
+	assert.Equal(t, CLOSE_GOING_AWAY, ce.Code)
+}